@@ -0,0 +1,161 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// KeyLogName is the file in a capture directory that TLS secrets are
+// written to, in the SSLKEYLOGFILE format Wireshark reads.
+const KeyLogName = "keylog.txt"
+
+var connCount uint64
+
+// Conn records everything read from and written to a TCP connection as a
+// pcapng file. Wrap the TCP connection, not the TLS one on top of it, so the
+// capture holds the TLS records and can be decrypted with the key log.
+type Conn struct {
+	net.Conn
+
+	mu        sync.Mutex
+	file      *os.File
+	pcap      *PcapngWriter
+	stream    *tcpStream
+	local     bool // whether the local side is the TCP client
+	remoteFIN bool
+	closed    bool
+}
+
+// Open starts a capture of c in dir, named after the time and a counter.
+// isClient says whether we opened c or accepted it.
+func Open(dir string, c net.Conn, isClient bool) (*Conn, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("conn-%s-%d.pcapng", time.Now().Format("20060102-150405"), atomic.AddUint64(&connCount, 1))
+	file, err := os.Create(filepath.Join(dir, name))
+	if err != nil {
+		return nil, err
+	}
+	pcap, err := NewPcapngWriter(file)
+	if err != nil {
+		file.Close()
+		return nil, err
+	}
+
+	conn := &Conn{Conn: c, file: file, pcap: pcap, local: isClient}
+	if isClient {
+		conn.stream = newTCPStream(c.LocalAddr(), c.RemoteAddr())
+	} else {
+		conn.stream = newTCPStream(c.RemoteAddr(), c.LocalAddr())
+	}
+	conn.write(conn.stream.handshake())
+	return conn, nil
+}
+
+func (c *Conn) Read(b []byte) (int, error) {
+	n, err := c.Conn.Read(b)
+	c.mu.Lock()
+	if n > 0 {
+		c.write(c.stream.data(!c.local, b[:n]))
+	}
+	if err == io.EOF && !c.remoteFIN {
+		c.remoteFIN = true
+		c.write([][]byte{c.stream.fin(!c.local)})
+	}
+	c.mu.Unlock()
+	return n, err
+}
+
+func (c *Conn) Write(b []byte) (int, error) {
+	n, err := c.Conn.Write(b)
+	if n > 0 {
+		c.mu.Lock()
+		c.write(c.stream.data(c.local, b[:n]))
+		c.mu.Unlock()
+	}
+	return n, err
+}
+
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if !c.closed {
+		c.closed = true
+		c.write([][]byte{c.stream.fin(c.local)})
+		c.file.Close()
+	}
+	c.mu.Unlock()
+	return c.Conn.Close()
+}
+
+// write saves packets, and gives up on the capture rather than the
+// connection if the file can't be written.
+func (c *Conn) write(packets [][]byte) {
+	if c.closed || c.pcap == nil {
+		return
+	}
+	now := time.Now()
+	for _, packet := range packets {
+		if err := c.pcap.WritePacket(now, packet); err != nil {
+			slog.Warn("Stopping capture", "err", err)
+			c.pcap = nil
+			return
+		}
+	}
+}
+
+var (
+	keyLogMu    sync.Mutex
+	keyLogFiles = map[string]*os.File{}
+)
+
+// KeyLogWriter returns the key log in dir, for tls.Config.KeyLogWriter. Every
+// connection captured in dir shares it, and Wireshark picks the secrets of
+// each session by its client random.
+func KeyLogWriter(dir string) (io.Writer, error) {
+	keyLogMu.Lock()
+	defer keyLogMu.Unlock()
+
+	if f, ok := keyLogFiles[dir]; ok {
+		return f, nil
+	}
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	f, err := os.OpenFile(filepath.Join(dir, KeyLogName), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return nil, err
+	}
+	keyLogFiles[dir] = f
+	return f, nil
+}
+
+// Listener captures every connection it accepts in Dir.
+type Listener struct {
+	net.Listener
+	Dir string
+}
+
+func (l Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	conn, err := Open(l.Dir, c, false)
+	if err != nil {
+		slog.Warn("Not capturing", "peer", c.RemoteAddr(), "err", err)
+		return c, nil
+	}
+	return conn, nil
+}
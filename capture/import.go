@@ -0,0 +1,133 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+const (
+	clientPreface  = "PRI * HTTP/2.0\r\n\r\nSM\r\n\r\n"
+	frameHeaderLen = 9
+)
+
+// An ImportedSession is the HTTP/2 frames a client sent on one connection
+// of a capture.
+type ImportedSession struct {
+	Client, Server string
+	Frames         []replay.RawFrame
+}
+
+// Import reads the HTTP/2 connections in a pcap or pcapng file. TLS
+// connections are decrypted with keys, which may be nil for a cleartext h2c
+// capture. Connections that can't be decrypted or don't carry HTTP/2 are
+// logged and skipped.
+func Import(filename string, keys KeyLog) ([]ImportedSession, error) {
+	packets, err := ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	sessions := []ImportedSession{}
+	for _, stream := range Reassemble(packets) {
+		frames, err := streamFrames(stream, keys)
+		if err != nil {
+			slog.Info("Skipping connection", "client", stream.Client, "server", stream.Server, "err", err)
+			continue
+		}
+		sessions = append(sessions, ImportedSession{Client: stream.Client, Server: stream.Server, Frames: frames})
+	}
+	return sessions, nil
+}
+
+func streamFrames(stream *TCPStream, keys KeyLog) ([]replay.RawFrame, error) {
+	client, server := stream.ClientData, stream.ServerData
+	// Without the SYN, the first packet we saw may have been the server's.
+	if !stream.clientKnown && (looksLikeTLS(server) || bytes.Contains(server, []byte(clientPreface))) {
+		client, server = server, client
+		stream.Client, stream.Server = stream.Server, stream.Client
+	}
+
+	if looksLikeTLS(client) {
+		if keys == nil {
+			return nil, errors.New("TLS connection and no key log")
+		}
+		var err error
+		if client, _, err = decryptTLS(client, server, keys); err != nil {
+			return nil, err
+		}
+	}
+
+	// An h2c upgrade starts out as HTTP/1.1, and the preface follows the
+	// server's 101 response.
+	i := bytes.Index(client, []byte(clientPreface))
+	if i < 0 {
+		return nil, errors.New("no HTTP/2 connection preface")
+	}
+	return parseFrames(client[i+len(clientPreface):]), nil
+}
+
+// parseFrames splits b into frames, dropping a truncated one at the end.
+func parseFrames(b []byte) []replay.RawFrame {
+	frames := []replay.RawFrame{}
+	for len(b) >= frameHeaderLen {
+		length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+		if len(b) < frameHeaderLen+length {
+			break
+		}
+		frames = append(frames, replay.RawFrame{
+			FrameType: b[3],
+			Flags:     b[4],
+			StreamID:  binary.BigEndian.Uint32(b[5:]),
+			Payload:   append([]byte{}, b[frameHeaderLen:frameHeaderLen+length]...),
+		})
+		b = b[frameHeaderLen+length:]
+	}
+	return frames
+}
+
+// Run imports config.ImportFile and saves every session it finds as a
+// replay file in config.ImportDir, ready for -seeds or -minimize.
+func Run() error {
+	var keys KeyLog
+	if config.KeyLogFile != "" {
+		var err error
+		if keys, err = LoadKeyLog(config.KeyLogFile); err != nil {
+			return err
+		}
+	}
+
+	sessions, err := Import(config.ImportFile, keys)
+	if err != nil {
+		return err
+	}
+	if len(sessions) == 0 {
+		return errors.New("no HTTP/2 connections found in " + config.ImportFile)
+	}
+	if err := os.MkdirAll(config.ImportDir, 0755); err != nil {
+		return err
+	}
+
+	base := strings.TrimSuffix(filepath.Base(config.ImportFile), filepath.Ext(config.ImportFile))
+	for i, s := range sessions {
+		name := filepath.Join(config.ImportDir, fmt.Sprintf("%s-%d.json", base, i+1))
+		session := &replay.Session{Frames: s.Frames}
+		if err := session.Save(name); err != nil {
+			return err
+		}
+		fmt.Printf("%s -> %s: %d frames saved to %s\n", s.Client, s.Server, len(s.Frames), name)
+	}
+	return nil
+}
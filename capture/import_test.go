@@ -0,0 +1,158 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"bytes"
+	"crypto/tls"
+	"io"
+	"net"
+	"path/filepath"
+	"testing"
+
+	"github.com/c0nrad/http2fuzz/certs"
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// sessionFrames is what the client sends after the preface in the round
+// trip tests. The DATA frame spans several segments and TLS records.
+var sessionFrames = []replay.RawFrame{
+	{FrameType: 4, Payload: []byte{0, 3, 0, 0, 0, 100}},
+	{FrameType: 1, Flags: 4, StreamID: 1, Payload: []byte{0x82, 0x86, 0x84, 0x41, 0x09, 'l', 'o', 'c', 'a', 'l', 'h', 'o', 's', 't'}},
+	{FrameType: 0, Flags: 1, StreamID: 1, Payload: bytes.Repeat([]byte("h2fuzz"), 3000)},
+	{FrameType: 6, Payload: []byte("12345678")},
+	{FrameType: 7, Payload: []byte{0, 0, 0, 1, 0, 0, 0, 0}},
+}
+
+// serverSettings is the empty SETTINGS frame the server answers with.
+var serverSettings = replay.RawFrame{FrameType: 4}.Bytes()
+
+// captureSession sends sessionFrames over a loopback connection whose client
+// side is captured in dir, through TLS if clientConfig isn't nil, and
+// returns the capture file.
+func captureSession(t *testing.T, dir string, clientConfig *tls.Config) (string, tls.ConnectionState) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	served := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			served <- err
+			return
+		}
+		defer c.Close()
+		if clientConfig != nil {
+			cert, err := certs.Generate(config.CertValid, []string{"127.0.0.1"})
+			if err != nil {
+				served <- err
+				return
+			}
+			c = tls.Server(c, &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}})
+		}
+		if _, err := c.Write(serverSettings); err != nil {
+			served <- err
+			return
+		}
+		_, err = io.Copy(io.Discard, c)
+		served <- err
+	}()
+
+	raw, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	captured, err := Open(dir, raw, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var c net.Conn = captured
+	var state tls.ConnectionState
+	if clientConfig != nil {
+		if clientConfig.KeyLogWriter, err = KeyLogWriter(dir); err != nil {
+			t.Fatal(err)
+		}
+		tc := tls.Client(captured, clientConfig)
+		if err := tc.Handshake(); err != nil {
+			t.Fatal(err)
+		}
+		state = tc.ConnectionState()
+		c = tc
+	}
+
+	out := []byte(clientPreface)
+	for _, frame := range sessionFrames {
+		out = append(out, frame.Bytes()...)
+	}
+	if _, err := c.Write(out); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := io.ReadFull(c, make([]byte, len(serverSettings))); err != nil {
+		t.Fatal(err)
+	}
+	c.Close()
+	if err := <-served; err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "conn-*.pcapng"))
+	if err != nil || len(files) != 1 {
+		t.Fatalf("want one capture in %s, got %v (%v)", dir, files, err)
+	}
+	return files[0], state
+}
+
+func TestImportRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		config *tls.Config
+	}{
+		{"h2c", nil},
+		{"tls12-aes128", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256}}},
+		{"tls12-aes256", &tls.Config{MaxVersion: tls.VersionTLS12, CipherSuites: []uint16{tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384}}},
+		{"tls13", &tls.Config{MinVersion: tls.VersionTLS13}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dir := t.TempDir()
+			if tt.config != nil {
+				tt.config.InsecureSkipVerify = true
+				tt.config.NextProtos = []string{"h2"}
+			}
+			file, state := captureSession(t, dir, tt.config)
+			if _, ok := cipherSuites[state.CipherSuite]; tt.config != nil && !ok {
+				t.Skipf("negotiated %s, which Import can't decrypt", tls.CipherSuiteName(state.CipherSuite))
+			}
+
+			var keys KeyLog
+			if tt.config != nil {
+				var err error
+				if keys, err = LoadKeyLog(filepath.Join(dir, KeyLogName)); err != nil {
+					t.Fatal(err)
+				}
+			}
+			sessions, err := Import(file, keys)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(sessions) != 1 {
+				t.Fatalf("got %d sessions, want 1", len(sessions))
+			}
+			got := sessions[0].Frames
+			if len(got) != len(sessionFrames) {
+				t.Fatalf("got %d frames, want %d", len(got), len(sessionFrames))
+			}
+			for i, want := range sessionFrames {
+				if !bytes.Equal(got[i].Bytes(), want.Bytes()) {
+					t.Errorf("frame %d: got %x, want %x", i, got[i].Bytes(), want.Bytes())
+				}
+			}
+		})
+	}
+}
@@ -0,0 +1,80 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"encoding/binary"
+	"io"
+	"time"
+)
+
+// pcapng block types and the constants of the blocks we write.
+const (
+	blockSectionHeader   = 0x0a0d0d0a
+	blockInterface       = 0x00000001
+	blockSimplePacket    = 0x00000003
+	blockEnhancedPacket  = 0x00000006
+	byteOrderMagic       = 0x1a2b3c4d
+	linkTypeRaw          = 101 // packets start with an IPv4 or IPv6 header
+	sectionLengthUnknown = 0xffffffffffffffff
+)
+
+// PcapngWriter writes packets to a pcapng file with a single interface
+// whose packets are bare IP packets with microsecond timestamps.
+type PcapngWriter struct {
+	w io.Writer
+}
+
+func NewPcapngWriter(w io.Writer) (*PcapngWriter, error) {
+	pw := &PcapngWriter{w: w}
+
+	shb := make([]byte, 16)
+	binary.LittleEndian.PutUint32(shb[0:], byteOrderMagic)
+	binary.LittleEndian.PutUint16(shb[4:], 1)
+	binary.LittleEndian.PutUint16(shb[6:], 0)
+	binary.LittleEndian.PutUint64(shb[8:], sectionLengthUnknown)
+	if err := pw.writeBlock(blockSectionHeader, shb); err != nil {
+		return nil, err
+	}
+
+	idb := make([]byte, 8)
+	binary.LittleEndian.PutUint16(idb[0:], linkTypeRaw)
+	binary.LittleEndian.PutUint32(idb[4:], 0) // no snap length
+	if err := pw.writeBlock(blockInterface, idb); err != nil {
+		return nil, err
+	}
+	return pw, nil
+}
+
+// WritePacket writes one IP packet captured at t.
+func (pw *PcapngWriter) WritePacket(t time.Time, packet []byte) error {
+	ts := uint64(t.UnixNano() / int64(time.Microsecond))
+	body := make([]byte, 20, 20+len(packet)+3)
+	binary.LittleEndian.PutUint32(body[0:], 0) // interface id
+	binary.LittleEndian.PutUint32(body[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(body[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(body[12:], uint32(len(packet)))
+	binary.LittleEndian.PutUint32(body[16:], uint32(len(packet)))
+	body = append(body, packet...)
+	return pw.writeBlock(blockEnhancedPacket, body)
+}
+
+// writeBlock frames body, padded to 32 bits, with the block type and the
+// total length on both ends.
+func (pw *PcapngWriter) writeBlock(blockType uint32, body []byte) error {
+	for len(body)%4 != 0 {
+		body = append(body, 0)
+	}
+	total := uint32(12 + len(body))
+
+	b := make([]byte, 8, total)
+	binary.LittleEndian.PutUint32(b[0:], blockType)
+	binary.LittleEndian.PutUint32(b[4:], total)
+	b = append(b, body...)
+	b = append(b, 0, 0, 0, 0)
+	binary.LittleEndian.PutUint32(b[len(b)-4:], total)
+	_, err := pw.w.Write(b)
+	return err
+}
@@ -0,0 +1,246 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"math/bits"
+	"time"
+)
+
+// Link types we know how to find the IP header in.
+const (
+	linkTypeNull     = 0
+	linkTypeEthernet = 1
+	linkTypeLinuxSLL = 113
+	linkTypeIPv4     = 228
+	linkTypeIPv6     = 229
+)
+
+const (
+	pcapMagicMicro = 0xa1b2c3d4
+	pcapMagicNano  = 0xa1b23c4d
+)
+
+// A Packet is one captured link layer frame.
+type Packet struct {
+	Time     time.Time
+	LinkType uint16
+	Data     []byte
+}
+
+// ReadFile reads the packets of a pcap or pcapng file.
+func ReadFile(filename string) ([]Packet, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+	if len(data) < 4 {
+		return nil, errors.New(filename + ": too short for a capture file")
+	}
+	if binary.LittleEndian.Uint32(data) == blockSectionHeader {
+		return readPcapng(data)
+	}
+	return readPcap(data)
+}
+
+func readPcap(data []byte) ([]Packet, error) {
+	if len(data) < 24 {
+		return nil, errors.New("truncated pcap header")
+	}
+	var order binary.ByteOrder
+	var nano bool
+	for _, o := range []binary.ByteOrder{binary.LittleEndian, binary.BigEndian} {
+		switch o.Uint32(data) {
+		case pcapMagicMicro:
+			order = o
+		case pcapMagicNano:
+			order, nano = o, true
+		}
+	}
+	if order == nil {
+		return nil, fmt.Errorf("not a pcap or pcapng file (magic %x)", data[:4])
+	}
+	linkType := uint16(order.Uint32(data[20:]))
+
+	packets := []Packet{}
+	for off := 24; off+16 <= len(data); {
+		sec, frac := order.Uint32(data[off:]), order.Uint32(data[off+4:])
+		capLen := int(order.Uint32(data[off+8:]))
+		off += 16
+		if off+capLen > len(data) {
+			return packets, errors.New("truncated pcap record")
+		}
+		if !nano {
+			frac *= 1000
+		}
+		packets = append(packets, Packet{
+			Time:     time.Unix(int64(sec), int64(frac)),
+			LinkType: linkType,
+			Data:     data[off : off+capLen],
+		})
+		off += capLen
+	}
+	return packets, nil
+}
+
+// pcapngInterface is what packets need from their Interface Description
+// Block.
+type pcapngInterface struct {
+	linkType uint16
+	tsresol  byte  // if_tsresol, 6 (microseconds) unless the block says
+	tsoffset int64 // if_tsoffset, seconds added to every timestamp
+}
+
+// pcapng options of Interface Description Blocks.
+const (
+	optEndOfOpt = 0
+	optTSResol  = 9
+	optTSOffset = 14
+)
+
+func parseInterface(order binary.ByteOrder, body []byte) pcapngInterface {
+	iface := pcapngInterface{linkType: order.Uint16(body), tsresol: 6}
+	if len(body) < 8 {
+		return iface
+	}
+	for opts := body[8:]; len(opts) >= 4; {
+		code, n := order.Uint16(opts), int(order.Uint16(opts[2:]))
+		// Values are padded to 32 bits.
+		next := 4 + (n+3)&^3
+		if code == optEndOfOpt || next > len(opts) {
+			break
+		}
+		value := opts[4 : 4+n]
+		switch {
+		case code == optTSResol && n == 1:
+			iface.tsresol = value[0]
+		case code == optTSOffset && n == 8:
+			iface.tsoffset = int64(order.Uint64(value))
+		}
+		opts = opts[next:]
+	}
+	return iface
+}
+
+// timestamp converts ts, counted in the interface's units, to a time. The
+// top bit of if_tsresol picks powers of two over powers of ten.
+func (iface pcapngInterface) timestamp(ts uint64) time.Time {
+	exp := uint(iface.tsresol & 0x7f)
+	var sec, nsec uint64
+	if iface.tsresol&0x80 != 0 {
+		if exp > 63 {
+			exp = 63
+		}
+		sec = ts >> exp
+		hi, lo := bits.Mul64(ts&(1<<exp-1), uint64(time.Second))
+		nsec, _ = bits.Div64(hi, lo, 1<<exp)
+	} else {
+		if exp > 19 {
+			exp = 19
+		}
+		unit := pow10(exp)
+		sec, nsec = ts/unit, ts%unit
+		if exp < 9 {
+			nsec *= pow10(9 - exp)
+		} else {
+			nsec /= pow10(exp - 9)
+		}
+	}
+	return time.Unix(int64(sec)+iface.tsoffset, int64(nsec))
+}
+
+func pow10(n uint) uint64 {
+	p := uint64(1)
+	for ; n > 0; n-- {
+		p *= 10
+	}
+	return p
+}
+
+// readPcapng reads the enhanced and simple packet blocks of every section.
+func readPcapng(data []byte) ([]Packet, error) {
+	var order binary.ByteOrder = binary.LittleEndian
+	ifaces := []pcapngInterface{}
+	packets := []Packet{}
+
+	for off := 0; off+12 <= len(data); {
+		blockType := order.Uint32(data[off:])
+		if blockType == blockSectionHeader {
+			order = binary.LittleEndian
+			if order.Uint32(data[off+8:]) != byteOrderMagic {
+				order = binary.BigEndian
+			}
+			ifaces = ifaces[:0]
+		}
+		total := int(order.Uint32(data[off+4:]))
+		if total < 12 || off+total > len(data) {
+			return packets, errors.New("truncated pcapng block")
+		}
+		body := data[off+8 : off+total-4]
+		off += total
+
+		switch blockType {
+		case blockInterface:
+			if len(body) >= 2 {
+				ifaces = append(ifaces, parseInterface(order, body))
+			}
+		case blockEnhancedPacket:
+			if len(body) < 20 {
+				continue
+			}
+			iface := int(order.Uint32(body))
+			ts := uint64(order.Uint32(body[4:]))<<32 | uint64(order.Uint32(body[8:]))
+			capLen := int(order.Uint32(body[12:]))
+			if iface >= len(ifaces) || 20+capLen > len(body) {
+				continue
+			}
+			packets = append(packets, Packet{
+				Time:     ifaces[iface].timestamp(ts),
+				LinkType: ifaces[iface].linkType,
+				Data:     body[20 : 20+capLen],
+			})
+		case blockSimplePacket:
+			if len(body) < 4 || len(ifaces) == 0 {
+				continue
+			}
+			packets = append(packets, Packet{LinkType: ifaces[0].linkType, Data: body[4:]})
+		}
+	}
+	return packets, nil
+}
+
+// ipPayload strips the link layer header and returns the IP packet.
+func ipPayload(p Packet) ([]byte, bool) {
+	b := p.Data
+	switch p.LinkType {
+	case linkTypeRaw, linkTypeIPv4, linkTypeIPv6:
+		return b, true
+	case linkTypeNull:
+		if len(b) < 4 {
+			return nil, false
+		}
+		return b[4:], true
+	case linkTypeEthernet:
+		if len(b) < 14 {
+			return nil, false
+		}
+		etherType, b := binary.BigEndian.Uint16(b[12:]), b[14:]
+		// Skip 802.1Q VLAN tags.
+		for etherType == 0x8100 && len(b) >= 4 {
+			etherType, b = binary.BigEndian.Uint16(b[2:]), b[4:]
+		}
+		return b, etherType == 0x0800 || etherType == 0x86dd
+	case linkTypeLinuxSLL:
+		if len(b) < 16 {
+			return nil, false
+		}
+		return b[16:], true
+	}
+	return nil, false
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+	"time"
+)
+
+// idbOption encodes one Interface Description Block option.
+func idbOption(code uint16, value []byte) []byte {
+	b := binary.LittleEndian.AppendUint16(nil, code)
+	b = binary.LittleEndian.AppendUint16(b, uint16(len(value)))
+	b = append(b, value...)
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// pcapngWith writes a pcapng file with one interface carrying opts, and one
+// packet stamped ts.
+func pcapngWith(t *testing.T, opts []byte, ts uint64) []byte {
+	var buf bytes.Buffer
+	pw := &PcapngWriter{w: &buf}
+	shb := binary.LittleEndian.AppendUint32(nil, byteOrderMagic)
+	shb = append(shb, 1, 0, 0, 0)
+	shb = binary.LittleEndian.AppendUint64(shb, sectionLengthUnknown)
+	if err := pw.writeBlock(blockSectionHeader, shb); err != nil {
+		t.Fatal(err)
+	}
+	idb := binary.LittleEndian.AppendUint32([]byte{linkTypeRaw, 0, 0, 0}, 0)
+	if opts != nil {
+		idb = append(append(idb, opts...), idbOption(optEndOfOpt, nil)...)
+	}
+	if err := pw.writeBlock(blockInterface, idb); err != nil {
+		t.Fatal(err)
+	}
+	epb := make([]byte, 20, 24)
+	binary.LittleEndian.PutUint32(epb[4:], uint32(ts>>32))
+	binary.LittleEndian.PutUint32(epb[8:], uint32(ts))
+	binary.LittleEndian.PutUint32(epb[12:], 4)
+	binary.LittleEndian.PutUint32(epb[16:], 4)
+	if err := pw.writeBlock(blockEnhancedPacket, append(epb, 0x45, 0, 0, 4)); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestPcapngTimestamps(t *testing.T) {
+	offset := binary.LittleEndian.AppendUint64(nil, 1000)
+	tests := []struct {
+		name string
+		opts []byte
+		ts   uint64
+		want time.Time
+	}{
+		{"default microseconds", nil, 1700000000123456, time.Unix(1700000000, 123456000)},
+		{"nanoseconds", idbOption(optTSResol, []byte{9}), 1700000000123456789, time.Unix(1700000000, 123456789)},
+		{"milliseconds", idbOption(optTSResol, []byte{3}), 1700000000123, time.Unix(1700000000, 123000000)},
+		{"picoseconds", idbOption(optTSResol, []byte{12}), 1700123456789000, time.Unix(1700, 123456789)},
+		{"eighths of a second", idbOption(optTSResol, []byte{0x80 | 3}), 8*100 + 3, time.Unix(100, 375000000)},
+		{"offset", append(idbOption(optTSResol, []byte{9}), idbOption(optTSOffset, offset)...), 500000000, time.Unix(1000, 500000000)},
+		{"unknown option first", append(idbOption(2, []byte("eth0")), idbOption(optTSResol, []byte{9})...), 42, time.Unix(0, 42)},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			packets, err := readPcapng(pcapngWith(t, tt.opts, tt.ts))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(packets) != 1 {
+				t.Fatalf("got %d packets, want 1", len(packets))
+			}
+			if !packets[0].Time.Equal(tt.want) {
+				t.Errorf("got %v, want %v", packets[0].Time.UTC(), tt.want.UTC())
+			}
+			if packets[0].LinkType != linkTypeRaw {
+				t.Errorf("got link type %d, want %d", packets[0].LinkType, linkTypeRaw)
+			}
+		})
+	}
+}
+
+func TestPcapngWriterRoundTrip(t *testing.T) {
+	var buf bytes.Buffer
+	pw, err := NewPcapngWriter(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	when := time.Unix(1700000000, 123456000)
+	if err := pw.WritePacket(when, []byte{0x45, 1, 2, 3, 4}); err != nil {
+		t.Fatal(err)
+	}
+	packets, err := readPcapng(buf.Bytes())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(packets) != 1 || !packets[0].Time.Equal(when) || !bytes.Equal(packets[0].Data, []byte{0x45, 1, 2, 3, 4}) {
+		t.Fatalf("got %+v", packets)
+	}
+}
@@ -0,0 +1,197 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"encoding/binary"
+	"fmt"
+	"net"
+	"sort"
+)
+
+// A TCPStream is one reassembled TCP connection.
+type TCPStream struct {
+	Client, Server string // host:port
+	// ClientData and ServerData are everything each side sent, in order,
+	// up to the first gap in the capture.
+	ClientData, ServerData []byte
+
+	// clientKnown is set when the client was identified by its SYN.
+	clientKnown bool
+}
+
+// halfStream collects the segments one side sent.
+type halfStream struct {
+	addr     string
+	isn      uint32
+	haveSYN  bool
+	segments map[uint32][]byte
+	order    []uint32
+}
+
+func (h *halfStream) add(seq uint32, data []byte) {
+	if _, ok := h.segments[seq]; ok && len(h.segments[seq]) >= len(data) {
+		return
+	}
+	if _, ok := h.segments[seq]; !ok {
+		h.order = append(h.order, seq)
+	}
+	h.segments[seq] = data
+}
+
+// assemble orders the segments by sequence number, drops retransmitted
+// bytes and stops at the first hole.
+func (h *halfStream) assemble() []byte {
+	if len(h.order) == 0 {
+		return nil
+	}
+	base := h.isn + 1
+	if !h.haveSYN {
+		base = h.order[0]
+		for _, seq := range h.order {
+			if int32(seq-base) < 0 {
+				base = seq
+			}
+		}
+	}
+
+	seqs := append([]uint32{}, h.order...)
+	sort.Slice(seqs, func(i, j int) bool { return int32(seqs[i]-base) < int32(seqs[j]-base) })
+
+	out := []byte{}
+	for _, seq := range seqs {
+		rel := int(int32(seq - base))
+		data := h.segments[seq]
+		if rel < 0 {
+			continue
+		}
+		if rel > len(out) {
+			break
+		}
+		if rel+len(data) > len(out) {
+			out = append(out, data[len(out)-rel:]...)
+		}
+	}
+	return out
+}
+
+type connection struct {
+	a, b   *halfStream // a sent the first packet we saw
+	client *halfStream // the side that sent a SYN without ACK
+}
+
+// Reassemble groups the TCP segments in packets by connection and puts each
+// direction back together. Packets that aren't TCP over IP are skipped.
+func Reassemble(packets []Packet) []*TCPStream {
+	conns := map[string]*connection{}
+	all := []*connection{}
+
+	for _, p := range packets {
+		ip, ok := ipPayload(p)
+		if !ok {
+			continue
+		}
+		src, dst, tcp, ok := parseIP(ip)
+		if !ok || len(tcp) < 20 {
+			continue
+		}
+		srcPort, dstPort := binary.BigEndian.Uint16(tcp[0:]), binary.BigEndian.Uint16(tcp[2:])
+		seq := binary.BigEndian.Uint32(tcp[4:])
+		dataOffset := int(tcp[12]>>4) * 4
+		flags := tcp[13]
+		if dataOffset < 20 || dataOffset > len(tcp) {
+			continue
+		}
+		from := net.JoinHostPort(src.String(), fmt.Sprint(srcPort))
+		to := net.JoinHostPort(dst.String(), fmt.Sprint(dstPort))
+
+		key := from + " " + to
+		if to < from {
+			key = to + " " + from
+		}
+		conn, ok := conns[key]
+		// A SYN on a pair of ports we already saw starts a new connection,
+		// unless it's the same SYN sent again.
+		if !ok || (flags&(tcpSYN|tcpACK) == tcpSYN && conn.client != nil && (conn.client.addr != from || conn.client.isn != seq)) {
+			conn = &connection{
+				a: &halfStream{addr: from, segments: map[uint32][]byte{}},
+				b: &halfStream{addr: to, segments: map[uint32][]byte{}},
+			}
+			conns[key] = conn
+			all = append(all, conn)
+		}
+
+		side := conn.a
+		if side.addr != from {
+			side = conn.b
+		}
+		if flags&tcpSYN != 0 {
+			side.isn, side.haveSYN = seq, true
+			if flags&tcpACK == 0 {
+				conn.client = side
+			}
+			continue
+		}
+		if data := tcp[dataOffset:]; len(data) > 0 {
+			side.add(seq, data)
+		}
+	}
+
+	streams := []*TCPStream{}
+	for _, conn := range all {
+		client, server := conn.a, conn.b
+		if conn.client == conn.b {
+			client, server = conn.b, conn.a
+		}
+		streams = append(streams, &TCPStream{
+			Client:      client.addr,
+			Server:      server.addr,
+			ClientData:  client.assemble(),
+			ServerData:  server.assemble(),
+			clientKnown: conn.client != nil,
+		})
+	}
+	return streams
+}
+
+// parseIP returns the addresses and TCP segment of an IPv4 or IPv6 packet.
+func parseIP(b []byte) (src, dst net.IP, tcp []byte, ok bool) {
+	if len(b) < 1 {
+		return nil, nil, nil, false
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < 20 {
+			return nil, nil, nil, false
+		}
+		ihl := int(b[0]&0x0f) * 4
+		total := int(binary.BigEndian.Uint16(b[2:]))
+		if b[9] != 6 || ihl < 20 || total < ihl || total > len(b) {
+			return nil, nil, nil, false
+		}
+		return net.IP(b[12:16]), net.IP(b[16:20]), b[ihl:total], true
+	case 6:
+		if len(b) < 40 {
+			return nil, nil, nil, false
+		}
+		next, payload := b[6], b[40:]
+		if end := 40 + int(binary.BigEndian.Uint16(b[4:])); end <= len(b) {
+			payload = b[40:end]
+		}
+		// Hop-by-hop, routing and destination options headers.
+		for (next == 0 || next == 43 || next == 60) && len(payload) >= 8 {
+			n := (int(payload[1]) + 1) * 8
+			if n > len(payload) {
+				return nil, nil, nil, false
+			}
+			next, payload = payload[0], payload[n:]
+		}
+		if next != 6 {
+			return nil, nil, nil, false
+		}
+		return net.IP(b[8:24]), net.IP(b[24:40]), payload, true
+	}
+	return nil, nil, nil, false
+}
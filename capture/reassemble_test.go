@@ -0,0 +1,66 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"net"
+	"testing"
+)
+
+var (
+	testClient = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 1), Port: 50000}
+	testServer = &net.TCPAddr{IP: net.IPv4(192, 0, 2, 2), Port: 443}
+)
+
+func packetsOf(raw [][]byte) []Packet {
+	packets := []Packet{}
+	for _, b := range raw {
+		packets = append(packets, Packet{LinkType: linkTypeRaw, Data: b})
+	}
+	return packets
+}
+
+func TestReassembleSYNRetransmit(t *testing.T) {
+	s := newTCPStream(testClient, testServer)
+	handshake := s.handshake()
+	syn := handshake[0]
+	raw := [][]byte{syn, syn}
+	raw = append(raw, handshake[1:]...)
+	raw = append(raw, s.data(true, []byte("hello"))...)
+	raw = append(raw, s.data(false, []byte("world"))...)
+
+	streams := Reassemble(packetsOf(raw))
+	if len(streams) != 1 {
+		t.Fatalf("got %d streams, want 1", len(streams))
+	}
+	if got := string(streams[0].ClientData); got != "hello" {
+		t.Errorf("client sent %q, want %q", got, "hello")
+	}
+	if got := string(streams[0].ServerData); got != "world" {
+		t.Errorf("server sent %q, want %q", got, "world")
+	}
+}
+
+func TestReassemblePortReuse(t *testing.T) {
+	first := newTCPStream(testClient, testServer)
+	raw := first.handshake()
+	raw = append(raw, first.data(true, []byte("first"))...)
+	raw = append(raw, first.fin(true))
+
+	second := newTCPStream(testClient, testServer)
+	second.client.seq = 90000
+	raw = append(raw, second.handshake()...)
+	raw = append(raw, second.data(true, []byte("second"))...)
+
+	streams := Reassemble(packetsOf(raw))
+	if len(streams) != 2 {
+		t.Fatalf("got %d streams, want 2", len(streams))
+	}
+	for i, want := range []string{"first", "second"} {
+		if got := string(streams[i].ClientData); got != want {
+			t.Errorf("stream %d: client sent %q, want %q", i, got, want)
+		}
+	}
+}
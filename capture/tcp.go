@@ -0,0 +1,177 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	tcpFIN = 0x01
+	tcpSYN = 0x02
+	tcpPSH = 0x08
+	tcpACK = 0x10
+)
+
+// maxSegment is how much data goes in one synthetic segment, the usual MSS
+// on an Ethernet link.
+const maxSegment = 1460
+
+// endpoint is one side of a synthetic TCP connection.
+type endpoint struct {
+	ip   net.IP
+	port uint16
+	seq  uint32
+}
+
+// tcpStream builds the IP packets of a TCP connection whose bytes we saw
+// above the socket, with sequence numbers that add up so Wireshark can
+// reassemble each direction.
+type tcpStream struct {
+	client, server endpoint
+}
+
+func newTCPStream(client, server net.Addr) *tcpStream {
+	s := &tcpStream{
+		client: toEndpoint(client, net.IPv4(10, 0, 0, 1), 50000),
+		server: toEndpoint(server, net.IPv4(10, 0, 0, 2), 443),
+	}
+	s.client.seq = 1000
+	s.server.seq = 5000
+	// Mixing IPv4 and IPv6 addresses can't be encoded, so fall back to
+	// IPv6 for both.
+	if (s.client.ip.To4() == nil) != (s.server.ip.To4() == nil) {
+		s.client.ip = s.client.ip.To16()
+		s.server.ip = s.server.ip.To16()
+	}
+	return s
+}
+
+func toEndpoint(addr net.Addr, ip net.IP, port uint16) endpoint {
+	if tcp, ok := addr.(*net.TCPAddr); ok && tcp.IP != nil {
+		return endpoint{ip: tcp.IP, port: uint16(tcp.Port)}
+	}
+	return endpoint{ip: ip, port: port}
+}
+
+// handshake returns the SYN, SYN-ACK and ACK that open the connection.
+func (s *tcpStream) handshake() [][]byte {
+	syn := s.segment(true, tcpSYN, nil)
+	s.client.seq++
+	synAck := s.segment(false, tcpSYN|tcpACK, nil)
+	s.server.seq++
+	ack := s.segment(true, tcpACK, nil)
+	return [][]byte{syn, synAck, ack}
+}
+
+// data returns the segments carrying b from one side to the other.
+func (s *tcpStream) data(fromClient bool, b []byte) [][]byte {
+	packets := [][]byte{}
+	for len(b) > 0 {
+		n := len(b)
+		if n > maxSegment {
+			n = maxSegment
+		}
+		packets = append(packets, s.segment(fromClient, tcpPSH|tcpACK, b[:n]))
+		s.sender(fromClient).seq += uint32(n)
+		b = b[n:]
+	}
+	return packets
+}
+
+// fin returns the FIN one side sends when it closes.
+func (s *tcpStream) fin(fromClient bool) []byte {
+	packet := s.segment(fromClient, tcpFIN|tcpACK, nil)
+	s.sender(fromClient).seq++
+	return packet
+}
+
+func (s *tcpStream) sender(fromClient bool) *endpoint {
+	if fromClient {
+		return &s.client
+	}
+	return &s.server
+}
+
+// segment builds an IP packet holding one TCP segment. The ACK number is
+// always everything the other side has sent so far.
+func (s *tcpStream) segment(fromClient bool, flags byte, payload []byte) []byte {
+	src, dst := s.client, s.server
+	if !fromClient {
+		src, dst = dst, src
+	}
+
+	tcp := make([]byte, 20, 20+len(payload))
+	binary.BigEndian.PutUint16(tcp[0:], src.port)
+	binary.BigEndian.PutUint16(tcp[2:], dst.port)
+	binary.BigEndian.PutUint32(tcp[4:], src.seq)
+	if flags&tcpACK != 0 {
+		binary.BigEndian.PutUint32(tcp[8:], dst.seq)
+	}
+	tcp[12] = 5 << 4
+	tcp[13] = flags
+	binary.BigEndian.PutUint16(tcp[14:], 65535)
+	tcp = append(tcp, payload...)
+
+	if src4, dst4 := src.ip.To4(), dst.ip.To4(); src4 != nil && dst4 != nil {
+		binary.BigEndian.PutUint16(tcp[16:], checksum(tcpPseudoHeader(src4, dst4, len(tcp)), tcp))
+		return append(ipv4Header(src4, dst4, len(tcp)), tcp...)
+	}
+	src16, dst16 := src.ip.To16(), dst.ip.To16()
+	binary.BigEndian.PutUint16(tcp[16:], checksum(tcpPseudoHeader(src16, dst16, len(tcp)), tcp))
+	return append(ipv6Header(src16, dst16, len(tcp)), tcp...)
+}
+
+func ipv4Header(src, dst net.IP, payloadLen int) []byte {
+	h := make([]byte, 20)
+	h[0] = 0x45
+	binary.BigEndian.PutUint16(h[2:], uint16(20+payloadLen))
+	binary.BigEndian.PutUint16(h[6:], 0x4000) // don't fragment
+	h[8] = 64
+	h[9] = 6 // TCP
+	copy(h[12:16], src)
+	copy(h[16:20], dst)
+	binary.BigEndian.PutUint16(h[10:], checksum(nil, h))
+	return h
+}
+
+func ipv6Header(src, dst net.IP, payloadLen int) []byte {
+	h := make([]byte, 40)
+	h[0] = 0x60
+	binary.BigEndian.PutUint16(h[4:], uint16(payloadLen))
+	h[6] = 6 // TCP
+	h[7] = 64
+	copy(h[8:24], src)
+	copy(h[24:40], dst)
+	return h
+}
+
+// tcpPseudoHeader is the part of the IP header the TCP checksum covers. Its
+// length is a multiple of 4, so it can be summed separately.
+func tcpPseudoHeader(src, dst net.IP, tcpLen int) []byte {
+	h := append(append([]byte{}, src...), dst...)
+	if len(src) == net.IPv4len {
+		return append(h, 0, 6, byte(tcpLen>>8), byte(tcpLen))
+	}
+	return append(h, byte(tcpLen>>24), byte(tcpLen>>16), byte(tcpLen>>8), byte(tcpLen), 0, 0, 0, 6)
+}
+
+// checksum is the Internet checksum of pseudo followed by b.
+func checksum(pseudo, b []byte) uint16 {
+	var sum uint32
+	for _, data := range [][]byte{pseudo, b} {
+		for i := 0; i+1 < len(data); i += 2 {
+			sum += uint32(data[i])<<8 | uint32(data[i+1])
+		}
+		if len(data)%2 == 1 {
+			sum += uint32(data[len(data)-1]) << 8
+		}
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xffff + sum>>16
+	}
+	return ^uint16(sum)
+}
@@ -0,0 +1,284 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package capture
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"os"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/internal/tlsutil"
+)
+
+const (
+	recordChangeCipherSpec = 20
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	handshakeClientHello = 1
+	handshakeServerHello = 2
+
+	extensionSupportedVersions = 43
+	versionTLS13               = 0x0304
+)
+
+// A KeyLog holds the secrets of an SSLKEYLOGFILE, by label and then by the
+// hex encoded client random of the session.
+type KeyLog map[string]map[string][]byte
+
+func LoadKeyLog(filename string) (KeyLog, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	keys := KeyLog{}
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) != 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		secret, err := hex.DecodeString(fields[2])
+		if err != nil {
+			continue
+		}
+		if keys[fields[0]] == nil {
+			keys[fields[0]] = map[string][]byte{}
+		}
+		keys[fields[0]][strings.ToLower(fields[1])] = secret
+	}
+	return keys, scanner.Err()
+}
+
+// cipherSuite is what decrypting a suite needs. Only the AES-GCM suites of
+// TLS 1.2 and 1.3 are supported.
+type cipherSuite struct {
+	hash   func() hash.Hash
+	keyLen int
+}
+
+var cipherSuites = map[uint16]cipherSuite{
+	0x1301: {sha256.New, 16},    // TLS_AES_128_GCM_SHA256
+	0x1302: {sha512.New384, 32}, // TLS_AES_256_GCM_SHA384
+	0x009c: {sha256.New, 16},    // TLS_RSA_WITH_AES_128_GCM_SHA256
+	0x009d: {sha512.New384, 32}, // TLS_RSA_WITH_AES_256_GCM_SHA384
+	0xc02b: {sha256.New, 16},    // TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256
+	0xc02c: {sha512.New384, 32}, // TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384
+	0xc02f: {sha256.New, 16},    // TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256
+	0xc030: {sha512.New384, 32}, // TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384
+}
+
+// looksLikeTLS reports whether b starts with a handshake record.
+func looksLikeTLS(b []byte) bool {
+	return len(b) >= 3 && b[0] == recordHandshake && b[1] == 3
+}
+
+// serverHello returns the server random, the cipher suite, and whether TLS
+// 1.3 was negotiated.
+func serverHello(body []byte) (random []byte, suite uint16, tls13 bool, err error) {
+	if len(body) < 35 {
+		return nil, 0, false, errors.New("short ServerHello")
+	}
+	random = body[2:34]
+	b := body[34:]
+	sessionID := int(b[0])
+	if len(b) < 1+sessionID+3 {
+		return nil, 0, false, errors.New("short ServerHello")
+	}
+	suite = binary.BigEndian.Uint16(b[1+sessionID:])
+	b = b[1+sessionID+3:]
+	if len(b) >= 2 {
+		exts := b[2:]
+		for len(exts) >= 4 {
+			typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+			if len(exts) < 4+n {
+				break
+			}
+			if typ == extensionSupportedVersions && n == 2 && binary.BigEndian.Uint16(exts[4:]) == versionTLS13 {
+				tls13 = true
+			}
+			exts = exts[4+n:]
+		}
+	}
+	return random, suite, tls13, nil
+}
+
+type trafficKey struct {
+	aead cipher.AEAD
+	iv   []byte
+}
+
+func newTrafficKey(key, iv []byte) (trafficKey, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return trafficKey{}, err
+	}
+	aead, err := cipher.NewGCM(block)
+	return trafficKey{aead: aead, iv: iv}, err
+}
+
+// decrypter decrypts one direction of a TLS connection. keys are the
+// traffic keys the direction moves through in order; TLS 1.3 switches from
+// early data to handshake to application keys.
+type decrypter struct {
+	tls13 bool
+	keys  []trafficKey
+	cur   int
+	seq   uint64
+}
+
+// open decrypts a record and returns its content type and plaintext.
+func (d *decrypter) open(r tlsutil.Record) (byte, []byte, error) {
+	for d.cur < len(d.keys) {
+		typ, plaintext, err := d.openWith(d.keys[d.cur], r)
+		if err == nil {
+			d.seq++
+			return typ, plaintext, nil
+		}
+		if !d.tls13 || d.cur+1 == len(d.keys) {
+			return 0, nil, err
+		}
+		d.cur, d.seq = d.cur+1, 0
+	}
+	return 0, nil, errors.New("no traffic keys")
+}
+
+func (d *decrypter) openWith(k trafficKey, r tlsutil.Record) (byte, []byte, error) {
+	if d.tls13 {
+		return tlsutil.Open13(k.aead, k.iv, d.seq, r)
+	}
+	plaintext, err := tlsutil.Open12(k.aead, k.iv, d.seq, r)
+	return r.Type, plaintext, err
+}
+
+// decryptTLS returns the application data each side of a TLS connection
+// sent, using the session's secrets from keys.
+func decryptTLS(client, server []byte, keys KeyLog) ([]byte, []byte, error) {
+	clientRecords, serverRecords := tlsutil.Records(client), tlsutil.Records(server)
+	ch, err := tlsutil.HandshakeMessage(clientRecords, handshakeClientHello)
+	if err != nil || len(ch) < 4+34 {
+		return nil, nil, errors.New("no ClientHello")
+	}
+	sh, err := tlsutil.HandshakeMessage(serverRecords, handshakeServerHello)
+	if err != nil {
+		return nil, nil, errors.New("no ServerHello")
+	}
+	clientRandom := ch[6:38]
+	serverRandom, suiteID, tls13, err := serverHello(sh[4:])
+	if err != nil {
+		return nil, nil, err
+	}
+	suite, ok := cipherSuites[suiteID]
+	if !ok {
+		return nil, nil, fmt.Errorf("can't decrypt cipher suite 0x%04x", suiteID)
+	}
+
+	random := hex.EncodeToString(clientRandom)
+	var c, s *decrypter
+	if tls13 {
+		c, s, err = tls13Decrypters(suite, random, keys)
+	} else {
+		c, s, err = tls12Decrypters(suite, random, clientRandom, serverRandom, keys)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+
+	clientData, err := applicationData(clientRecords, c)
+	if err != nil {
+		return nil, nil, err
+	}
+	serverData, err := applicationData(serverRecords, s)
+	return clientData, serverData, err
+}
+
+// applicationData decrypts rs and collects the application data. In TLS
+// 1.2 records are encrypted after the ChangeCipherSpec, in TLS 1.3 every
+// application data record is.
+func applicationData(rs []tlsutil.Record, d *decrypter) ([]byte, error) {
+	out := []byte{}
+	encrypted := false
+	for _, r := range rs {
+		if r.Type == recordChangeCipherSpec {
+			encrypted = !d.tls13
+			continue
+		}
+		if !encrypted && !(d.tls13 && r.Type == recordApplicationData) {
+			continue
+		}
+		typ, plaintext, err := d.open(r)
+		if err != nil {
+			return out, fmt.Errorf("decrypting record: %v", err)
+		}
+		if typ == recordApplicationData {
+			out = append(out, plaintext...)
+		}
+	}
+	return out, nil
+}
+
+func tls13Decrypters(suite cipherSuite, random string, keys KeyLog) (*decrypter, *decrypter, error) {
+	trafficKeys := func(labels ...string) ([]trafficKey, error) {
+		out := []trafficKey{}
+		for _, label := range labels {
+			secret, ok := keys[label][random]
+			if !ok {
+				continue
+			}
+			k, err := newTrafficKey(
+				tlsutil.ExpandLabel(suite.hash, secret, "key", nil, suite.keyLen),
+				tlsutil.ExpandLabel(suite.hash, secret, "iv", nil, 12))
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, k)
+		}
+		if len(out) == 0 {
+			return nil, fmt.Errorf("no %s for client random %s in key log", labels[len(labels)-1], random)
+		}
+		return out, nil
+	}
+
+	ck, err := trafficKeys("CLIENT_EARLY_TRAFFIC_SECRET", "CLIENT_HANDSHAKE_TRAFFIC_SECRET", "CLIENT_TRAFFIC_SECRET_0")
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, err := trafficKeys("SERVER_HANDSHAKE_TRAFFIC_SECRET", "SERVER_TRAFFIC_SECRET_0")
+	if err != nil {
+		return nil, nil, err
+	}
+	return &decrypter{tls13: true, keys: ck}, &decrypter{tls13: true, keys: sk}, nil
+}
+
+func tls12Decrypters(suite cipherSuite, random string, clientRandom, serverRandom []byte, keys KeyLog) (*decrypter, *decrypter, error) {
+	master, ok := keys["CLIENT_RANDOM"][random]
+	if !ok {
+		return nil, nil, fmt.Errorf("no CLIENT_RANDOM %s in key log", random)
+	}
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	kb := tlsutil.PRF12(suite.hash, master, "key expansion", seed, 2*suite.keyLen+8)
+	n := suite.keyLen
+
+	ck, err := newTrafficKey(kb[:n], kb[2*n:2*n+4])
+	if err != nil {
+		return nil, nil, err
+	}
+	sk, err := newTrafficKey(kb[n:2*n], kb[2*n+4:2*n+8])
+	if err != nil {
+		return nil, nil, err
+	}
+	return &decrypter{keys: []trafficKey{ck}}, &decrypter{keys: []trafficKey{sk}}, nil
+}
@@ -0,0 +1,173 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package certs
+
+import (
+	"crypto"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"fmt"
+	"math/big"
+	mrand "math/rand"
+	"net"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+// HugeChainLength is how many intermediate CAs a huge-chain certificate
+// comes with, enough to push the Certificate message past 64KB.
+const HugeChainLength = 150
+
+// Modes are the kinds of certificate Generate makes.
+var Modes = []string{
+	config.CertValid,
+	config.CertExpired,
+	config.CertNotYetValid,
+	config.CertWrongSAN,
+	config.CertNoSAN,
+	config.CertHugeChain,
+	config.CertEd25519,
+	config.CertP521,
+	config.CertRSA1024,
+}
+
+// Generate makes a self-signed certificate for hosts, which may be names or
+// IP addresses, broken the way mode says.
+func Generate(mode string, hosts []string) (tls.Certificate, error) {
+	key, err := newKey(mode)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+
+	leaf := template(hosts)
+	now := time.Now()
+	switch mode {
+	case config.CertValid, config.CertHugeChain, config.CertEd25519, config.CertP521, config.CertRSA1024:
+	case config.CertExpired:
+		leaf.NotBefore, leaf.NotAfter = now.AddDate(-2, 0, 0), now.AddDate(-1, 0, 0)
+	case config.CertNotYetValid:
+		leaf.NotBefore, leaf.NotAfter = now.AddDate(1, 0, 0), now.AddDate(2, 0, 0)
+	case config.CertWrongSAN:
+		leaf.Subject.CommonName = "wrong.invalid"
+		leaf.DNSNames = []string{"wrong.invalid", "*.wrong.invalid"}
+		leaf.IPAddresses = []net.IP{net.IPv4(192, 0, 2, 1)}
+	case config.CertNoSAN:
+		leaf.DNSNames, leaf.IPAddresses = nil, nil
+	default:
+		return tls.Certificate{}, fmt.Errorf("unknown certificate mode %q", mode)
+	}
+	if _, ok := key.(*rsa.PrivateKey); ok {
+		leaf.KeyUsage |= x509.KeyUsageKeyEncipherment
+	}
+
+	if mode != config.CertHugeChain {
+		der, err := x509.CreateCertificate(rand.Reader, leaf, leaf, key.Public(), key)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, nil
+	}
+	return hugeChain(leaf, key)
+}
+
+// hugeChain signs leaf with the last of HugeChainLength CAs, each signed by
+// the one before, and sends the whole chain.
+func hugeChain(leaf *x509.Certificate, key crypto.Signer) (tls.Certificate, error) {
+	caKey, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	var parent *x509.Certificate
+	chain := [][]byte{}
+	for i := 0; i <= HugeChainLength; i++ {
+		ca := template(nil)
+		ca.Subject.CommonName = fmt.Sprintf("http2fuzz CA %d", i)
+		ca.IsCA = true
+		ca.KeyUsage = x509.KeyUsageCertSign
+		ca.ExtKeyUsage = nil
+		if parent == nil {
+			parent = ca
+		}
+		der, err := x509.CreateCertificate(rand.Reader, ca, parent, caKey.Public(), caKey)
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if parent, err = x509.ParseCertificate(der); err != nil {
+			return tls.Certificate{}, err
+		}
+		// Closest to the leaf first.
+		chain = append([][]byte{der}, chain...)
+	}
+
+	der, err := x509.CreateCertificate(rand.Reader, leaf, parent, key.Public(), caKey)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	return tls.Certificate{Certificate: append([][]byte{der}, chain...), PrivateKey: key}, nil
+}
+
+func newKey(mode string) (crypto.Signer, error) {
+	switch mode {
+	case config.CertEd25519:
+		_, key, err := ed25519.GenerateKey(rand.Reader)
+		return key, err
+	case config.CertP521:
+		return ecdsa.GenerateKey(elliptic.P521(), rand.Reader)
+	case config.CertRSA1024:
+		return rsa.GenerateKey(rand.Reader, 1024)
+	}
+	return ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+}
+
+func template(hosts []string) *x509.Certificate {
+	serial, _ := rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+	cert := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{Organization: []string{"http2fuzz"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(1, 0, 0),
+		KeyUsage:              x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+	}
+	for _, host := range hosts {
+		if ip := net.ParseIP(host); ip != nil {
+			cert.IPAddresses = append(cert.IPAddresses, ip)
+		} else {
+			cert.DNSNames = append(cert.DNSNames, host)
+		}
+	}
+	if len(hosts) > 0 {
+		cert.Subject.CommonName = hosts[0]
+	}
+	return cert
+}
+
+// GetCertificate returns a tls.Config.GetCertificate that serves mode
+// certificates for hosts. In random mode every kind is made up front and
+// each handshake gets one of them.
+func GetCertificate(mode string, hosts []string) (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	modes := []string{mode}
+	if mode == config.CertRandom {
+		modes = Modes
+	}
+	certs := make([]tls.Certificate, len(modes))
+	for i, m := range modes {
+		var err error
+		if certs[i], err = Generate(m, hosts); err != nil {
+			return nil, err
+		}
+	}
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) {
+		return &certs[mrand.Intn(len(certs))], nil
+	}, nil
+}
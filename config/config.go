@@ -6,12 +6,48 @@ package config
 
 import (
 	"flag"
+	"strings"
 	"time"
 )
 
 const (
-	ModeClient = "client"
-	ModeServer = "server"
+	ModeClient      = "client"
+	ModeServer      = "server"
+	ModeInteractive = "interactive"
+	ModeStep        = "step"
+	ModeMinimize    = "minimize"
+	ModeSeeds       = "seeds"
+	ModeImport      = "import"
+	ModeTLS         = "tls"
+)
+
+const (
+	OracleExit  = "exit"
+	OracleProbe = "probe"
+	OracleDrop  = "drop"
+)
+
+const (
+	LogFormatText = "logfmt"
+	LogFormatJSON = "json"
+)
+
+const (
+	BundleRandom     = "random"
+	BundleRoundRobin = "round-robin"
+)
+
+const (
+	CertValid       = "valid"
+	CertExpired     = "expired"
+	CertNotYetValid = "not-yet-valid"
+	CertWrongSAN    = "wrong-san"
+	CertNoSAN       = "no-san"
+	CertHugeChain   = "huge-chain"
+	CertEd25519     = "ed25519"
+	CertP521        = "p521"
+	CertRSA1024     = "rsa-1024"
+	CertRandom      = "random"
 )
 
 const (
@@ -19,40 +55,174 @@ const (
 	ReplayReadFilename  = "./replay.json"
 )
 
-var RestartDelay time.Duration
-var FuzzDelay time.Duration
+var RestartDelay = 10 * time.Millisecond
+var FuzzDelay = 100 * time.Millisecond
 var Target string
 var FuzzMode string
 var ReplayMode bool
+var InteractiveMode bool
+var StepStrategy string
+
+var SeedPath string
+var ImportFile string
+var KeyLogFile string
+var ImportDir string
+
+var MinimizeFile string
+var MinimizeOutput string
+var Oracle string
+var OracleWait = 500 * time.Millisecond
+var TargetCommand string
+var CrashDir string
+var PcapDir string
+var SessionDir string
+var MaxRSS uint64
+
+var LogFormat string
+var LogLevel string
+var Quiet bool
+var Stats bool
+var MetricsAddr string
+var ProbeInterval time.Duration
 
 var Port string
 var Interface string
+var ServerBundle string
+var CampaignFile string
+var CertFile string
+var KeyFile string
+var CertHosts []string
+var CertMode string
+var TLSFuzz string
+
+var SNI string
+var ClientCert string
+var ClientKey string
+var CAFile string
+var TLSMinVersion string
+var TLSMaxVersion string
+var CipherSuites string
+
+var Segment string
+var SegmentDelay time.Duration
+var Coalesce int
+var NoDelay bool
+var Proxy string
+var UpstreamAddr string
 
 var MaxRestartAttempts = 3
 var KeyboardDelay = false
 
-func init() {
-	restartMillisecond := 10
-	fuzzDelay := 100
+var restartMillisecond = 10
+var fuzzDelay = 100
+var oracleWait = 500
+var maxRSS = 0
+var probeInterval = 0
+var segmentDelay = 0
+var certHosts = "localhost,127.0.0.1,::1"
 
+// init only registers the flags, so packages like harness can be imported by
+// programs with flags of their own. main calls Parse.
+func init() {
 	flag.StringVar(&Target, "target", "", "HTTP2 server to fuzz in host:port format")
 	flag.IntVar(&restartMillisecond, "restart-delay", restartMillisecond, "number a milliseconds to wait between broken connections")
 	flag.IntVar(&fuzzDelay, "fuzz-delay", fuzzDelay, "number of milliseconds to wait between each request per strategy")
 
 	flag.StringVar(&Port, "port", "8000", "port to listen from")
 	flag.StringVar(&Interface, "listen", "0.0.0.0", "interface to listen from")
+	flag.StringVar(&ServerBundle, "bundle", BundleRandom, "strategies for each connection in server mode: random, round-robin, a bundle number, or strategy names separated by commas")
+	flag.StringVar(&CampaignFile, "campaign", "", "file of server mode bundles, one per line, run in turn on each connection")
+	flag.StringVar(&SNI, "sni", "", "server name to send to -target, instead of its host")
+	flag.StringVar(&ClientCert, "client-cert", "", "PEM certificate to present to -target")
+	flag.StringVar(&ClientKey, "client-key", "", "PEM private key for -client-cert")
+	flag.StringVar(&CAFile, "ca", "", "PEM CA bundle to verify -target's certificate with; without it the certificate isn't checked")
+	flag.StringVar(&TLSMinVersion, "tls-min", "", "lowest TLS version to offer -target: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&TLSMaxVersion, "tls-max", "", "highest TLS version to offer -target: 1.0, 1.1, 1.2 or 1.3")
+	flag.StringVar(&CipherSuites, "ciphers", "", "TLS 1.2 cipher suites to offer -target, by name or number, separated by commas")
+	flag.StringVar(&Segment, "segment", "", "split every write into segments of n bytes, or of min-max bytes picked at random, each sent on its own")
+	flag.IntVar(&segmentDelay, "segment-delay", segmentDelay, "number of milliseconds to wait between the segments of a write")
+	flag.IntVar(&Coalesce, "coalesce", 0, "gather this many frames into one write, 0 for none")
+	flag.BoolVar(&NoDelay, "nodelay", true, "set TCP_NODELAY; -nodelay=false lets the kernel gather small writes")
+	flag.StringVar(&Proxy, "proxy", "", "reach -target through proxies: http://, https:// or socks5:// URLs, or direct, separated by commas and taken in turn by each connection")
+	flag.StringVar(&UpstreamAddr, "upstream", "127.0.0.1:0", "address the stand-in upstream that CONNECT tunnels lead to listens on")
+	flag.StringVar(&TLSFuzz, "tls-fuzz", "", "fuzz ALPN and TLS negotiation instead of HTTP/2 frames: all, or case names separated by commas")
+	flag.StringVar(&CertFile, "cert", "", "PEM certificate for server mode; without it one is generated")
+	flag.StringVar(&KeyFile, "key", "", "PEM private key for -cert")
+	flag.StringVar(&certHosts, "cert-hosts", certHosts, "names and IPs, separated by commas, the generated server certificate is for")
+	flag.StringVar(&CertMode, "cert-mode", CertValid, "generated server certificate: valid, expired, not-yet-valid, wrong-san, no-san, huge-chain, ed25519, p521, rsa-1024, or random for a different one per connection")
+
+	flag.BoolVar(&InteractiveMode, "interactive", false, "hand-craft frames against -target from a prompt")
+	flag.StringVar(&StepStrategy, "step", "", "run a single strategy against -target, pausing before each frame")
+
+	flag.StringVar(&ImportFile, "import", "", "turn the HTTP/2 connections in a pcap or pcapng file into replay files")
+	flag.StringVar(&KeyLogFile, "keylog", "", "SSLKEYLOGFILE for decrypting TLS connections with -import")
+	flag.StringVar(&ImportDir, "import-out", "./imported", "directory -import writes its replay files to")
+	flag.StringVar(&SeedPath, "seeds", "", "replay file, or directory of them, whose sessions are mutated and replayed against -target")
+
+	flag.StringVar(&MinimizeFile, "minimize", "", "shrink a crashing replay file against -target")
+	flag.StringVar(&MinimizeOutput, "minimize-out", "./minimized.json", "where -minimize writes the smallest reproducing replay")
+	flag.StringVar(&Oracle, "oracle", OracleDrop, "how -minimize decides a crash reproduced: exit, probe or drop")
+	flag.IntVar(&oracleWait, "oracle-wait", oracleWait, "number of milliseconds to wait for the target to crash after replaying")
+	flag.StringVar(&TargetCommand, "target-cmd", "", "command that starts the server under test; it is restarted after every crash")
+	flag.StringVar(&CrashDir, "crash-dir", "./crashes", "where crash reports of a -target-cmd target are saved")
+	flag.StringVar(&SessionDir, "session-dir", "", "log the frames sent and received on each connection, with timestamps, in this directory")
+	flag.StringVar(&PcapDir, "pcap-dir", "", "save each connection as a pcapng file, with TLS secrets in keylog.txt, in this directory")
+	flag.IntVar(&maxRSS, "max-rss", maxRSS, "megabytes of RSS after which a -target-cmd target counts as crashed, 0 for no limit")
+
+	flag.StringVar(&LogFormat, "log-format", LogFormatText, "log format: logfmt or json")
+	flag.StringVar(&LogLevel, "log-level", "info", "least severe messages to log: debug, info, warn or error; debug adds every frame with its payload")
+	flag.BoolVar(&Quiet, "quiet", false, "only log errors")
+	flag.StringVar(&MetricsAddr, "metrics", "", "serve Prometheus metrics at http://<addr>/metrics, e.g. :9090")
+	flag.IntVar(&probeInterval, "probe-interval", probeInterval, "number of milliseconds between liveness probes of -target while fuzzing, 0 for none")
+	flag.BoolVar(&Stats, "stats", false, "show a status view of the fuzzers on stdout, refreshed every second")
 
 	// flag.BoolVar(&ReplayMode, "replay", false, "replay frames from replay.json")
+}
+
+func Parse() {
 	flag.Parse()
 
 	RestartDelay = time.Duration(restartMillisecond) * time.Millisecond
 	FuzzDelay = time.Duration(fuzzDelay) * time.Millisecond
+	OracleWait = time.Duration(oracleWait) * time.Millisecond
+	MaxRSS = uint64(maxRSS) << 20
+	ProbeInterval = time.Duration(probeInterval) * time.Millisecond
+	SegmentDelay = time.Duration(segmentDelay) * time.Millisecond
+	CertHosts = strings.Split(certHosts, ",")
 
-	if Target != "" {
+	if InteractiveMode {
+		FuzzMode = ModeInteractive
+	} else if ImportFile != "" {
+		FuzzMode = ModeImport
+	} else if MinimizeFile != "" {
+		FuzzMode = ModeMinimize
+	} else if SeedPath != "" {
+		FuzzMode = ModeSeeds
+	} else if StepStrategy != "" {
+		FuzzMode = ModeStep
+		KeyboardDelay = true
+	} else if TLSFuzz != "" && Target != "" {
+		FuzzMode = ModeTLS
+	} else if Target != "" {
 		FuzzMode = ModeClient
 	} else {
 		FuzzMode = ModeServer
 	}
+
+	// The prompt modes are for watching the peer's replies.
+	if (FuzzMode == ModeInteractive || FuzzMode == ModeStep) && !isSet("log-level") {
+		LogLevel = "debug"
+	}
+}
+
+func isSet(name string) bool {
+	set := false
+	flag.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			set = true
+		}
+	})
+	return set
 }
 
 func IsTLS() bool {
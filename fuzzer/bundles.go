@@ -0,0 +1,142 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+// A Bundle is a set of strategies run together on one connection.
+type Bundle struct {
+	Name       string
+	Strategies []string
+}
+
+// ServerBundles are the bundles server mode picks from, by number.
+var ServerBundles = [][]string{
+	{"PingFuzzer"},
+	{"PingFuzzer", "DataFuzzer", "HeaderFuzzer"},
+	{"RawFrameFuzzer"},
+	{"PriorityFuzzer", "PingFuzzer", "HeaderFuzzer"},
+	{"PriorityFuzzer", "PingFuzzer", "HeaderFuzzer", "WindowUpdateFuzzer"},
+	{"PriorityFuzzer", "PingFuzzer", "HeaderFuzzer", "ResetFuzzer"},
+	{"SettingsFuzzer", "HeaderFuzzer"},
+	{"DataFuzzer", "HeaderFuzzer"},
+	{"ContinuationFuzzer", "HeaderFuzzer"},
+	{"PushPromiseFuzzer", "HeaderFuzzer"},
+	{"RawTCPFuzzer"},
+	{"ResponseFuzzer"},
+	{"PrefaceFuzzer", "ResponseFuzzer"},
+}
+
+// A BundlePicker chooses the bundle for each connection the server accepts.
+type BundlePicker struct {
+	mode    string
+	bundles []Bundle // for round-robin, a fixed bundle or a campaign
+
+	mu   sync.Mutex
+	next int
+}
+
+// NewBundlePicker picks bundles the way spec says: "random", "round-robin",
+// a number from ServerBundles, or strategy names separated by commas. If
+// campaign is set, it names a file of bundles that are run in turn instead.
+func NewBundlePicker(spec, campaign string) (*BundlePicker, error) {
+	if campaign != "" {
+		bundles, err := LoadCampaign(campaign)
+		if err != nil {
+			return nil, err
+		}
+		return &BundlePicker{mode: config.BundleRoundRobin, bundles: bundles}, nil
+	}
+
+	switch spec {
+	case config.BundleRandom, config.BundleRoundRobin:
+		bundles := make([]Bundle, len(ServerBundles))
+		for i, strategies := range ServerBundles {
+			bundles[i] = Bundle{Name: strconv.Itoa(i), Strategies: strategies}
+		}
+		return &BundlePicker{mode: spec, bundles: bundles}, nil
+	}
+	bundle, err := ParseBundle(spec)
+	if err != nil {
+		return nil, err
+	}
+	return &BundlePicker{mode: config.BundleRoundRobin, bundles: []Bundle{bundle}}, nil
+}
+
+// Next returns the bundle for the next connection.
+func (p *BundlePicker) Next() Bundle {
+	if p.mode == config.BundleRandom {
+		return p.bundles[rand.Intn(len(p.bundles))]
+	}
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	bundle := p.bundles[p.next%len(p.bundles)]
+	p.next++
+	return bundle
+}
+
+// ParseBundle reads a bundle number from ServerBundles, or a list of
+// strategy names separated by commas or spaces.
+func ParseBundle(s string) (Bundle, error) {
+	if n, err := strconv.Atoi(s); err == nil {
+		if n < 0 || n >= len(ServerBundles) {
+			return Bundle{}, fmt.Errorf("no bundle %d, pick 0-%d", n, len(ServerBundles)-1)
+		}
+		return Bundle{Name: s, Strategies: ServerBundles[n]}, nil
+	}
+
+	names := strings.FieldsFunc(s, func(r rune) bool { return r == ',' || r == ' ' || r == '\t' })
+	if len(names) == 0 {
+		return Bundle{}, errors.New("empty bundle")
+	}
+	for _, name := range names {
+		if _, ok := Strategies[name]; !ok {
+			return Bundle{}, fmt.Errorf("unknown strategy %q", name)
+		}
+	}
+	return Bundle{Name: strings.Join(names, ","), Strategies: names}, nil
+}
+
+// LoadCampaign reads a campaign file: one bundle per line, as ParseBundle
+// takes them. Blank lines and lines starting with # are skipped.
+func LoadCampaign(filename string) ([]Bundle, error) {
+	f, err := os.Open(filename)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	bundles := []Bundle{}
+	scanner := bufio.NewScanner(f)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		bundle, err := ParseBundle(text)
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, line, err)
+		}
+		bundles = append(bundles, bundle)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if len(bundles) == 0 {
+		return nil, errors.New("no bundles in " + filename)
+	}
+	return bundles, nil
+}
@@ -0,0 +1,106 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+func TestParseBundle(t *testing.T) {
+	tests := []struct {
+		in      string
+		want    Bundle
+		wantErr string
+	}{
+		{in: "0", want: Bundle{Name: "0", Strategies: ServerBundles[0]}},
+		{in: "11", want: Bundle{Name: "11", Strategies: ServerBundles[11]}},
+		{in: "PingFuzzer", want: Bundle{Name: "PingFuzzer", Strategies: []string{"PingFuzzer"}}},
+		{in: "PingFuzzer,DataFuzzer", want: Bundle{Name: "PingFuzzer,DataFuzzer", Strategies: []string{"PingFuzzer", "DataFuzzer"}}},
+		{in: " PingFuzzer, \tDataFuzzer HeaderFuzzer,", want: Bundle{Name: "PingFuzzer,DataFuzzer,HeaderFuzzer", Strategies: []string{"PingFuzzer", "DataFuzzer", "HeaderFuzzer"}}},
+		{in: "-1", wantErr: "no bundle -1"},
+		{in: "999", wantErr: "no bundle 999"},
+		{in: strconv.Itoa(len(ServerBundles)), wantErr: "pick 0-" + strconv.Itoa(len(ServerBundles)-1)},
+		{in: "", wantErr: "empty bundle"},
+		{in: " ,, ", wantErr: "empty bundle"},
+		{in: "PingFuzzer,NoSuchFuzzer", wantErr: `unknown strategy "NoSuchFuzzer"`},
+		{in: "pingfuzzer", wantErr: "unknown strategy"},
+	}
+	for _, tt := range tests {
+		got, err := ParseBundle(tt.in)
+		if tt.wantErr != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+				t.Errorf("ParseBundle(%q) = %v, %v; want error with %q", tt.in, got, err, tt.wantErr)
+			}
+			continue
+		}
+		if err != nil || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("ParseBundle(%q) = %v, %v; want %v", tt.in, got, err, tt.want)
+		}
+	}
+}
+
+func writeCampaign(t *testing.T, text string) string {
+	t.Helper()
+	filename := filepath.Join(t.TempDir(), "campaign.txt")
+	if err := os.WriteFile(filename, []byte(text), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return filename
+}
+
+func TestLoadCampaign(t *testing.T) {
+	filename := writeCampaign(t, "# comment\n\n  3\nPingFuzzer, ResetFuzzer\r\n\t# indented comment\nRawTCPFuzzer")
+	bundles, err := LoadCampaign(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []Bundle{
+		{Name: "3", Strategies: ServerBundles[3]},
+		{Name: "PingFuzzer,ResetFuzzer", Strategies: []string{"PingFuzzer", "ResetFuzzer"}},
+		{Name: "RawTCPFuzzer", Strategies: []string{"RawTCPFuzzer"}},
+	}
+	if !reflect.DeepEqual(bundles, want) {
+		t.Fatalf("got %v, want %v", bundles, want)
+	}
+
+	// A campaign runs its bundles in turn, whatever the bundle spec says.
+	p, err := NewBundlePicker(config.BundleRandom, filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 2*len(want); i++ {
+		if got := p.Next(); !reflect.DeepEqual(got, want[i%len(want)]) {
+			t.Errorf("bundle %d: got %v, want %v", i, got, want[i%len(want)])
+		}
+	}
+}
+
+func TestLoadCampaignErrors(t *testing.T) {
+	tests := []struct {
+		text    string
+		wantErr string
+	}{
+		{"", "no bundles"},
+		{"# nothing but comments\n\n", "no bundles"},
+		{"PingFuzzer\n\nBogusFuzzer\n", `campaign.txt:3: unknown strategy "BogusFuzzer"`},
+		{"0\n999\n", "campaign.txt:2: no bundle 999"},
+	}
+	for _, tt := range tests {
+		_, err := LoadCampaign(writeCampaign(t, tt.text))
+		if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("LoadCampaign(%q) = %v, want error with %q", tt.text, err, tt.wantErr)
+		}
+	}
+	if _, err := LoadCampaign(filepath.Join(t.TempDir(), "missing.txt")); !os.IsNotExist(err) {
+		t.Errorf("missing file: got %v", err)
+	}
+}
@@ -12,67 +12,67 @@ func Client() {
 	restartFuzzer := true
 	sendSettingsInit := true
 
-	conn0 := NewConnection(target, tls, true, sendSettingsInit)
+	conn0 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer0 := NewFuzzer(conn0, restartFuzzer)
 	go fuzzer0.PingFuzzer()
 
-	conn1 := NewConnection(target, tls, true, sendSettingsInit)
+	conn1 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer1 := NewFuzzer(conn1, restartFuzzer)
 	go fuzzer1.RawFrameFuzzer()
 
-	conn2 := NewConnection(target, tls, true, sendSettingsInit)
+	conn2 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer2 := NewFuzzer(conn2, restartFuzzer)
 	go fuzzer2.PriorityFuzzer()
 	go fuzzer2.PingFuzzer()
 	go fuzzer2.HeaderFuzzer()
 
-	conn3 := NewConnection(target, tls, true, sendSettingsInit)
+	conn3 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer3 := NewFuzzer(conn3, restartFuzzer)
 	go fuzzer3.PriorityFuzzer()
 	go fuzzer3.PingFuzzer()
 	go fuzzer3.HeaderFuzzer()
 	go fuzzer3.WindowUpdateFuzzer()
 
-	conn4 := NewConnection(target, tls, true, sendSettingsInit)
+	conn4 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer4 := NewFuzzer(conn4, restartFuzzer)
 	go fuzzer4.PriorityFuzzer()
 	go fuzzer4.PingFuzzer()
 	go fuzzer4.HeaderFuzzer()
 	go fuzzer4.ResetFuzzer()
 
-	conn5 := NewConnection(target, tls, true, sendSettingsInit)
+	conn5 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer5 := NewFuzzer(conn5, restartFuzzer)
 	go fuzzer5.SettingsFuzzer()
 	go fuzzer5.HeaderFuzzer()
 
-	conn6 := NewConnection(target, tls, true, sendSettingsInit)
+	conn6 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer6 := NewFuzzer(conn6, restartFuzzer)
 	go fuzzer6.DataFuzzer()
 	go fuzzer6.HeaderFuzzer()
 
-	conn7 := NewConnection(target, tls, true, sendSettingsInit)
+	conn7 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer7 := NewFuzzer(conn7, restartFuzzer)
 	go fuzzer7.ContinuationFuzzer()
 	go fuzzer7.HeaderFuzzer()
 
-	conn8 := NewConnection(target, tls, true, sendSettingsInit)
+	conn8 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer8 := NewFuzzer(conn8, restartFuzzer)
 	go fuzzer8.PushPromiseFuzzer()
 	go fuzzer8.HeaderFuzzer()
 
-	conn9 := NewConnection(target, tls, true, sendSettingsInit)
+	conn9 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer9 := NewFuzzer(conn9, restartFuzzer)
 	go fuzzer9.RawTCPFuzzer()
 
-	conn10 := NewConnection(target, tls, true, sendSettingsInit)
+	conn10 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer10 := NewFuzzer(conn10, restartFuzzer)
 	go fuzzer10.RawTCPFuzzer()
 
-	conn11 := NewConnection(target, tls, false, !sendSettingsInit)
+	conn11 := NewConnection(target, tls, false, !sendSettingsInit, true)
 	fuzzer11 := NewFuzzer(conn11, restartFuzzer)
 	go fuzzer11.RawTCPFuzzer()
 
-	conn12 := NewConnection(target, tls, true, sendSettingsInit)
+	conn12 := NewConnection(target, tls, true, sendSettingsInit, true)
 	fuzzer12 := NewFuzzer(conn12, restartFuzzer)
 	go fuzzer12.PriorityFuzzer()
 	go fuzzer12.PingFuzzer()
@@ -80,4 +80,26 @@ func Client() {
 	go fuzzer12.PushPromiseFuzzer()
 	go fuzzer12.ContinuationFuzzer()
 	go fuzzer12.WindowUpdateFuzzer()
+
+	conn13 := NewConnection(target, tls, true, sendSettingsInit, true)
+	fuzzer13 := NewFuzzer(conn13, restartFuzzer)
+	go fuzzer13.SettingsBoundaryFuzzer()
+	go fuzzer13.HeaderFuzzer()
+
+	conn14 := NewConnection(target, tls, true, sendSettingsInit, false)
+	fuzzer14 := NewFuzzer(conn14, restartFuzzer)
+	go fuzzer14.SettingsAckFuzzer()
+	go fuzzer14.PingFuzzer()
+
+	conn15 := NewConnection(target, tls, false, false, true)
+	fuzzer15 := NewFuzzer(conn15, restartFuzzer)
+	go fuzzer15.PrefaceFuzzer()
+
+	conn16 := NewConnection(target, tls, true, sendSettingsInit, true)
+	fuzzer16 := NewFuzzer(conn16, restartFuzzer)
+	go fuzzer16.ExtendedConnectFuzzer()
+
+	conn17 := NewConnection(target, tls, true, sendSettingsInit, true)
+	fuzzer17 := NewFuzzer(conn17, restartFuzzer)
+	go fuzzer17.ConnectTunnelFuzzer()
 }
@@ -7,24 +7,42 @@ package fuzzer
 import (
 	"bytes"
 	"crypto/tls"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
 	"net"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/c0nrad/http2fuzz/capture"
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/logging"
 	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/transport"
 
 	"github.com/bradfitz/http2"
 	"github.com/bradfitz/http2/hpack"
 )
 
+const frameHeaderLen = 9
+
+// History holds the last frames written and read on any connection.
+var History = replay.NewHistory(1000)
+
+var connCount uint64
+
 type Connection struct {
 	Host           string
 	IsTLS          bool
 	IsPreface      bool
 	IsSendSettings bool
+	// IsAutoAck is the AutoAck the connection was opened with, and gets
+	// again when it is reopened.
+	IsAutoAck bool
 
 	Raw net.Conn
 
@@ -37,25 +55,159 @@ type Connection struct {
 	PeerSetting map[http2.SettingID]uint32
 	HDec        *hpack.Decoder
 
-	Err error
+	// AutoAck controls whether SETTINGS frames from the peer are ACKed as
+	// soon as they are read.
+	AutoAck bool
+	// PendingSettings are the SETTINGS frames we sent that the peer has not
+	// ACKed yet, oldest first.
+	PendingSettings []PendingSettings
+	// SettingsAcked is when the peer last ACKed one of our SETTINGS frames.
+	SettingsAcked time.Time
+	// PeerSettingsUnacked counts the peer's SETTINGS frames we haven't ACKed.
+	PeerSettingsUnacked int
+
+	// GoAway is set once the peer sends a GOAWAY, with its error code in
+	// GoAwayCode.
+	GoAway     bool
+	GoAwayCode http2.ErrCode
+
+	// WriteHook, if set, sees every frame written through the framer before
+	// it goes out on Raw.
+	WriteHook FrameHook
+
+	// Requests gets the client's HEADERS on connections we accepted, for
+	// ResponseFuzzer to answer. Requests nobody is waiting for are dropped,
+	// and it's closed when the connection breaks.
+	Requests chan Request
+
+	// Log records the frames sent and received on this connection when
+	// config.SessionDir is set.
+	Log *replay.SessionLog
+
+	// ID numbers connections in the order they were made, so their log
+	// messages can be told apart.
+	ID     uint64
+	logger *slog.Logger
+
+	counters   Counters
+	countersMu sync.Mutex
+
+	reader     frameReader
+	headers    []replay.HeaderField
+	writeMu    sync.Mutex
+	settingsMu sync.Mutex
+	// saveWrites makes hookWriter save the frames it sends to the replay
+	// file. It is only touched with writeMu held.
+	saveWrites bool
+
+	// responses has a channel for each stream a strategy waits on the
+	// response of.
+	responses  map[uint32]chan string
+	responseMu sync.Mutex
+
+	Err   error
+	errMu sync.Mutex
+}
+
+// FrameHook is handed one serialized frame and returns the bytes to send in
+// its place. Returning nil drops the frame, and an error fails the write.
+type FrameHook func(frame []byte) ([]byte, error)
+
+// hookWriter sits between the framer and Raw. The framer writes each frame
+// with a single Write call, so every call is exactly one frame.
+type hookWriter struct {
+	conn *Connection
+}
+
+func (w hookWriter) Write(p []byte) (int, error) {
+	b := p
+	if w.conn.WriteHook != nil {
+		var err error
+		if b, err = w.conn.WriteHook(p); err != nil {
+			return 0, err
+		}
+		if b == nil {
+			return len(p), nil
+		}
+	}
+	if _, err := w.conn.Raw.Write(b); err != nil {
+		return 0, err
+	}
+	// What the hook sent is what gets counted, recorded and saved.
+	frame, err := parseRawFrame(b)
+	if err != nil {
+		w.conn.logger.Warn("Sent bytes that aren't a frame", "err", err, "len", len(b))
+		return len(p), nil
+	}
+	frame.Payload = append([]byte{}, frame.Payload...)
+	w.conn.count(func(c *Counters) { c.FramesSent++ })
+	connFramesMetric.Inc("sent", frameTypeLabel(frame.FrameType))
+	w.conn.record(replay.LogEntry{Time: time.Now(), Frame: frame})
+	if w.conn.saveWrites {
+		replay.SaveRawFrame(frame.FrameType, frame.Flags, frame.StreamID, frame.Payload)
+	}
+	w.conn.onSentFrame(frame)
+	return len(p), nil
+}
+
+// frameReader sits between Raw and the framer and keeps the bytes of the
+// frame being read, so received frames can be logged as they arrived.
+type frameReader struct {
+	conn *Connection
+	buf  []byte
+}
+
+func (r *frameReader) Read(p []byte) (int, error) {
+	n, err := r.conn.Raw.Read(p)
+	r.buf = append(r.buf, p[:n]...)
+	return n, err
+}
+
+// take returns the bytes read since the last call.
+func (r *frameReader) take() []byte {
+	b := r.buf
+	r.buf = nil
+	return b
+}
+
+func (conn *Connection) record(entry replay.LogEntry) {
+	History.Add(entry)
+	if conn.Log != nil {
+		conn.Log.Add(entry)
+	}
+}
+
+// setLogger gives conn an ID and a logger that tags every message with it.
+func (conn *Connection) setLogger(peer string) {
+	conn.ID = atomic.AddUint64(&connCount, 1)
+	conn.logger = slog.With("conn", conn.ID, "peer", peer)
+}
+
+type PendingSettings struct {
+	Settings []http2.Setting
+	Sent     time.Time
 }
 
-func NewConnection(host string, isTLS, sendPreface, sendSettingsInit bool) *Connection {
+// NewConnection dials host. Without autoAck the peer's SETTINGS, its first
+// one included, are left for a strategy to ACK.
+func NewConnection(host string, isTLS, sendPreface, sendSettingsInit, autoAck bool) *Connection {
 	conn := &Connection{
 		Host:           host,
 		IsTLS:          isTLS,
 		IsPreface:      sendPreface,
 		IsSendSettings: sendSettingsInit,
+		IsAutoAck:      autoAck,
 		PeerSetting:    make(map[http2.SettingID]uint32),
+		AutoAck:        autoAck,
 	}
 	conn.HEnc = hpack.NewEncoder(&conn.HBuf)
+	conn.setLogger(host)
 
 	raw, err := Dial(host, isTLS)
 	if err != nil {
 		conn.handleError(err)
 		return conn
 	}
-	fmt.Println(raw)
 	conn.Raw = raw
 	conn.SetupFramer()
 
@@ -74,11 +226,15 @@ func NewConnection(host string, isTLS, sendPreface, sendSettingsInit bool) *Conn
 
 func NewConnectionRaw(c net.Conn, tls bool) *Connection {
 	conn := &Connection{
-		Host:  "localhost",
-		IsTLS: tls,
-		Raw:   c,
+		Host:        "localhost",
+		IsTLS:       tls,
+		Raw:         c,
+		PeerSetting: make(map[http2.SettingID]uint32),
+		IsAutoAck:   true,
+		AutoAck:     true,
 	}
 	conn.HEnc = hpack.NewEncoder(&conn.HBuf)
+	conn.setLogger(c.RemoteAddr().String())
 	conn.SetupFramer()
 	conn.SendInitSettings()
 	go func() { conn.readFrames() }()
@@ -86,22 +242,29 @@ func NewConnectionRaw(c net.Conn, tls bool) *Connection {
 	return conn
 }
 
-func NewServerConnection(c net.Conn, tls bool) *Connection {
+// NewServerConnection reads the client's preface from c. Without
+// sendSettingsInit our SETTINGS isn't sent and the client's SETTINGS isn't
+// ACKed, which leaves the server preface to a strategy. Without autoAck the
+// client's SETTINGS are never ACKed for us.
+func NewServerConnection(c net.Conn, tls, sendSettingsInit, autoAck bool) *Connection {
 	conn := &Connection{
 		Host:           "localhost",
 		IsTLS:          tls,
 		Raw:            c,
 		PeerSetting:    make(map[http2.SettingID]uint32),
-		IsSendSettings: true,
+		IsSendSettings: sendSettingsInit,
+		IsAutoAck:      autoAck,
+		AutoAck:        sendSettingsInit && autoAck,
+		Requests:       make(chan Request, 64),
 	}
 	conn.HEnc = hpack.NewEncoder(&conn.HBuf)
+	conn.setLogger(c.RemoteAddr().String())
 	conn.SetupFramer()
 
 	conn.readPreface()
-	conn.Framer.WriteSettings()
-	conn.Framer.WriteSettingsAck()
-	conn.Framer.WriteSettings()
-	conn.Framer.WriteSettingsAck()
+	if sendSettingsInit {
+		conn.SendInitSettings()
+	}
 
 	go func() { conn.readFrames() }()
 
@@ -109,34 +272,73 @@ func NewServerConnection(c net.Conn, tls bool) *Connection {
 }
 
 func (conn *Connection) handleError(err error) error {
-	if err != nil {
-		log.Println(err)
+	if err == nil {
+		return nil
+	}
+	// Only the first error counts. Whatever follows it, like reads on the
+	// connection we just closed, is a consequence.
+	conn.errMu.Lock()
+	first := conn.Err == nil
+	if first {
 		conn.Err = err
-		if conn.Raw != nil {
-			conn.Raw.Close()
-		}
+	}
+	conn.errMu.Unlock()
+	if !first {
+		return err
+	}
+	if err != errHungUp {
+		conn.logger.Info("Connection error", "err", err)
+		connErrorsMetric.Inc(conn.Host, conn.errorCause(err))
+	}
+	if conn.Raw != nil {
+		conn.Raw.Close()
+	}
+	if conn.Log != nil {
+		conn.Log.Close()
 	}
 	return err
 }
 
+// closeErr is Err, read under the lock handleError sets it with.
+func (conn *Connection) closeErr() error {
+	conn.errMu.Lock()
+	defer conn.errMu.Unlock()
+	return conn.Err
+}
+
 func (conn *Connection) SetupFramer() {
-	conn.Framer = http2.NewFramer(conn.Raw, conn.Raw)
+	conn.reader = frameReader{conn: conn}
+	conn.Framer = http2.NewFramer(hookWriter{conn}, &conn.reader)
 	conn.Framer.AllowIllegalWrites = true
+
+	if config.SessionDir != "" && conn.Log == nil {
+		l, err := replay.NewSessionLog(config.SessionDir)
+		if err != nil {
+			conn.logger.Warn("Not logging session", "err", err)
+			return
+		}
+		conn.Log = l
+		conn.logger.Info("Logging session", "file", l.Filename)
+	}
 }
 
 func (conn *Connection) SendInitSettings() {
-	conn.Framer.WriteSettings()
-	conn.Framer.WriteSettingsAck()
+	conn.WriteSettingsFrame(nil)
 }
 
 func (conn *Connection) readPreface() error {
 	buffer := make([]byte, len(http2.ClientPreface))
-	n, err := conn.Raw.Read(buffer)
+	n, err := io.ReadFull(conn.Raw, buffer)
 	if err != nil {
-		fmt.Println("Error reading preface", buffer)
-		return conn.handleError(err)
+		conn.logger.Warn("Client preface is wrong", "data", logging.Payload(buffer[:n]))
+		return conn.handleError(fmt.Errorf("reading preface: %v", err))
+	}
+	if string(buffer) != http2.ClientPreface {
+		// Keep going: what the client does next is worth seeing too.
+		conn.logger.Warn("Client preface is wrong", "data", logging.Payload(buffer))
+		return nil
 	}
-	fmt.Println("READ PREFACE", string(buffer[:n]))
+	conn.logger.Debug("Read preface", "data", logging.Payload(buffer))
 	return nil
 }
 
@@ -148,129 +350,296 @@ func (conn *Connection) SendPreface() error {
 }
 
 func settingByName(name string) (http2.SettingID, bool) {
-	for _, sid := range [...]http2.SettingID{
-		http2.SettingHeaderTableSize,
-		http2.SettingEnablePush,
-		http2.SettingMaxConcurrentStreams,
-		http2.SettingInitialWindowSize,
-		http2.SettingMaxFrameSize,
-		http2.SettingMaxHeaderListSize,
-	} {
-		if strings.EqualFold(sid.String(), name) {
+	for _, sid := range SettingIDs {
+		if strings.EqualFold(settingName(sid), name) {
+			return sid, true
+		}
+	}
+	for sid, sname := range settingNames {
+		if strings.EqualFold(sname, name) {
 			return sid, true
 		}
 	}
 	return 0, false
 }
 
-func (conn *Connection) SendPing(data [8]byte) error {
-	err := conn.Framer.WritePing(false, data)
+// write serializes access to the framer, which is shared by the strategies
+// and by readFrames when it ACKs the peer's settings.
+func (conn *Connection) write(fn func() error) error {
+	conn.writeMu.Lock()
+	err := fn()
+	conn.writeMu.Unlock()
 	return conn.handleError(err)
 }
 
+func (conn *Connection) SendPing(data [8]byte) error {
+	return conn.write(func() error { return conn.Framer.WritePing(false, data) })
+}
+
 func (conn *Connection) WriteSettingsFrame(settings []http2.Setting) error {
-	fmt.Println("SettingsFrame", settings)
-	err := conn.Framer.WriteSettings(settings...)
-	return conn.handleError(err)
+	conn.logger.Debug("Sending SETTINGS", "settings", settings)
+	return conn.write(func() error { return conn.Framer.WriteSettings(settings...) })
+}
+
+// WriteSettingsAck ACKs the peer's settings. It is sent even if the peer has
+// nothing outstanding.
+func (conn *Connection) WriteSettingsAck() error {
+	conn.logger.Debug("Sending SETTINGS ACK")
+	return conn.write(func() error { return conn.Framer.WriteSettingsAck() })
+}
+
+func (conn *Connection) SetAutoAck(autoAck bool) {
+	conn.settingsMu.Lock()
+	conn.AutoAck = autoAck
+	conn.settingsMu.Unlock()
+}
+
+// PeerSettingsPending returns how many of the peer's SETTINGS frames are waiting for an ACK.
+func (conn *Connection) PeerSettingsPending() int {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.PeerSettingsUnacked
+}
+
+// OldestPendingSettings returns how long our oldest unacknowledged SETTINGS
+// frame has been waiting, and false if nothing is waiting.
+func (conn *Connection) OldestPendingSettings() (time.Duration, bool) {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	if len(conn.PendingSettings) == 0 {
+		return 0, false
+	}
+	return time.Since(conn.PendingSettings[0].Sent), true
+}
+
+func (conn *Connection) addPendingSettings(settings []http2.Setting) {
+	conn.settingsMu.Lock()
+	conn.PendingSettings = append(conn.PendingSettings, PendingSettings{Settings: settings, Sent: time.Now()})
+	conn.settingsMu.Unlock()
+}
+
+// onSentFrame keeps track of the SETTINGS frames that went out.
+func (conn *Connection) onSentFrame(frame replay.RawFrame) {
+	if frame.FrameType != settingsFrameType {
+		return
+	}
+	if frame.Flags&settingsFlagAck == 0 {
+		conn.addPendingSettings(DecodeSettings(frame.Payload))
+	} else {
+		conn.onSentSettingsAck()
+	}
+}
+
+func (conn *Connection) onSentSettingsAck() {
+	conn.settingsMu.Lock()
+	if conn.PeerSettingsUnacked > 0 {
+		conn.PeerSettingsUnacked--
+	}
+	conn.settingsMu.Unlock()
+}
+
+func (conn *Connection) onSettingsAck() {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	if len(conn.PendingSettings) == 0 {
+		conn.logger.Info("Unsolicited SETTINGS ACK")
+		return
+	}
+	pending := conn.PendingSettings[0]
+	conn.PendingSettings = conn.PendingSettings[1:]
+	conn.SettingsAcked = time.Now()
+	conn.logger.Debug("SETTINGS ACKed", "settings", pending.Settings, "after", conn.SettingsAcked.Sub(pending.Sent))
 }
 
 func (conn *Connection) WriteDataFrame(streamID uint32, endStream bool, data []byte) error {
-	fmt.Println("DataFrame", streamID, endStream, data)
-	err := conn.Framer.WriteData(streamID, endStream, data)
-	return conn.handleError(err)
+	conn.logger.Debug("Sending DATA", "stream", streamID, "end_stream", endStream, "data", logging.Payload(data))
+	return conn.write(func() error { return conn.Framer.WriteData(streamID, endStream, data) })
 }
 
 func (conn *Connection) WritePushPromiseFrame(promise http2.PushPromiseParam) error {
-	fmt.Println("PushPromiseFrame", promise)
-	err := conn.Framer.WritePushPromise(promise)
-	return conn.handleError(err)
+	conn.logger.Debug("Sending PUSH_PROMISE", "stream", promise.StreamID, "promise", promise.PromiseID, "block", logging.Payload(promise.BlockFragment))
+	return conn.write(func() error { return conn.Framer.WritePushPromise(promise) })
 }
 
 func (conn *Connection) WriteContinuationFrame(streamID uint32, endStream bool, data []byte) error {
-	fmt.Println("ContinuationFrame", streamID, endStream, data)
-	err := conn.Framer.WriteContinuation(streamID, endStream, data)
-	return conn.handleError(err)
+	conn.logger.Debug("Sending CONTINUATION", "stream", streamID, "end_headers", endStream, "block", logging.Payload(data))
+	return conn.write(func() error { return conn.Framer.WriteContinuation(streamID, endStream, data) })
 }
 
 func (conn *Connection) WritePriorityFrame(streamId, streamDep uint32, weight uint8, exclusive bool) error {
-	fmt.Println("PriorityFrame", streamId, streamDep, weight, exclusive)
+	conn.logger.Debug("Sending PRIORITY", "stream", streamId, "dep", streamDep, "weight", weight, "exclusive", exclusive)
 	priorityParam := http2.PriorityParam{StreamDep: streamDep, Exclusive: exclusive, Weight: weight}
-	err := conn.Framer.WritePriority(streamId, priorityParam)
-	return conn.handleError(err)
+	return conn.write(func() error { return conn.Framer.WritePriority(streamId, priorityParam) })
 }
 
 func (conn *Connection) WriteResetFrame(streamId uint32, errorCode uint32) error {
-	fmt.Println("ResetFrame", streamId, errorCode)
-	err := conn.Framer.WriteRSTStream(streamId, http2.ErrCode(errorCode))
-	return conn.handleError(err)
+	conn.logger.Debug("Sending RST_STREAM", "stream", streamId, "code", http2.ErrCode(errorCode))
+	return conn.write(func() error { return conn.Framer.WriteRSTStream(streamId, http2.ErrCode(errorCode)) })
 }
 
 func (conn *Connection) WriteWindowUpdateFrame(streamId, incr uint32) error {
-	fmt.Println("WindowUpdateFrame", streamId, incr)
-	err := conn.Framer.WriteWindowUpdate(streamId, incr)
-	return conn.handleError(err)
+	conn.logger.Debug("Sending WINDOW_UPDATE", "stream", streamId, "increment", incr)
+	return conn.write(func() error { return conn.Framer.WriteWindowUpdate(streamId, incr) })
 }
 
 func (conn *Connection) WriteRawFrame(frameType, flags uint8, streamID uint32, payload []byte) error {
-	err := conn.Framer.WriteRawFrame(http2.FrameType(frameType), http2.Flags(flags), streamID, payload)
-	if err == nil {
-		replay.SaveRawFrame(frameType, flags, streamID, payload)
+	return conn.write(func() error {
+		conn.saveWrites = true
+		defer func() { conn.saveWrites = false }()
+		return conn.Framer.WriteRawFrame(http2.FrameType(frameType), http2.Flags(flags), streamID, payload)
+	})
+}
+
+// writeFrame is WriteRawFrame without saving the frame to the replay file.
+func (conn *Connection) writeFrame(frameType, flags uint8, streamID uint32, payload []byte) error {
+	return conn.write(func() error {
+		return conn.Framer.WriteRawFrame(http2.FrameType(frameType), http2.Flags(flags), streamID, payload)
+	})
+}
+
+// NewReplayConnection dials host to replay frames on. A replay that starts
+// with raw data, like one PrefaceFuzzer saved, brings its own preface, so
+// the connection is opened without one or our SETTINGS.
+func NewReplayConnection(host string, isTLS bool, frames []replay.RawFrame) *Connection {
+	preface := len(frames) == 0 || !frames[0].Raw
+	return NewConnection(host, isTLS, preface, preface, true)
+}
+
+// ReplayFrames writes frames loaded from a replay file. They are not recorded
+// to replay.json again.
+func (conn *Connection) ReplayFrames(frames []replay.RawFrame) error {
+	for _, frame := range frames {
+		err := conn.write(func() error {
+			if frame.Raw {
+				_, err := conn.Raw.Write(frame.Payload)
+				return err
+			}
+			return conn.Framer.WriteRawFrame(http2.FrameType(frame.FrameType), http2.Flags(frame.Flags), frame.StreamID, frame.Payload)
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// captureFrame runs write against a scratch framer and returns the frame it
+// produced, so it can be sent with WriteRawFrame and end up in the replay file.
+func captureFrame(write func(f *http2.Framer) error) (replay.RawFrame, error) {
+	var buf bytes.Buffer
+	framer := http2.NewFramer(&buf, nil)
+	framer.AllowIllegalWrites = true
+	if err := write(framer); err != nil {
+		return replay.RawFrame{}, err
 	}
+	return parseRawFrame(buf.Bytes())
+}
 
-	return conn.handleError(err)
+// parseRawFrame splits a single serialized frame into its header fields and
+// payload.
+func parseRawFrame(b []byte) (replay.RawFrame, error) {
+	if len(b) < frameHeaderLen {
+		return replay.RawFrame{}, errors.New("short frame header")
+	}
+	length := int(b[0])<<16 | int(b[1])<<8 | int(b[2])
+	if len(b) < frameHeaderLen+length {
+		return replay.RawFrame{}, errors.New("short frame payload")
+	}
+	return replay.RawFrame{
+		FrameType: b[3],
+		Flags:     b[4],
+		StreamID:  binary.BigEndian.Uint32(b[5:]) & (1<<31 - 1),
+		Payload:   b[frameHeaderLen : frameHeaderLen+length],
+	}, nil
 }
 
 func (conn *Connection) cmdHeaders(headers map[string]string) error {
 
 	hbf := conn.encodeHeaders(conn.Host, "GET", "", headers)
+	conn.nextStreamID()
+
+	if len(hbf) > 16<<10 {
+		conn.logger.Warn("Header block too large, not sent", "size", len(hbf))
+		return nil
+	}
+	conn.logger.Debug("Sending HEADERS", "stream", conn.StreamID, "headers", headers)
+	return conn.write(func() error {
+		return conn.Framer.WriteHeaders(http2.HeadersFrameParam{
+			StreamID:      conn.StreamID,
+			BlockFragment: hbf,
+			EndStream:     true, // good enough for now
+			EndHeaders:    true, // for now
+		})
+	})
+}
 
+func (conn *Connection) nextStreamID() uint32 {
 	if conn.StreamID == 0 {
 		conn.StreamID = 1
 	} else {
 		conn.StreamID += 2
 	}
-	log.Printf("Opening Stream-ID %d:", conn.StreamID)
-
-	if len(hbf) > 16<<10 {
-		log.Printf("TODO")
-		return nil
-	}
-	return conn.Framer.WriteHeaders(http2.HeadersFrameParam{
-		StreamID:      conn.StreamID,
-		BlockFragment: hbf,
-		EndStream:     true, // good enough for now
-		EndHeaders:    true, // for now
-	})
+	return conn.StreamID
 }
 
 func (conn *Connection) readFrames() error {
+	if conn.Requests != nil {
+		defer close(conn.Requests)
+	}
 	for {
 		f, err := conn.Framer.ReadFrame()
+		entry := replay.LogEntry{Time: time.Now(), Received: true}
+		frame, perr := parseRawFrame(conn.reader.take())
+		entry.Frame = frame
 		if err != nil {
-			return fmt.Errorf("ReadFrame: %v", err)
+			err = fmt.Errorf("ReadFrame: %w", err)
+			// A whole frame the framer rejected is still worth keeping.
+			if perr == nil {
+				entry.Summary = err.Error()
+				conn.record(entry)
+			}
+			// Unless we closed it, the peer dropped the connection.
+			conn.handleError(err)
+			return err
 		}
-		log.Printf("Received: %v", f)
+		conn.count(func(c *Counters) { c.FramesReceived++ })
+		connFramesMetric.Inc("received", frameTypeLabel(frame.FrameType))
+		entry.Summary = fmt.Sprint(f)
+		ack := false
 		switch f := f.(type) {
-		case *http2.PingFrame:
-			log.Printf("  Data = %q", f.Data)
 		case *http2.SettingsFrame:
+			if f.IsAck() {
+				conn.onSettingsAck()
+				break
+			}
+			conn.settingsMu.Lock()
 			f.ForeachSetting(func(s http2.Setting) error {
-				log.Printf("  %v", s)
+				entry.Summary += fmt.Sprintf(" %v", s)
+				if s.ID == SettingEnableConnectProtocol && (s.Val > 1 || s.Val == 0 && conn.PeerSetting[s.ID] == 1) {
+					// RFC 8441 section 3: only 0 or 1, and never 0 after 1.
+					conn.logger.Warn("Peer sent a bad ENABLE_CONNECT_PROTOCOL", "value", s.Val, "was", conn.PeerSetting[s.ID])
+				}
 				conn.PeerSetting[s.ID] = s.Val
 				return nil
 			})
-			// conn.cmdSettings([]string{"ACK"})
-		case *http2.WindowUpdateFrame:
-			log.Printf("  Window-Increment = %v\n", f.Increment)
+			conn.PeerSettingsUnacked++
+			ack = conn.AutoAck
+			conn.settingsMu.Unlock()
 		case *http2.GoAwayFrame:
-			log.Printf("  Last-Stream-ID = %d; Error-Code = %v (%d)\n", f.LastStreamID, f.ErrCode, f.ErrCode)
+			conn.logger.Info("Received GOAWAY", "last_stream", f.LastStreamID, "code", f.ErrCode, "debug", string(f.DebugData()))
+			entry.Summary += fmt.Sprintf(" Last-Stream-ID = %d; Error-Code = %v; Debug = %q", f.LastStreamID, f.ErrCode, f.DebugData())
+			conn.record(entry)
+			conn.count(func(c *Counters) { c.GoAway = countCode(c.GoAway, f.ErrCode) })
+			goAwayMetric.Inc(conn.Host, f.ErrCode.String())
+			conn.GoAway = true
+			conn.GoAwayCode = f.ErrCode
 			conn.handleError(fmt.Errorf("Recieved GoAwayFrame %v", f.ErrCode))
-		case *http2.DataFrame:
-			log.Printf("  %q", f.Data())
+			continue
+		case *http2.RSTStreamFrame:
+			conn.count(func(c *Counters) { c.Reset = countCode(c.Reset, f.ErrCode) })
+			resetMetric.Inc(conn.Host, f.ErrCode.String())
+			conn.deliverResponse(f.StreamID, "")
 		case *http2.HeadersFrame:
-			if f.HasPriority() {
-				log.Printf("  PRIORITY = %v", f.Priority)
-			}
 			if conn.HDec == nil {
 				// TODO: if the user uses h2i to send a SETTINGS frame advertising
 				// something larger, we'll need to respect SETTINGS_HEADER_TABLE_SIZE
@@ -279,16 +648,93 @@ func (conn *Connection) readFrames() error {
 				conn.HDec = hpack.NewDecoder(tableSize, conn.onNewHeaderField)
 			}
 			conn.HDec.Write(f.HeaderBlockFragment())
+			entry.Headers, conn.headers = conn.headers, nil
+			for _, h := range entry.Headers {
+				if h.Name == ":status" && !strings.HasPrefix(h.Value, "1") {
+					conn.deliverResponse(f.StreamID, h.Value)
+				}
+			}
+			if conn.Requests != nil {
+				select {
+				case conn.Requests <- Request{StreamID: f.StreamID, Headers: entry.Headers, EndStream: f.StreamEnded()}:
+				default:
+				}
+			}
+		}
+		if len(entry.Headers) > 0 {
+			conn.logger.Debug("Received", "frame", entry.Summary, "payload", logging.Payload(entry.Frame.Payload), "headers", entry.Headers)
+		} else {
+			conn.logger.Debug("Received", "frame", entry.Summary, "payload", logging.Payload(entry.Frame.Payload))
+		}
+		// Recorded before the ACK goes out, so the log keeps wire order.
+		conn.record(entry)
+		if ack {
+			conn.WriteSettingsAck()
+		}
+	}
+}
+
+// expectResponse returns a channel that gets the :status of the response
+// on streamID, or "" if the stream is reset first. Call it before sending
+// the request, and forgetResponse when done waiting.
+func (conn *Connection) expectResponse(streamID uint32) <-chan string {
+	conn.responseMu.Lock()
+	defer conn.responseMu.Unlock()
+	if conn.responses == nil {
+		conn.responses = map[uint32]chan string{}
+	}
+	ch := make(chan string, 1)
+	conn.responses[streamID] = ch
+	return ch
+}
+
+func (conn *Connection) forgetResponse(streamID uint32) {
+	conn.responseMu.Lock()
+	delete(conn.responses, streamID)
+	conn.responseMu.Unlock()
+}
+
+func (conn *Connection) deliverResponse(streamID uint32, status string) {
+	conn.responseMu.Lock()
+	defer conn.responseMu.Unlock()
+	if ch, ok := conn.responses[streamID]; ok {
+		ch <- status
+		delete(conn.responses, streamID)
+	}
+}
+
+// waitResponse waits up to timeout for what expectResponse promised. ok is
+// false if nothing came, or the connection broke first.
+func (conn *Connection) waitResponse(streamID uint32, ch <-chan string, timeout time.Duration) (status string, ok bool) {
+	defer conn.forgetResponse(streamID)
+	deadline := time.After(timeout)
+	tick := time.NewTicker(50 * time.Millisecond)
+	defer tick.Stop()
+	for {
+		select {
+		case status = <-ch:
+			return status, true
+		case <-deadline:
+			return "", false
+		case <-tick.C:
+			if conn.closeErr() != nil {
+				return "", false
+			}
 		}
 	}
 }
 
+// ConnectProtocolEnabled says whether the peer's SETTINGS allow extended
+// CONNECT.
+func (conn *Connection) ConnectProtocolEnabled() bool {
+	conn.settingsMu.Lock()
+	defer conn.settingsMu.Unlock()
+	return conn.PeerSetting[SettingEnableConnectProtocol] == 1
+}
+
 // called from readLoop
 func (conn *Connection) onNewHeaderField(f hpack.HeaderField) {
-	if f.Sensitive {
-		log.Printf("  %s = %q (SENSITIVE)", f.Name, f.Value)
-	}
-	log.Printf("  %s = %q", f.Name, f.Value)
+	conn.headers = append(conn.headers, replay.HeaderField{Name: f.Name, Value: f.Value, Sensitive: f.Sensitive})
 }
 
 func (conn *Connection) encodeHeaders(host, method, path string, headers map[string]string) []byte {
@@ -322,48 +768,97 @@ func (conn *Connection) encodeHeaders(host, method, path string, headers map[str
 	return conn.HBuf.Bytes()
 }
 
+// encodeConnect encodes a CONNECT request to authority. Unlike other
+// requests it has no :path or :scheme (RFC 7540 section 8.3).
+func (conn *Connection) encodeConnect(authority string, headers map[string]string) []byte {
+	conn.HBuf.Reset()
+
+	conn.writeHeader(":method", "CONNECT")
+	conn.writeHeader(":authority", authority)
+
+	for k, v := range headers {
+		lowKey := strings.ToLower(k)
+		if lowKey == "host" {
+			continue
+		}
+		conn.writeHeader(lowKey, v)
+	}
+	return conn.HBuf.Bytes()
+}
+
 func (conn *Connection) writeHeader(name, value string) {
 	conn.HEnc.WriteField(hpack.HeaderField{Name: name, Value: value})
-	log.Printf(" %s = %s", name, value)
 }
 
 func Dial(host string, isTLS bool) (net.Conn, error) {
-	log.Printf("Connecting to %s ...", host)
+	slog.Info("Connecting", "host", host)
 
-	if isTLS {
-		cfg := &tls.Config{
-			ServerName:         host,
-			NextProtos:         []string{"h2", "h2-14"},
-			InsecureSkipVerify: true,
-		}
+	TCPConn, err := dialTCP(host)
+	if err != nil {
+		return nil, err
+	}
 
-		tc, err := tls.Dial("tcp", host, cfg)
+	if isTLS {
+		cfg, err := clientTLSConfig(host)
 		if err != nil {
+			TCPConn.Close()
 			return nil, err
 		}
 
-		log.Printf("Connected to %v", tc.RemoteAddr())
+		tc := tls.Client(TCPConn, cfg)
 
 		if err := tc.Handshake(); err != nil {
+			tc.Close()
 			return nil, err
 		}
 
 		state := tc.ConnectionState()
 		if !state.NegotiatedProtocolIsMutual || state.NegotiatedProtocol == "" {
-			return nil, errors.New("sever doesn't support http2")
+			tc.Close()
+			return nil, errNoHTTP2
 		}
-		log.Printf("Negotiated protocol %q", state.NegotiatedProtocol)
+		slog.Info("Connected", "host", host, "addr", tc.RemoteAddr(), "proto", state.NegotiatedProtocol)
 
-		return tc, nil
-	} else {
+		return wrapTransport(tc), nil
+	}
 
-		log.Printf("Connecting to %s ...", host)
-		TCPConn, err := net.Dial("tcp", host)
-		if err != nil {
-			return nil, err
-		}
+	return wrapTransport(TCPConn), nil
+}
 
-		return TCPConn, nil
+// dialTCP connects to host, through a proxy if config.Proxy names any, and
+// captures the connection if config.PcapDir is set.
+func dialTCP(host string) (net.Conn, error) {
+	TCPConn, err := dialDirectOrProxy(host)
+	if err != nil {
+		return nil, err
 	}
+	transport.SetNoDelay(TCPConn, config.NoDelay)
+	if config.PcapDir != "" {
+		if c, err := capture.Open(config.PcapDir, TCPConn, true); err != nil {
+			slog.Warn("Not capturing", "host", host, "err", err)
+		} else {
+			TCPConn = c
+		}
+	}
+	return TCPConn, nil
+}
 
+// clientTLSConfig is the TLS config connections to host start from, with
+// the options of LoadClientTLS.
+func clientTLSConfig(host string) (*tls.Config, error) {
+	cfg := &tls.Config{
+		NextProtos:         []string{"h2", "h2-14"},
+		InsecureSkipVerify: true,
+	}
+	if clientTLS != nil {
+		cfg = clientTLS.Clone()
+	}
+	cfg.ServerName = serverName(host)
+	if config.PcapDir != "" {
+		var err error
+		if cfg.KeyLogWriter, err = capture.KeyLogWriter(config.PcapDir); err != nil {
+			return nil, err
+		}
+	}
+	return cfg, nil
 }
@@ -6,52 +6,108 @@ package fuzzer
 
 import (
 	crand "crypto/rand"
-	"fmt"
 	"io"
 	"math/rand"
+	"strconv"
 	"sync"
 	"time"
 
 	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/logging"
 	"github.com/c0nrad/http2fuzz/util"
 
 	"github.com/bradfitz/http2"
 )
 
 type Fuzzer struct {
+	// ID numbers fuzzers in the order they were made.
+	ID   int
 	Mu   *sync.Mutex
 	Conn *Connection
 
 	RestartConnection bool
 	Alive             bool
 	RestartAttempts   int
+
+	// Frames counts the frames each strategy sent, and Reconnects the
+	// connections opened to replace a broken one. retired adds up the
+	// counters of those broken connections. They're guarded by statsMu, as
+	// are Conn, Alive and RestartAttempts when they change.
+	Frames     map[string]uint64
+	Reconnects int
+	retired    Counters
+	statsMu    sync.Mutex
 }
 
 func NewFuzzer(c *Connection, restart bool) *Fuzzer {
-	return &Fuzzer{Conn: c, Mu: new(sync.Mutex), RestartConnection: restart, Alive: true, RestartAttempts: 0}
+	fuzzer := &Fuzzer{Conn: c, Mu: new(sync.Mutex), RestartConnection: restart, Alive: true, RestartAttempts: 0, Frames: map[string]uint64{}}
+	register(fuzzer)
+	return fuzzer
+}
+
+// Strategies maps each strategy's name to its method, for picking strategies
+// from the command line.
+var Strategies = map[string]func(*Fuzzer){
+	"RawTCPFuzzer":           (*Fuzzer).RawTCPFuzzer,
+	"ContinuationFuzzer":     (*Fuzzer).ContinuationFuzzer,
+	"PushPromiseFuzzer":      (*Fuzzer).PushPromiseFuzzer,
+	"DataFuzzer":             (*Fuzzer).DataFuzzer,
+	"RawFrameFuzzer":         (*Fuzzer).RawFrameFuzzer,
+	"WindowUpdateFuzzer":     (*Fuzzer).WindowUpdateFuzzer,
+	"ResetFuzzer":            (*Fuzzer).ResetFuzzer,
+	"PingFuzzer":             (*Fuzzer).PingFuzzer,
+	"PriorityFuzzer":         (*Fuzzer).PriorityFuzzer,
+	"HeaderFuzzer":           (*Fuzzer).HeaderFuzzer,
+	"SettingsFuzzer":         (*Fuzzer).SettingsFuzzer,
+	"SettingsBoundaryFuzzer": (*Fuzzer).SettingsBoundaryFuzzer,
+	"SettingsAckFuzzer":      (*Fuzzer).SettingsAckFuzzer,
+	"ResponseFuzzer":         (*Fuzzer).ResponseFuzzer,
+	"PrefaceFuzzer":          (*Fuzzer).PrefaceFuzzer,
+	"ExtendedConnectFuzzer":  (*Fuzzer).ExtendedConnectFuzzer,
+	"ConnectTunnelFuzzer":    (*Fuzzer).ConnectTunnelFuzzer,
 }
 
 func (fuzzer *Fuzzer) CheckConnection() {
 	for fuzzer.Conn.Err != nil {
 
 		if !fuzzer.RestartConnection {
-			fuzzer.Alive = false
+			fuzzer.kill()
 			return
 		}
 
 		time.Sleep(config.RestartDelay)
+		if TargetSupervisor != nil {
+			TargetSupervisor.WaitReady()
+		}
 		fuzzer.Mu.Lock()
-		if fuzzer.Conn.Err != nil {
-			fuzzer.Conn = NewConnection(config.Target, fuzzer.Conn.IsTLS, fuzzer.Conn.IsPreface, fuzzer.Conn.IsSendSettings)
+		if old := fuzzer.Conn; old.Err != nil {
+			conn := NewConnection(config.Target, old.IsTLS, old.IsPreface, old.IsSendSettings, old.IsAutoAck)
+			fuzzer.statsMu.Lock()
+			fuzzer.retired.add(old.Counters())
+			fuzzer.Conn = conn
+			fuzzer.Reconnects++
+			reconnectsMetric.Inc(strconv.Itoa(fuzzer.ID))
+			fuzzer.statsMu.Unlock()
 		}
 		fuzzer.Mu.Unlock()
+		fuzzer.statsMu.Lock()
 		fuzzer.RestartAttempts += 1
-		if fuzzer.RestartAttempts > config.MaxRestartAttempts {
-			fuzzer.Alive = false
+		attempts := fuzzer.RestartAttempts
+		fuzzer.statsMu.Unlock()
+		if attempts > config.MaxRestartAttempts {
+			fuzzer.kill()
 			return
 		}
 	}
+	fuzzer.statsMu.Lock()
 	fuzzer.RestartAttempts = 0
+	fuzzer.statsMu.Unlock()
+}
+
+func (fuzzer *Fuzzer) kill() {
+	fuzzer.statsMu.Lock()
+	fuzzer.Alive = false
+	fuzzer.statsMu.Unlock()
 }
 
 func (fuzzer *Fuzzer) RawTCPFuzzer() {
@@ -63,8 +119,11 @@ func (fuzzer *Fuzzer) RawTCPFuzzer() {
 		crand.Read(payload)
 
 		fuzzer.Mu.Lock()
+		fuzzer.Conn.logger.Debug("Sending raw bytes", "strategy", "RawTCPFuzzer", "data", logging.Payload(payload))
 		if _, err := io.WriteString(fuzzer.Conn.Raw, string(payload)); err != nil {
 			fuzzer.Conn.handleError(err)
+		} else {
+			fuzzer.sent("RawTCPFuzzer", "RAW_TCP", 1)
 		}
 		fuzzer.Mu.Unlock()
 
@@ -77,223 +136,92 @@ func (fuzzer *Fuzzer) RawTCPFuzzer() {
 		fuzzer.CheckConnection()
 	}
 
-	fmt.Println("Stopping RawTCPFuzzer:", fuzzer.Conn.Err)
+	fuzzer.stopped("RawTCPFuzzer")
 }
 
-func (fuzzer *Fuzzer) ContinuationFuzzer() {
+// generatorFuzzer sends frames from generate until the fuzzer dies. With
+// save, the frames are also saved to the replay file.
+func (fuzzer *Fuzzer) generatorFuzzer(name string, generate FrameGenerator, save bool) {
 	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
 
 	for fuzzer.Alive {
-		streamId := uint32(rand.Int31())
-		endStream := rand.Int31()%2 == 0
-
-		payloadLength := int32(rand.Intn(10000))
-		payload := make([]byte, payloadLength)
-		crand.Read(payload)
+		frame := generate(r)
 
 		fuzzer.Mu.Lock()
-		fuzzer.Conn.WriteContinuationFrame(streamId, endStream, payload)
+		fuzzer.Conn.logger.Debug("Sending frame", "strategy", name, "type", frame.FrameType, "flags", frame.Flags, "stream", frame.StreamID, "payload", logging.Payload(frame.Payload))
+		write := fuzzer.Conn.writeFrame
+		if save {
+			write = fuzzer.Conn.WriteRawFrame
+		}
+		if write(frame.FrameType, frame.Flags, frame.StreamID, frame.Payload) == nil {
+			fuzzer.sent(name, frameTypeLabel(frame.FrameType), 1)
+		}
 		fuzzer.Mu.Unlock()
 
 		time.Sleep(config.FuzzDelay)
 		fuzzer.CheckConnection()
 	}
-
-	fmt.Println("Stopping ContinuationFuzzer:", fuzzer.Conn.Err)
+	fuzzer.stopped(name)
 }
 
-func (fuzzer *Fuzzer) PushPromiseFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		payloadLength := int32(rand.Intn(10000))
-		payload := make([]byte, payloadLength)
-		crand.Read(payload)
-
-		promise := http2.PushPromiseParam{
-			StreamID:      uint32(rand.Int31()),
-			PromiseID:     uint32(rand.Int31()),
-			BlockFragment: payload,
-			EndHeaders:    rand.Int31()%2 == 0,
-			PadLength:     uint8(rand.Intn(256)),
-		}
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WritePushPromiseFrame(promise)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
+// stopped logs that a strategy gave up, along with the error that killed its
+// connection.
+func (fuzzer *Fuzzer) stopped(name string) {
+	fuzzer.Conn.logger.Warn("Stopping strategy", "strategy", name, "err", fuzzer.Conn.Err)
+}
 
-	}
+func (fuzzer *Fuzzer) ContinuationFuzzer() {
+	fuzzer.generatorFuzzer("ContinuationFuzzer", GenerateContinuationFrame, false)
+}
 
-	fmt.Println("Stopping PushPromiseFuzzer:", fuzzer.Conn.Err)
+func (fuzzer *Fuzzer) PushPromiseFuzzer() {
+	fuzzer.generatorFuzzer("PushPromiseFuzzer", GeneratePushPromiseFrame, false)
 }
 
 func (fuzzer *Fuzzer) DataFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		streamId := uint32(rand.Int31())
-		endStream := rand.Int31()%2 == 0
-
-		payloadLength := int32(rand.Intn(10000))
-		payload := make([]byte, payloadLength)
-		crand.Read(payload)
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WriteDataFrame(streamId, endStream, payload)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-
-	}
-
-	fmt.Println("Stopping DataFuzzer:", fuzzer.Conn.Err)
+	fuzzer.generatorFuzzer("DataFuzzer", GenerateDataFrame, false)
 }
 
 func (fuzzer *Fuzzer) RawFrameFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		frameType := uint8(9)
-		for frameType == 9 {
-			frameType = uint8(rand.Intn(15))
-		}
-
-		flags := uint8(rand.Intn(256))
-		streamId := uint32(rand.Int31())
-
-		payloadLength := int32(rand.Intn(100))
-		payload := make([]byte, payloadLength)
-		crand.Read(payload)
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WriteRawFrame(frameType, flags, streamId, payload)
-		fuzzer.Mu.Unlock()
-		fmt.Printf("%d, %d, %d, FromBase64(%s)\n", frameType, flags, streamId, util.ToBase64(payload))
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-	}
-	fmt.Println("Stopping RawFrameFuzzer:", fuzzer.Conn.Err)
+	fuzzer.generatorFuzzer("RawFrameFuzzer", GenerateRawFrame, true)
 }
 
 func (fuzzer *Fuzzer) WindowUpdateFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		streamId := uint32(rand.Int31())
-		incr := uint32(rand.Int31())
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WriteWindowUpdateFrame(streamId, incr)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-	}
-	fmt.Println("Stopping WindowUpdate Fuzzer:", fuzzer.Conn.Err)
+	fuzzer.generatorFuzzer("WindowUpdateFuzzer", GenerateWindowUpdateFrame, false)
 }
 
 func (fuzzer *Fuzzer) ResetFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		streamId := uint32(rand.Int31())
-		errorCode := uint32(rand.Int31())
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WriteResetFrame(streamId, errorCode)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-	}
-	fmt.Println("Stopping ResetFuzzer:", fuzzer.Conn.Err)
+	fuzzer.generatorFuzzer("ResetFuzzer", GenerateResetFrame, false)
 }
 
 func (fuzzer *Fuzzer) PingFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		data := [8]byte{byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256)), byte(rand.Intn(256))}
-		fmt.Println("SENDING DATA", data)
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.SendPing(data)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-	}
-	fmt.Println("Stopping PingFuzzer:", fuzzer.Conn.Err)
+	fuzzer.generatorFuzzer("PingFuzzer", GeneratePingFrame, false)
 }
 
 func (fuzzer *Fuzzer) PriorityFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		streamDep := uint32(rand.Int31())
-		streamId := uint32(rand.Int31())
-		weight := uint8(rand.Intn(256))
-		exclusive := rand.Int31()%2 == 0
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WritePriorityFrame(streamId, streamDep, weight, exclusive)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-	}
-	fmt.Println("Stopping PriorityFuzzer:", fuzzer.Conn.Err)
+	fuzzer.generatorFuzzer("PriorityFuzzer", GeneratePriorityFrame, false)
 }
 
 func (fuzzer *Fuzzer) HeaderFuzzer() {
 	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
 
 	for fuzzer.Alive {
-		headers := make(map[string]string)
-		numberHeaders := rand.Intn(5)
-		for i := 0; i < numberHeaders; i++ {
-			headers[util.RandomHeader()] = util.RandomHeaderValue()
-		}
+		headers := randomHeaders(r)
 		fuzzer.Mu.Lock()
-		fuzzer.Conn.cmdHeaders(headers)
-		fuzzer.Mu.Unlock()
-
-		time.Sleep(config.FuzzDelay)
-		fuzzer.CheckConnection()
-
-	}
-	fmt.Println("Stopping HeaderFuzzer:", fuzzer.Conn.Err)
-}
-
-func (fuzzer *Fuzzer) SettingsFuzzer() {
-	fuzzer.CheckConnection()
-
-	for fuzzer.Alive {
-		settings := []http2.Setting{}
-		numberSettings := rand.Intn(5)
-		for i := 0; i < numberSettings; i++ {
-			setting := http2.Setting{
-				ID:  randomSettingID(),
-				Val: uint32(rand.Int31()),
-			}
-			settings = append(settings, setting)
+		if fuzzer.Conn.cmdHeaders(headers) == nil {
+			fuzzer.sent("HeaderFuzzer", http2.FrameHeaders.String(), 1)
 		}
-
-		fuzzer.Mu.Lock()
-		fuzzer.Conn.WriteSettingsFrame(settings)
 		fuzzer.Mu.Unlock()
 
 		time.Sleep(config.FuzzDelay)
 		fuzzer.CheckConnection()
 
 	}
-	fmt.Println("Stopping SettingsFuzzer:", fuzzer.Conn.Err)
+	fuzzer.stopped("HeaderFuzzer")
 }
 
-func randomSettingID() http2.SettingID {
-	return http2.SettingID(rand.Intn(6))
+func (fuzzer *Fuzzer) SettingsFuzzer() {
+	fuzzer.generatorFuzzer("SettingsFuzzer", GenerateSettingsFrame, false)
 }
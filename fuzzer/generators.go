@@ -0,0 +1,226 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"sort"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/util"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+// A FrameGenerator builds one random frame, drawing all of its randomness
+// from r. The strategies send what the generators build, and the harness
+// package mutates with them.
+type FrameGenerator func(r *rand.Rand) replay.RawFrame
+
+var FrameGenerators = map[string]FrameGenerator{
+	"Continuation":     GenerateContinuationFrame,
+	"PushPromise":      GeneratePushPromiseFrame,
+	"Data":             GenerateDataFrame,
+	"RawFrame":         GenerateRawFrame,
+	"WindowUpdate":     GenerateWindowUpdateFrame,
+	"Reset":            GenerateResetFrame,
+	"Ping":             GeneratePingFrame,
+	"Priority":         GeneratePriorityFrame,
+	"Headers":          GenerateHeadersFrame,
+	"Settings":         GenerateSettingsFrame,
+	"SettingsBoundary": GenerateSettingsBoundaryFrame,
+}
+
+func randomPayload(r *rand.Rand, max int) []byte {
+	payload := make([]byte, r.Intn(max))
+	r.Read(payload)
+	return payload
+}
+
+// mustCapture is captureFrame for writes that can't fail: the scratch
+// framer allows illegal writes and writes into memory.
+func mustCapture(write func(f *http2.Framer) error) replay.RawFrame {
+	frame, err := captureFrame(write)
+	if err != nil {
+		panic(err)
+	}
+	return frame
+}
+
+func GenerateContinuationFrame(r *rand.Rand) replay.RawFrame {
+	streamId := uint32(r.Int31())
+	endStream := r.Int31()%2 == 0
+	payload := randomPayload(r, 10000)
+
+	return mustCapture(func(f *http2.Framer) error {
+		return f.WriteContinuation(streamId, endStream, payload)
+	})
+}
+
+func GeneratePushPromiseFrame(r *rand.Rand) replay.RawFrame {
+	promise := http2.PushPromiseParam{
+		StreamID:      uint32(r.Int31()),
+		PromiseID:     uint32(r.Int31()),
+		BlockFragment: randomPayload(r, 10000),
+		EndHeaders:    r.Int31()%2 == 0,
+		PadLength:     uint8(r.Intn(256)),
+	}
+
+	return mustCapture(func(f *http2.Framer) error { return f.WritePushPromise(promise) })
+}
+
+func GenerateDataFrame(r *rand.Rand) replay.RawFrame {
+	streamId := uint32(r.Int31())
+	endStream := r.Int31()%2 == 0
+	payload := randomPayload(r, 10000)
+
+	return mustCapture(func(f *http2.Framer) error {
+		return f.WriteData(streamId, endStream, payload)
+	})
+}
+
+// GenerateRawFrame builds a frame of any type but CONTINUATION with random
+// flags and a short random payload.
+func GenerateRawFrame(r *rand.Rand) replay.RawFrame {
+	frameType := uint8(9)
+	for frameType == 9 {
+		frameType = uint8(r.Intn(15))
+	}
+
+	return replay.RawFrame{
+		FrameType: frameType,
+		Flags:     uint8(r.Intn(256)),
+		StreamID:  uint32(r.Int31()),
+		Payload:   randomPayload(r, 100),
+	}
+}
+
+func GenerateWindowUpdateFrame(r *rand.Rand) replay.RawFrame {
+	streamId := uint32(r.Int31())
+	incr := uint32(r.Int31())
+
+	return mustCapture(func(f *http2.Framer) error { return f.WriteWindowUpdate(streamId, incr) })
+}
+
+func GenerateResetFrame(r *rand.Rand) replay.RawFrame {
+	streamId := uint32(r.Int31())
+	errorCode := uint32(r.Int31())
+
+	return mustCapture(func(f *http2.Framer) error {
+		return f.WriteRSTStream(streamId, http2.ErrCode(errorCode))
+	})
+}
+
+func GeneratePingFrame(r *rand.Rand) replay.RawFrame {
+	var data [8]byte
+	r.Read(data[:])
+
+	return mustCapture(func(f *http2.Framer) error { return f.WritePing(false, data) })
+}
+
+func GeneratePriorityFrame(r *rand.Rand) replay.RawFrame {
+	streamId := uint32(r.Int31())
+	priority := http2.PriorityParam{
+		StreamDep: uint32(r.Int31()),
+		Weight:    uint8(r.Intn(256)),
+		Exclusive: r.Int31()%2 == 0,
+	}
+
+	return mustCapture(func(f *http2.Framer) error { return f.WritePriority(streamId, priority) })
+}
+
+func randomHeaders(r *rand.Rand) map[string]string {
+	headers := make(map[string]string)
+	numberHeaders := r.Intn(5)
+	for i := 0; i < numberHeaders; i++ {
+		headers[util.HTTPHeaders[r.Intn(len(util.HTTPHeaders))]] = util.HTTPHeaderValues[r.Intn(len(util.HTTPHeaderValues))]
+	}
+	return headers
+}
+
+// GenerateHeadersFrame opens a low numbered client stream with random
+// headers. Each frame is encoded with its own HPACK encoder, so it never
+// refers to dynamic table entries from a frame the peer may not have seen.
+func GenerateHeadersFrame(r *rand.Rand) replay.RawFrame {
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	henc.WriteField(hpack.HeaderField{Name: ":authority", Value: "localhost"})
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: util.HTTPMethods[r.Intn(len(util.HTTPMethods))]})
+	henc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	henc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	headers := randomHeaders(r)
+	names := make([]string, 0, len(headers))
+	for name := range headers {
+		names = append(names, name)
+	}
+	// Sorted so that the same r always encodes the same frame.
+	sort.Strings(names)
+	for _, name := range names {
+		henc.WriteField(hpack.HeaderField{Name: strings.ToLower(name), Value: headers[name]})
+	}
+
+	param := http2.HeadersFrameParam{
+		StreamID:      uint32(r.Intn(50))*2 + 1,
+		BlockFragment: hbuf.Bytes(),
+		EndStream:     r.Int31()%2 == 0,
+		EndHeaders:    true,
+	}
+	return mustCapture(func(f *http2.Framer) error { return f.WriteHeaders(param) })
+}
+
+func GenerateSettingsFrame(r *rand.Rand) replay.RawFrame {
+	settings := []http2.Setting{}
+	numberSettings := r.Intn(5)
+	for i := 0; i < numberSettings; i++ {
+		setting := http2.Setting{
+			ID:  randomSettingID(r),
+			Val: uint32(r.Int31()),
+		}
+		settings = append(settings, setting)
+	}
+
+	return replay.RawFrame{FrameType: settingsFrameType, Payload: EncodeSettings(settings)}
+}
+
+// maxBytesFrames caps how many frames FromBytes builds from one input.
+const maxBytesFrames = 64
+
+// bytesSource is a rand.Source that reads its numbers from a byte slice, and
+// returns zeros once the slice runs out.
+type bytesSource struct {
+	data []byte
+}
+
+func (s *bytesSource) Int63() int64 {
+	var b [8]byte
+	n := copy(b[:], s.data)
+	s.data = s.data[n:]
+	return int64(binary.BigEndian.Uint64(b[:]) >> 1)
+}
+
+func (s *bytesSource) Seed(int64) {}
+
+// BytesRand returns a rand.Rand whose randomness comes from data, so that a
+// coverage guided engine like go test -fuzz steers the generators by
+// mutating data. more reports whether any of data is left unread.
+func BytesRand(data []byte) (r *rand.Rand, more func() bool) {
+	src := &bytesSource{data: data}
+	return rand.New(src), func() bool { return len(src.data) > 0 }
+}
+
+// FromBytes builds frames with generate until data runs out. The same data
+// always builds the same frames.
+func (generate FrameGenerator) FromBytes(data []byte) []replay.RawFrame {
+	r, more := BytesRand(data)
+	frames := []replay.RawFrame{}
+	for more() && len(frames) < maxBytesFrames {
+		frames = append(frames, generate(r))
+	}
+	return frames
+}
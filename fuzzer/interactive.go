@@ -0,0 +1,249 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bufio"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+
+	"github.com/bradfitz/http2"
+)
+
+const interactiveHelp = `Commands:
+  headers [name=value ...]          open a new stream (:method and :path may be overridden)
+  connect <host:port> [name=value]  open a CONNECT tunnel, then send into it with data
+  data [end] <sid> <text>           send a DATA frame, with END_STREAM if "end" is given
+  ping [hex]                        send a PING with up to 8 bytes of opaque data
+  settings [ack | name=value ...]   send a SETTINGS frame, names or numeric ids
+  raw <type> <flags> <sid> <hex>    send an arbitrary frame
+  rst <sid> [code]                  send a RST_STREAM
+  save <file>                       save the frames sent so far as a replay file
+  reconnect                         open a new connection to the target
+  quit`
+
+// Interactive connects to config.Target and lets a person send hand-crafted
+// frames. Incoming frames are decoded by readFrames as they arrive.
+func Interactive() {
+	conn := NewConnection(config.Target, config.IsTLS(), true, true, true)
+	session := &replay.Session{}
+
+	fmt.Println(interactiveHelp)
+	scanner := bufio.NewScanner(os.Stdin)
+	for {
+		fmt.Print("h2fuzz> ")
+		if !scanner.Scan() {
+			return
+		}
+		args := strings.Fields(scanner.Text())
+		if len(args) == 0 {
+			continue
+		}
+
+		switch args[0] {
+		case "quit", "exit":
+			return
+		case "help":
+			fmt.Println(interactiveHelp)
+			continue
+		case "reconnect":
+			conn = NewConnection(config.Target, config.IsTLS(), true, true, true)
+			continue
+		case "save":
+			if len(args) != 2 {
+				fmt.Println("usage: save <file>")
+				continue
+			}
+			if err := session.Save(args[1]); err != nil {
+				fmt.Println("Error saving session:", err)
+				continue
+			}
+			fmt.Printf("Saved %d frames to %s\n", len(session.Frames), args[1])
+			continue
+		}
+
+		if conn.Err != nil {
+			fmt.Println("Connection is closed:", conn.Err, "(use reconnect)")
+			continue
+		}
+
+		frame, err := conn.interactiveFrame(args)
+		if err != nil {
+			fmt.Println("Error:", err)
+			continue
+		}
+		if err := conn.WriteRawFrame(frame.FrameType, frame.Flags, frame.StreamID, frame.Payload); err != nil {
+			fmt.Println("Error sending frame:", err)
+			continue
+		}
+		session.Add(frame.FrameType, frame.Flags, frame.StreamID, frame.Payload)
+	}
+}
+
+// interactiveFrame builds the frame for a single REPL command.
+func (conn *Connection) interactiveFrame(args []string) (replay.RawFrame, error) {
+	switch args[0] {
+	case "headers":
+		method, path := "GET", ""
+		headers := make(map[string]string)
+		for _, arg := range args[1:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return replay.RawFrame{}, fmt.Errorf("expected name=value, got %q", arg)
+			}
+			switch kv[0] {
+			case ":method":
+				method = kv[1]
+			case ":path":
+				path = kv[1]
+			default:
+				headers[kv[0]] = kv[1]
+			}
+		}
+		hbf := conn.encodeHeaders(conn.Host, method, path, headers)
+		streamID := conn.nextStreamID()
+		return captureFrame(func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      streamID,
+				BlockFragment: hbf,
+				EndStream:     true,
+				EndHeaders:    true,
+			})
+		})
+
+	case "connect":
+		if len(args) < 2 {
+			return replay.RawFrame{}, errors.New("usage: connect <host:port> [name=value ...]")
+		}
+		headers := make(map[string]string)
+		for _, arg := range args[2:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return replay.RawFrame{}, fmt.Errorf("expected name=value, got %q", arg)
+			}
+			headers[kv[0]] = kv[1]
+		}
+		hbf := conn.encodeConnect(args[1], headers)
+		streamID := conn.nextStreamID()
+		return captureFrame(func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{
+				StreamID:      streamID,
+				BlockFragment: hbf,
+				EndHeaders:    true,
+			})
+		})
+
+	case "data":
+		args = args[1:]
+		endStream := len(args) > 0 && args[0] == "end"
+		if endStream {
+			args = args[1:]
+		}
+		if len(args) < 1 {
+			return replay.RawFrame{}, errors.New("usage: data [end] <sid> <text>")
+		}
+		streamID, err := parseUint(args[0], 31)
+		if err != nil {
+			return replay.RawFrame{}, err
+		}
+		data := []byte(strings.Join(args[1:], " "))
+		return captureFrame(func(f *http2.Framer) error {
+			return f.WriteData(uint32(streamID), endStream, data)
+		})
+
+	case "ping":
+		var data [8]byte
+		if len(args) > 1 {
+			b, err := hex.DecodeString(args[1])
+			if err != nil {
+				return replay.RawFrame{}, err
+			}
+			copy(data[:], b)
+		}
+		return captureFrame(func(f *http2.Framer) error { return f.WritePing(false, data) })
+
+	case "settings":
+		if len(args) == 2 && args[1] == "ack" {
+			return captureFrame(func(f *http2.Framer) error { return f.WriteSettingsAck() })
+		}
+		settings := []http2.Setting{}
+		for _, arg := range args[1:] {
+			kv := strings.SplitN(arg, "=", 2)
+			if len(kv) != 2 {
+				return replay.RawFrame{}, fmt.Errorf("expected name=value, got %q", arg)
+			}
+			id, ok := settingByName(kv[0])
+			if !ok {
+				n, err := parseUint(kv[0], 16)
+				if err != nil {
+					return replay.RawFrame{}, fmt.Errorf("unknown setting %q", kv[0])
+				}
+				id = http2.SettingID(n)
+			}
+			val, err := parseUint(kv[1], 32)
+			if err != nil {
+				return replay.RawFrame{}, err
+			}
+			settings = append(settings, http2.Setting{ID: id, Val: uint32(val)})
+		}
+		return replay.RawFrame{FrameType: settingsFrameType, Payload: EncodeSettings(settings)}, nil
+
+	case "raw":
+		if len(args) < 4 {
+			return replay.RawFrame{}, errors.New("usage: raw <type> <flags> <sid> <hex>")
+		}
+		frameType, err := parseUint(args[1], 8)
+		if err != nil {
+			return replay.RawFrame{}, err
+		}
+		flags, err := parseUint(args[2], 8)
+		if err != nil {
+			return replay.RawFrame{}, err
+		}
+		streamID, err := parseUint(args[3], 32)
+		if err != nil {
+			return replay.RawFrame{}, err
+		}
+		payload := []byte{}
+		if len(args) > 4 {
+			if payload, err = hex.DecodeString(args[4]); err != nil {
+				return replay.RawFrame{}, err
+			}
+		}
+		return replay.RawFrame{FrameType: uint8(frameType), Flags: uint8(flags), StreamID: uint32(streamID), Payload: payload}, nil
+
+	case "rst":
+		if len(args) < 2 {
+			return replay.RawFrame{}, errors.New("usage: rst <sid> [code]")
+		}
+		streamID, err := parseUint(args[1], 31)
+		if err != nil {
+			return replay.RawFrame{}, err
+		}
+		code := uint64(http2.ErrCodeCancel)
+		if len(args) > 2 {
+			if code, err = parseUint(args[2], 32); err != nil {
+				return replay.RawFrame{}, err
+			}
+		}
+		return captureFrame(func(f *http2.Framer) error {
+			return f.WriteRSTStream(uint32(streamID), http2.ErrCode(code))
+		})
+	}
+
+	return replay.RawFrame{}, fmt.Errorf("unknown command %q, try help", args[0])
+}
+
+// parseUint accepts decimal, 0x hex and 0 octal numbers.
+func parseUint(s string, bitSize int) (uint64, error) {
+	return strconv.ParseUint(s, 0, bitSize)
+}
@@ -0,0 +1,96 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"crypto/tls"
+	"errors"
+	"io"
+	"net"
+	"strings"
+	"syscall"
+
+	"github.com/c0nrad/http2fuzz/metrics"
+
+	"github.com/bradfitz/http2"
+)
+
+var (
+	framesSentMetric = metrics.NewCounterVec("http2fuzz_frames_sent_total",
+		"Frames sent by each fuzzing strategy.", "fuzzer", "strategy", "type")
+	connFramesMetric = metrics.NewCounterVec("http2fuzz_connection_frames_total",
+		"Frames written and read on every connection, the fuzzer's own SETTINGS and ACKs included.", "direction", "type")
+	connErrorsMetric = metrics.NewCounterVec("http2fuzz_connection_errors_total",
+		"Connections that failed, by cause.", "host", "cause")
+	goAwayMetric = metrics.NewCounterVec("http2fuzz_goaway_received_total",
+		"GOAWAY frames received, by error code.", "host", "code")
+	resetMetric = metrics.NewCounterVec("http2fuzz_rst_stream_received_total",
+		"RST_STREAM frames received, by error code.", "host", "code")
+	reconnectsMetric = metrics.NewCounterVec("http2fuzz_reconnects_total",
+		"Connections a fuzzer opened to replace a broken one.", "fuzzer")
+	crashesMetric = metrics.NewCounterVec("http2fuzz_crashes_total",
+		"Crashes of the -target-cmd target.")
+	negotiationMetric = metrics.NewCounterVec("http2fuzz_negotiation_cases_total",
+		"TLS negotiation cases run, by whether the handshake got through.", "case", "result")
+	probeMetric = metrics.NewHistogramVec("http2fuzz_probe_duration_seconds",
+		"How long liveness probes of the target took.",
+		[]float64{.005, .01, .025, .05, .1, .25, .5, 1, 2.5, 5, 10}, "host", "result")
+)
+
+func init() {
+	metrics.NewGaugeFunc("http2fuzz_fuzzers_live", "Fuzzers still running.", func() float64 {
+		live, _ := countFuzzers()
+		return float64(live)
+	})
+	metrics.NewGaugeFunc("http2fuzz_fuzzers_dead", "Fuzzers that gave up after too many failed restarts.", func() float64 {
+		_, dead := countFuzzers()
+		return float64(dead)
+	})
+}
+
+func countFuzzers() (live, dead int) {
+	for _, fuzzer := range Fuzzers() {
+		if fuzzer.Status().Alive {
+			live++
+		} else {
+			dead++
+		}
+	}
+	return live, dead
+}
+
+var errNoHTTP2 = errors.New("sever doesn't support http2")
+
+// errorCause sorts the error that broke conn into a few broad causes, for
+// labelling metrics.
+func (conn *Connection) errorCause(err error) string {
+	var netErr net.Error
+	var recordErr tls.RecordHeaderError
+	switch {
+	case conn.GoAway:
+		return "goaway"
+	case errors.Is(err, errNoHTTP2):
+		return "no_h2"
+	case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+		return "eof"
+	case errors.Is(err, syscall.ECONNRESET):
+		return "reset"
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return "refused"
+	case errors.Is(err, syscall.EPIPE):
+		return "broken_pipe"
+	case errors.Is(err, net.ErrClosed):
+		return "closed"
+	case errors.As(err, &recordErr), strings.Contains(err.Error(), "tls: "):
+		return "tls"
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return "timeout"
+	}
+	return "other"
+}
+
+func frameTypeLabel(t uint8) string {
+	return http2.FrameType(t).String()
+}
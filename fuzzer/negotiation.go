@@ -0,0 +1,328 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/tlsfuzz"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+// A NegotiationCase is one way of getting, or failing to get, from a TCP
+// connection to HTTP/2 over TLS.
+type NegotiationCase struct {
+	Name string
+	// Config adjusts the TLS config of the connection.
+	Config func(cfg *tls.Config)
+	// Rewrite, if set, rewrites our ClientHello, or ServerHello, on the wire.
+	Rewrite func(hello []byte) []byte
+	// Renegotiate asks for a second handshake once HTTP/2 is going.
+	Renegotiate bool
+	// EarlyData sends the preface and a request as TLS 1.3 0-RTT data.
+	EarlyData bool
+}
+
+// ClientNegotiationCases are run against -target by -tls-fuzz.
+var ClientNegotiationCases = []NegotiationCase{
+	{Name: "no-alpn", Config: nextProtos()},
+	{Name: "empty-alpn", Rewrite: setALPN(tlsfuzz.ALPN())},
+	{Name: "empty-protocol", Rewrite: setALPN(tlsfuzz.ALPN("", "h2"))},
+	{Name: "http1.1-only", Config: nextProtos("http/1.1")},
+	{Name: "long-protocols", Config: nextProtos(strings.Repeat("h", 255), strings.Repeat("2", 255), "h2")},
+	{Name: "oversized-protocol", Rewrite: setALPN(tlsfuzz.ALPN(strings.Repeat("h2", 150), "h2"))},
+	{Name: "huge-alpn", Rewrite: setALPN(hugeALPN())},
+	{Name: "truncated-alpn", Rewrite: setALPN([]byte{0, 10, 2, 'h', '2'})},
+	{Name: "blacklisted-cipher", Config: blacklistedCiphers},
+	{Name: "renegotiation", Config: gcmCiphers, Renegotiate: true},
+	{Name: "early-data", EarlyData: true},
+}
+
+// ServerNegotiationCases are played on clients in server mode by -tls-fuzz,
+// one picked at random for each connection.
+var ServerNegotiationCases = []NegotiationCase{
+	{Name: "no-alpn", Config: nextProtos()},
+	{Name: "http1.1-only", Config: nextProtos("http/1.1")},
+	{Name: "unoffered-protocol", Config: maxTLS12, Rewrite: unofferedProtocol},
+	{Name: "blacklisted-cipher", Config: blacklistedCiphers},
+	{Name: "renegotiation", Config: gcmCiphers, Renegotiate: true},
+}
+
+// unofferedProtocols are what a server picks that clients don't offer.
+var unofferedProtocols = []string{"h3", "h2c", "spdy/3.1", "http/2.0", "HTTP/1.1", "", strings.Repeat("h2", 127)}
+
+func nextProtos(protos ...string) func(*tls.Config) {
+	return func(cfg *tls.Config) { cfg.NextProtos = protos }
+}
+
+func maxTLS12(cfg *tls.Config) {
+	cfg.MaxVersion = tls.VersionTLS12
+}
+
+func blacklistedCiphers(cfg *tls.Config) {
+	cfg.MaxVersion = tls.VersionTLS12
+	cfg.CipherSuites = tlsfuzz.BlacklistedCipherSuites
+}
+
+func gcmCiphers(cfg *tls.Config) {
+	cfg.MaxVersion = tls.VersionTLS12
+	cfg.CipherSuites = tlsfuzz.GCMCipherSuites
+}
+
+func setALPN(body []byte) func([]byte) []byte {
+	return func(hello []byte) []byte {
+		if out, err := tlsfuzz.SetExtension(hello, tlsfuzz.ExtensionALPN, body); err == nil {
+			return out
+		}
+		return hello
+	}
+}
+
+// hugeALPN lists enough long protocols that the ClientHello spans several
+// records.
+func hugeALPN() []byte {
+	protos := make([]string, 240)
+	for i := range protos {
+		protos[i] = fmt.Sprintf("%03d", i) + strings.Repeat("x", 252)
+	}
+	return tlsfuzz.ALPN(append(protos, "h2")...)
+}
+
+func unofferedProtocol(hello []byte) []byte {
+	return setALPN(tlsfuzz.ALPN(unofferedProtocols[rand.Intn(len(unofferedProtocols))]))(hello)
+}
+
+// ParseNegotiationCases picks the cases spec names, separated by commas, or
+// all of them for "all".
+func ParseNegotiationCases(cases []NegotiationCase, spec string) ([]NegotiationCase, error) {
+	if spec == "all" {
+		return cases, nil
+	}
+	out := []NegotiationCase{}
+	for _, name := range strings.Split(spec, ",") {
+		found := false
+		for _, c := range cases {
+			if c.Name == strings.TrimSpace(name) {
+				out = append(out, c)
+				found = true
+			}
+		}
+		if !found {
+			return nil, fmt.Errorf("unknown negotiation case %q", name)
+		}
+	}
+	return out, nil
+}
+
+// NegotiationFuzzer runs the -tls-fuzz cases against config.Target, one
+// after another and over again. After each one it probes the target, to
+// catch the cases that took it down.
+func NegotiationFuzzer() error {
+	cases, err := ParseNegotiationCases(ClientNegotiationCases, config.TLSFuzz)
+	if err != nil {
+		return err
+	}
+	for i := 0; ; i++ {
+		if TargetSupervisor != nil {
+			TargetSupervisor.WaitReady()
+		}
+		c := cases[i%len(cases)]
+		RunNegotiationCase(config.Target, c)
+		if err := Probe(config.Target, true, ProbeTimeout); err != nil {
+			slog.Warn("Target stopped answering", "host", config.Target, "case", c.Name, "err", err)
+		}
+		time.Sleep(config.FuzzDelay)
+	}
+}
+
+// RunNegotiationCase connects to host the way c says, tries a request over
+// whatever was negotiated, and logs how far it got.
+func RunNegotiationCase(host string, c NegotiationCase) {
+	logger := slog.With("host", host, "case", c.Name)
+	cfg, err := clientTLSConfig(host)
+	if err != nil {
+		logger.Warn("Negotiation case failed", "err", err)
+		return
+	}
+	keys := &tlsfuzz.KeyLog{}
+	cfg.KeyLogWriter = keyLogWriter(keys, cfg.KeyLogWriter)
+	if c.Config != nil {
+		c.Config(cfg)
+	}
+
+	if c.EarlyData {
+		first, early := earlyData(host)
+		result, err := tlsfuzz.EarlyData(func() (net.Conn, error) { return dialTCP(host) }, cfg, first, early, ProbeTimeout)
+		if err != nil {
+			negotiationMetric.Inc(c.Name, "failed")
+			logger.Info("Negotiation case", "err", err)
+			return
+		}
+		negotiationMetric.Inc(c.Name, "connected")
+		logger.Info("Negotiation case", "resumed", result.Resumed, "early_data", result.Accepted, "alert", result.Alert)
+		return
+	}
+
+	raw, err := dialTCP(host)
+	if err != nil {
+		logger.Warn("Negotiation case failed", "err", err)
+		return
+	}
+	tap := tlsfuzz.NewTap(raw)
+	tap.Rewrite = c.Rewrite
+	tc := tls.Client(tap, cfg)
+	defer tc.Close()
+
+	tc.SetDeadline(time.Now().Add(ProbeTimeout))
+	if err := tc.Handshake(); err != nil {
+		negotiationMetric.Inc(c.Name, "failed")
+		logger.Info("Negotiation case", "err", err)
+		return
+	}
+	negotiationMetric.Inc(c.Name, "connected")
+
+	reply := "response"
+	if err := probeConn(tc, host, true, ProbeTimeout); err != nil {
+		reply = err.Error()
+	}
+	if c.Renegotiate {
+		if err := tlsfuzz.Renegotiate(tap, keys, true); err != nil {
+			reply += ", can't renegotiate: " + err.Error()
+		} else {
+			reply += ", then " + afterRenegotiation(tc)
+		}
+	}
+	logger.Info("Negotiation case", connectionState(tc, reply)...)
+}
+
+// serveNegotiation plays c on a client we accepted. Unless it renegotiates,
+// the connection is then fuzzed with bundle like any other.
+func serveNegotiation(raw net.Conn, c NegotiationCase, base *tls.Config, bundle Bundle) {
+	logger := slog.With("peer", raw.RemoteAddr(), "case", c.Name)
+	keys := &tlsfuzz.KeyLog{}
+	cfg := base.Clone()
+	cfg.KeyLogWriter = keyLogWriter(keys, cfg.KeyLogWriter)
+	if c.Config != nil {
+		c.Config(cfg)
+	}
+	tap := tlsfuzz.NewTap(raw)
+	tap.Rewrite = c.Rewrite
+	tc := tls.Server(tap, cfg)
+
+	tc.SetDeadline(time.Now().Add(ProbeTimeout))
+	if err := tc.Handshake(); err != nil {
+		negotiationMetric.Inc(c.Name, "failed")
+		logger.Info("Negotiation case", "err", err)
+		tc.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+	negotiationMetric.Inc(c.Name, "connected")
+
+	if !c.Renegotiate {
+		logger.Info("Negotiation case", connectionState(tc, "")...)
+		replay.TruncateFile()
+		FuzzConnection(tc, bundle)
+		return
+	}
+
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(ProbeTimeout))
+	preface := make([]byte, len(http2.ClientPreface))
+	if _, err := io.ReadFull(tc, preface); err != nil {
+		logger.Info("Negotiation case", connectionState(tc, err.Error())...)
+		return
+	}
+	framer := http2.NewFramer(tc, tc)
+	if err := framer.WriteSettings(); err != nil {
+		logger.Info("Negotiation case", connectionState(tc, err.Error())...)
+		return
+	}
+	if _, err := framer.ReadFrame(); err != nil {
+		logger.Info("Negotiation case", connectionState(tc, err.Error())...)
+		return
+	}
+	reply := "renegotiated"
+	if err := tlsfuzz.Renegotiate(tap, keys, false); err != nil {
+		reply = "can't renegotiate: " + err.Error()
+	} else {
+		reply = afterRenegotiation(tc)
+	}
+	logger.Info("Negotiation case", connectionState(tc, reply)...)
+}
+
+// afterRenegotiation reads what the peer sends after we asked to
+// renegotiate. Nothing can be written, our side of the tls.Conn is out of
+// step.
+func afterRenegotiation(conn net.Conn) string {
+	conn.SetReadDeadline(time.Now().Add(ProbeTimeout))
+	framer := http2.NewFramer(nil, conn)
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			return err.Error()
+		}
+		if f, ok := f.(*http2.GoAwayFrame); ok {
+			return "GOAWAY " + f.ErrCode.String()
+		}
+	}
+}
+
+func connectionState(tc *tls.Conn, reply string) []any {
+	state := tc.ConnectionState()
+	attrs := []any{
+		"proto", state.NegotiatedProtocol,
+		"version", tls.VersionName(state.Version),
+		"cipher", tls.CipherSuiteName(state.CipherSuite),
+	}
+	if reply != "" {
+		attrs = append(attrs, "reply", reply)
+	}
+	return attrs
+}
+
+func keyLogWriter(keys *tlsfuzz.KeyLog, w io.Writer) io.Writer {
+	if w == nil {
+		return keys
+	}
+	return io.MultiWriter(keys, w)
+}
+
+// earlyData returns what's written on the connection that gets the session
+// ticket, the preface and SETTINGS, and what's sent as early data on the
+// next: the same with a GET / behind them.
+func earlyData(host string) (first, early []byte) {
+	var buf bytes.Buffer
+	buf.WriteString(http2.ClientPreface)
+	framer := http2.NewFramer(&buf, nil)
+	framer.WriteSettings()
+	first = append([]byte{}, buf.Bytes()...)
+
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	henc.WriteField(hpack.HeaderField{Name: ":authority", Value: host})
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	henc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	henc.WriteField(hpack.HeaderField{Name: ":scheme", Value: "https"})
+	framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: hbuf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	return first, buf.Bytes()
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"errors"
+	"math/rand"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/logging"
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/util"
+
+	"github.com/bradfitz/http2"
+)
+
+// PrefaceWait is how long PrefaceFuzzer gives the peer to react to a
+// preface before hanging up and trying the next one.
+const PrefaceWait = time.Second
+
+var errHungUp = errors.New("hung up")
+
+// A PrefaceWrite is one write of a preface, made after Delay.
+type PrefaceWrite struct {
+	Delay time.Duration
+	Data  []byte
+}
+
+// nonSettingsGenerators make the frames sent where SETTINGS has to be.
+var nonSettingsGenerators = []FrameGenerator{
+	GeneratePingFrame,
+	GenerateHeadersFrame,
+	GenerateDataFrame,
+	GenerateWindowUpdateFrame,
+	GenerateResetFrame,
+	GeneratePriorityFrame,
+	GeneratePushPromiseFrame,
+	GenerateContinuationFrame,
+	func(r *rand.Rand) replay.RawFrame {
+		return replay.RawFrame{FrameType: uint8(http2.FrameGoAway), Payload: randomPayload(r, 64)}
+	},
+}
+
+// frameBytes serializes frame with its 9 byte header.
+func frameBytes(frame replay.RawFrame) []byte {
+	var buf bytes.Buffer
+	framer := http2.NewFramer(&buf, nil)
+	framer.AllowIllegalWrites = true
+	framer.WriteRawFrame(http2.FrameType(frame.FrameType), http2.Flags(frame.Flags), frame.StreamID, frame.Payload)
+	return buf.Bytes()
+}
+
+func nonSettingsFrame(r *rand.Rand) []byte {
+	return frameBytes(nonSettingsGenerators[r.Intn(len(nonSettingsGenerators))](r))
+}
+
+func settingsFrame() []byte {
+	return frameBytes(replay.RawFrame{FrameType: settingsFrameType})
+}
+
+// GenerateClientPreface mangles the client connection preface: it is
+// truncated, has bits flipped, is split over many writes, is repeated, or
+// is followed by something other than SETTINGS. kind names what was done.
+func GenerateClientPreface(r *rand.Rand) (kind string, writes []PrefaceWrite) {
+	preface := []byte(http2.ClientPreface)
+
+	switch r.Intn(5) {
+	case 0:
+		return "truncated", []PrefaceWrite{{Data: preface[:1+r.Intn(len(preface)-1)]}}
+	case 1:
+		for i := r.Intn(3) + 1; i > 0; i-- {
+			preface[r.Intn(len(preface))] ^= 1 << uint(r.Intn(8))
+		}
+		return "flipped", []PrefaceWrite{{Data: append(preface, settingsFrame()...)}}
+	case 2:
+		// A valid preface, a few bytes per write, so the peer has to put it
+		// back together.
+		for len(preface) > 0 {
+			n := 1 + r.Intn(4)
+			if n > len(preface) {
+				n = len(preface)
+			}
+			delay := time.Duration(r.Intn(200)) * time.Millisecond
+			writes = append(writes, PrefaceWrite{Delay: delay, Data: preface[:n]})
+			preface = preface[n:]
+		}
+		return "split", append(writes, PrefaceWrite{Data: settingsFrame()})
+	case 3:
+		data := bytes.Repeat(preface, r.Intn(3)+2)
+		return "repeated", []PrefaceWrite{{Data: append(data, settingsFrame()...)}}
+	default:
+		// The first frame has to be SETTINGS. Send it after the others.
+		data := preface
+		for i := r.Intn(3) + 1; i > 0; i-- {
+			data = append(data, nonSettingsFrame(r)...)
+		}
+		return "no-settings", []PrefaceWrite{{Data: append(data, settingsFrame()...)}}
+	}
+}
+
+// GenerateServerPreface makes the first bytes a server sends, which should
+// be a SETTINGS frame and here are not: another frame, a SETTINGS ACK, a
+// truncated SETTINGS frame, the client's preface echoed back, or garbage.
+// Sometimes the real SETTINGS follows.
+func GenerateServerPreface(r *rand.Rand) (kind string, data []byte) {
+	switch r.Intn(5) {
+	case 0:
+		kind, data = "frame", nonSettingsFrame(r)
+	case 1:
+		kind, data = "settings-ack", frameBytes(replay.RawFrame{FrameType: settingsFrameType, Flags: settingsFlagAck})
+	case 2:
+		settings := frameBytes(replay.RawFrame{FrameType: settingsFrameType, Payload: EncodeSettings(RandomBoundarySettings(r))})
+		return "truncated-settings", settings[:r.Intn(len(settings))]
+	case 3:
+		kind, data = "client-preface", []byte(http2.ClientPreface)
+	default:
+		kind, data = "garbage", randomPayload(r, 64)
+	}
+	if r.Intn(2) == 0 {
+		data = append(data, settingsFrame()...)
+	}
+	return kind, data
+}
+
+// writePreface makes writes on conn's socket, bypassing the framer. Each is
+// recorded and saved as raw data, so a replay sends the same bytes.
+func (conn *Connection) writePreface(writes []PrefaceWrite) error {
+	for _, w := range writes {
+		time.Sleep(w.Delay)
+		err := conn.write(func() error {
+			if _, err := conn.Raw.Write(w.Data); err != nil {
+				return err
+			}
+			conn.record(replay.LogEntry{Time: time.Now(), Frame: replay.RawFrame{Payload: w.Data, Raw: true}})
+			replay.SaveRawData(w.Data)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// hangUp closes conn from our side, unless it is closed already, without
+// counting it as an error, so the fuzzer starts over on a new connection.
+func (conn *Connection) hangUp() {
+	conn.handleError(errHungUp)
+}
+
+// PrefaceFuzzer sends mangled connection prefaces. Against a server it needs
+// a connection that was opened without a preface or SETTINGS, and uses a new
+// one for every preface. On a connection we accepted it sends the client
+// something other than SETTINGS first, once, and FuzzConnection runs it
+// before the rest of the bundle.
+func (fuzzer *Fuzzer) PrefaceFuzzer() {
+	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
+
+	if conn := fuzzer.Conn; conn.Requests != nil {
+		if conn.IsSendSettings {
+			conn.logger.Warn("PrefaceFuzzer is too late, SETTINGS went out already")
+		} else {
+			kind, data := GenerateServerPreface(r)
+			conn.logger.Debug("Sending server preface", "strategy", "PrefaceFuzzer", "kind", kind, "data", logging.Payload(data))
+			if conn.writePreface([]PrefaceWrite{{Data: data}}) == nil {
+				fuzzer.sent("PrefaceFuzzer", "PREFACE", 1)
+			}
+			// Catch up on the ACKs held back until now, unless another
+			// strategy is taking care of them.
+			if conn.IsAutoAck {
+				conn.SetAutoAck(true)
+				for i := conn.PeerSettingsPending(); i > 0; i-- {
+					conn.WriteSettingsAck()
+				}
+			}
+		}
+		fuzzer.stopped("PrefaceFuzzer")
+		return
+	}
+
+	for fuzzer.Alive {
+		fuzzer.Mu.Lock()
+		conn := fuzzer.Conn
+		fuzzer.Mu.Unlock()
+		if conn.IsPreface {
+			conn.logger.Warn("PrefaceFuzzer needs a connection without a preface")
+			fuzzer.kill()
+			break
+		}
+
+		kind, writes := GenerateClientPreface(r)
+		conn.logger.Debug("Sending preface", "strategy", "PrefaceFuzzer", "kind", kind, "writes", len(writes))
+		if conn.writePreface(writes) == nil {
+			fuzzer.sent("PrefaceFuzzer", "PREFACE", 1)
+		}
+
+		for start := time.Now(); conn.closeErr() == nil && time.Since(start) < PrefaceWait; {
+			time.Sleep(10 * time.Millisecond)
+		}
+		conn.hangUp()
+
+		if config.KeyboardDelay {
+			util.WaitForEnter()
+		} else {
+			time.Sleep(config.FuzzDelay)
+		}
+
+		fuzzer.CheckConnection()
+	}
+
+	fuzzer.stopped("PrefaceFuzzer")
+}
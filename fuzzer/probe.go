@@ -0,0 +1,119 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+// ProbeTimeout is how long ProbeLoop gives the target to answer.
+const ProbeTimeout = 5 * time.Second
+
+// Probe checks that host still serves HTTP/2 by opening a fresh connection
+// and waiting for the response headers of a GET /. How long it took is
+// recorded in the probe latency histogram.
+func Probe(host string, isTLS bool, timeout time.Duration) error {
+	start := time.Now()
+	err := probe(host, isTLS, timeout)
+	result := "ok"
+	if err != nil {
+		result = "error"
+	}
+	probeMetric.Observe(time.Since(start).Seconds(), host, result)
+	return err
+}
+
+// ProbeLoop probes config.Target every config.ProbeInterval while the
+// fuzzers run, logging the probes that fail.
+func ProbeLoop() {
+	for range time.Tick(config.ProbeInterval) {
+		if TargetSupervisor != nil {
+			TargetSupervisor.WaitReady()
+		}
+		start := time.Now()
+		if err := Probe(config.Target, config.IsTLS(), ProbeTimeout); err != nil {
+			slog.Warn("Liveness probe failed", "host", config.Target, "after", time.Since(start), "err", err)
+		}
+	}
+}
+
+func probe(host string, isTLS bool, timeout time.Duration) error {
+	raw, err := Dial(host, isTLS)
+	if err != nil {
+		return err
+	}
+	defer raw.Close()
+	return probeConn(raw, host, isTLS, timeout)
+}
+
+// probeConn sends the connection preface, SETTINGS and a GET / on raw, and
+// waits for the response headers.
+func probeConn(raw net.Conn, host string, isTLS bool, timeout time.Duration) error {
+	raw.SetDeadline(time.Now().Add(timeout))
+
+	if _, err := io.WriteString(raw, http2.ClientPreface); err != nil {
+		return err
+	}
+	framer := http2.NewFramer(raw, raw)
+	if err := framer.WriteSettings(); err != nil {
+		return err
+	}
+
+	scheme := "http"
+	if isTLS {
+		scheme = "https"
+	}
+	var hbuf bytes.Buffer
+	henc := hpack.NewEncoder(&hbuf)
+	henc.WriteField(hpack.HeaderField{Name: ":authority", Value: host})
+	henc.WriteField(hpack.HeaderField{Name: ":method", Value: "GET"})
+	henc.WriteField(hpack.HeaderField{Name: ":path", Value: "/"})
+	henc.WriteField(hpack.HeaderField{Name: ":scheme", Value: scheme})
+
+	err := framer.WriteHeaders(http2.HeadersFrameParam{
+		StreamID:      1,
+		BlockFragment: hbuf.Bytes(),
+		EndStream:     true,
+		EndHeaders:    true,
+	})
+	if err != nil {
+		return err
+	}
+
+	for {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			return err
+		}
+		switch f := f.(type) {
+		case *http2.SettingsFrame:
+			if !f.IsAck() {
+				if err := framer.WriteSettingsAck(); err != nil {
+					return err
+				}
+			}
+		case *http2.HeadersFrame:
+			if f.StreamID == 1 {
+				return nil
+			}
+		case *http2.RSTStreamFrame:
+			if f.StreamID == 1 {
+				return fmt.Errorf("probe stream reset: %v", f.ErrCode)
+			}
+		case *http2.GoAwayFrame:
+			return fmt.Errorf("probe got GOAWAY: %v", f.ErrCode)
+		}
+	}
+}
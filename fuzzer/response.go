@@ -0,0 +1,278 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/util"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	frameContinuation = 0x9
+
+	flagEndStream  = 0x1
+	flagEndHeaders = 0x4
+	flagPadded     = 0x8
+
+	// maxResponseFrame keeps DATA frames and header block fragments under
+	// the default SETTINGS_MAX_FRAME_SIZE.
+	maxResponseFrame = 16384
+)
+
+// A Request is a HEADERS frame the client sent, with its decoded fields.
+type Request struct {
+	StreamID  uint32
+	Headers   []replay.HeaderField
+	EndStream bool
+}
+
+// Header returns the value of the named field, or "" if req doesn't have it.
+func (req Request) Header(name string) string {
+	for _, f := range req.Headers {
+		if f.Name == name {
+			return f.Value
+		}
+	}
+	return ""
+}
+
+// malformedStatuses are :status values no client should accept.
+var malformedStatuses = []string{"", "0", "99", "600", "999", "2000", "20x", " 200", "200 OK", "-200", "0x0c8"}
+
+// imageMagic starts bodies of the image types browsers sniff, so they get as
+// far as the decoder.
+var imageMagic = map[string][]byte{
+	"image/gif":  []byte("GIF89a"),
+	"image/png":  []byte("\x89PNG\r\n\x1a\n"),
+	"image/jpeg": []byte("\xff\xd8\xff\xe0"),
+	"image/bmp":  []byte("BM"),
+	"image/tiff": []byte("II*\x00"),
+}
+
+func randomStatus(r *rand.Rand) string {
+	if r.Intn(8) == 0 {
+		return malformedStatuses[r.Intn(len(malformedStatuses))]
+	}
+	return util.HTTPStatusCodes[r.Intn(len(util.HTTPStatusCodes))]
+}
+
+// randomResponseHeaders picks response headers with random values. Now and
+// then a name keeps its upper case, which HTTP/2 forbids.
+func randomResponseHeaders(r *rand.Rand, max int) []hpack.HeaderField {
+	fields := []hpack.HeaderField{}
+	for i := r.Intn(max + 1); i > 0; i-- {
+		name := util.HTTPResponseHeaders[r.Intn(len(util.HTTPResponseHeaders))]
+		if r.Intn(25) != 0 {
+			name = strings.ToLower(name)
+		}
+		fields = append(fields, hpack.HeaderField{Name: name, Value: util.HTTPHeaderValues[r.Intn(len(util.HTTPHeaderValues))]})
+	}
+	return fields
+}
+
+// GenerateResponse builds the frames of a fuzzed response to req: a random
+// status, headers and content-type, a body framed one of several ways, and
+// sometimes an informational response first or trailers after. The header
+// blocks are encoded with enc, which writes into buf. It has to be the
+// connection's own encoder, so the client's HPACK table stays in step and
+// the responses get past header decoding.
+func GenerateResponse(r *rand.Rand, req Request, enc *hpack.Encoder, buf *bytes.Buffer) []replay.RawFrame {
+	frames := []replay.RawFrame{}
+	streamID := req.StreamID
+
+	if r.Intn(10) == 0 {
+		info := []hpack.HeaderField{{Name: ":status", Value: []string{"100", "102", "103"}[r.Intn(3)]}}
+		if r.Intn(2) == 0 {
+			info = append(info, hpack.HeaderField{Name: "link", Value: "</style.css>; rel=preload; as=style"})
+		}
+		frames = append(frames, headerFrames(r, streamID, encodeFields(enc, buf, info), false)...)
+	}
+
+	contentType := ""
+	if r.Intn(10) < 7 {
+		contentType = util.HTTPImageTypes[r.Intn(len(util.HTTPImageTypes))]
+	}
+	body := append([]byte{}, imageMagic[contentType]...)
+	body = append(body, randomPayload(r, 1+r.Intn(32<<10))...)
+	if req.Header(":method") == "HEAD" || r.Intn(6) == 0 {
+		body = nil
+	}
+
+	fields := []hpack.HeaderField{{Name: ":status", Value: randomStatus(r)}}
+	if r.Intn(20) == 0 {
+		fields = append(fields, hpack.HeaderField{Name: ":status", Value: randomStatus(r)})
+	}
+	if contentType != "" {
+		fields = append(fields, hpack.HeaderField{Name: "content-type", Value: contentType})
+	}
+	switch r.Intn(5) {
+	case 0, 1, 2:
+		fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body))})
+	case 3:
+		// Doesn't match the body.
+		fields = append(fields, hpack.HeaderField{Name: "content-length", Value: strconv.Itoa(len(body) + r.Intn(2000) - 1000)})
+	}
+	fields = append(fields, randomResponseHeaders(r, 6)...)
+	if r.Intn(20) == 0 {
+		// A pseudo-header after a regular one.
+		fields = append(fields, hpack.HeaderField{Name: ":status", Value: "200"})
+	}
+
+	withTrailers := r.Intn(8) == 0
+	endStream := len(body) == 0 && !withTrailers
+	frames = append(frames, headerFrames(r, streamID, encodeFields(enc, buf, fields), endStream)...)
+
+	if len(body) > 0 {
+		frames = append(frames, dataFrames(r, streamID, body, !withTrailers)...)
+	}
+	if withTrailers {
+		trailers := randomResponseHeaders(r, 3)
+		if r.Intn(4) == 0 {
+			trailers = append(trailers, hpack.HeaderField{Name: ":status", Value: randomStatus(r)})
+		}
+		frames = append(frames, headerFrames(r, streamID, encodeFields(enc, buf, trailers), true)...)
+	}
+
+	// Now and then leave the stream open.
+	if r.Intn(15) == 0 {
+		for i := range frames {
+			frames[i].Flags &^= flagEndStream
+		}
+	}
+	return frames
+}
+
+func encodeFields(enc *hpack.Encoder, buf *bytes.Buffer, fields []hpack.HeaderField) []byte {
+	buf.Reset()
+	for _, f := range fields {
+		enc.WriteField(f)
+	}
+	return append([]byte{}, buf.Bytes()...)
+}
+
+// headerFrames sends block in a HEADERS frame, or sometimes splits it over
+// CONTINUATION frames.
+func headerFrames(r *rand.Rand, streamID uint32, block []byte, endStream bool) []replay.RawFrame {
+	first := replay.RawFrame{FrameType: frameHeaders, StreamID: streamID}
+	if endStream {
+		first.Flags |= flagEndStream
+	}
+	if len(block) <= maxResponseFrame && (len(block) < 2 || r.Intn(5) != 0) {
+		first.Flags |= flagEndHeaders
+		first.Payload = block
+		return []replay.RawFrame{first}
+	}
+
+	size := maxResponseFrame
+	if len(block) <= maxResponseFrame {
+		size = 1 + r.Intn(len(block)-1)
+	}
+	first.Payload = block[:size]
+	frames := []replay.RawFrame{first}
+	for rest := block[size:]; len(rest) > 0; {
+		n := size
+		if n > len(rest) {
+			n = len(rest)
+		}
+		frame := replay.RawFrame{FrameType: frameContinuation, StreamID: streamID, Payload: rest[:n]}
+		if rest = rest[n:]; len(rest) == 0 {
+			frame.Flags = flagEndHeaders
+		}
+		frames = append(frames, frame)
+	}
+	return frames
+}
+
+// dataFrames frames body as one DATA frame, several, padded ones, or with
+// empty frames mixed in.
+func dataFrames(r *rand.Rand, streamID uint32, body []byte, endStream bool) []replay.RawFrame {
+	chunk := maxResponseFrame
+	if r.Intn(2) == 0 {
+		chunk = 1 + r.Intn(4096)
+	}
+	padded := r.Intn(4) == 0
+	empties := r.Intn(4) == 0
+
+	frames := []replay.RawFrame{}
+	for len(body) > 0 {
+		n := chunk
+		if padded {
+			n = chunk - 256
+			if n < 1 {
+				n = 1
+			}
+		}
+		if n > len(body) {
+			n = len(body)
+		}
+		frame := replay.RawFrame{FrameType: frameData, StreamID: streamID, Payload: body[:n]}
+		if padded {
+			pad := r.Intn(256)
+			frame.Flags |= flagPadded
+			frame.Payload = append(append([]byte{byte(pad)}, body[:n]...), make([]byte, pad)...)
+		}
+		frames = append(frames, frame)
+		if empties && r.Intn(3) == 0 {
+			frames = append(frames, replay.RawFrame{FrameType: frameData, StreamID: streamID})
+		}
+		body = body[n:]
+	}
+	if endStream {
+		if empties {
+			frames = append(frames, replay.RawFrame{FrameType: frameData, StreamID: streamID})
+		}
+		frames[len(frames)-1].Flags |= flagEndStream
+	}
+	return frames
+}
+
+// ResponseFuzzer answers every request the client makes with a fuzzed
+// response from GenerateResponse, as soon as it arrives. It needs a
+// connection we accepted.
+func (fuzzer *Fuzzer) ResponseFuzzer() {
+	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
+
+	for fuzzer.Alive {
+		fuzzer.Mu.Lock()
+		conn := fuzzer.Conn
+		fuzzer.Mu.Unlock()
+		if conn.Requests == nil {
+			conn.logger.Warn("ResponseFuzzer only runs on server connections")
+			fuzzer.kill()
+			break
+		}
+		req, ok := <-conn.Requests
+		if !ok {
+			// readFrames gave up on the connection.
+			fuzzer.CheckConnection()
+			continue
+		}
+
+		fuzzer.Mu.Lock()
+		frames := GenerateResponse(r, req, conn.HEnc, &conn.HBuf)
+		conn.logger.Debug("Responding", "strategy", "ResponseFuzzer", "stream", req.StreamID,
+			"method", req.Header(":method"), "path", req.Header(":path"), "frames", len(frames))
+		for _, frame := range frames {
+			if conn.WriteRawFrame(frame.FrameType, frame.Flags, frame.StreamID, frame.Payload) != nil {
+				break
+			}
+			fuzzer.sent("ResponseFuzzer", http2.FrameType(frame.FrameType).String(), 1)
+		}
+		fuzzer.Mu.Unlock()
+		fuzzer.CheckConnection()
+	}
+	fuzzer.stopped("ResponseFuzzer")
+}
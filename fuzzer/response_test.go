@@ -0,0 +1,171 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"math/rand"
+	"testing"
+
+	"github.com/c0nrad/http2fuzz/replay"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+// eachFrame parses frames the way a client would, and calls fn with each.
+// The frame is only good until fn returns.
+func eachFrame(t *testing.T, frames []replay.RawFrame, fn func(i int, f http2.Frame)) {
+	t.Helper()
+	var buf bytes.Buffer
+	for _, frame := range frames {
+		if len(frame.Payload) > maxResponseFrame {
+			t.Fatalf("%d byte frame is over the default SETTINGS_MAX_FRAME_SIZE", len(frame.Payload))
+		}
+		buf.Write(frame.Bytes())
+	}
+	framer := http2.NewFramer(nil, &buf)
+	for i := range frames {
+		f, err := framer.ReadFrame()
+		if err != nil {
+			t.Fatalf("frame %d: %v", i, err)
+		}
+		fn(i, f)
+	}
+}
+
+func TestHeaderFrames(t *testing.T) {
+	for _, size := range []int{0, 1, 2, 100, maxResponseFrame - 1, maxResponseFrame, maxResponseFrame + 1, 3*maxResponseFrame + 7} {
+		for seed := int64(0); seed < 20; seed++ {
+			r := rand.New(rand.NewSource(seed))
+			block := randomPayload(r, size+1)
+			for len(block) < size {
+				block = append(block, byte(len(block)))
+			}
+			endStream := seed%2 == 0
+			frames := headerFrames(r, 3, block, endStream)
+
+			var got []byte
+			eachFrame(t, frames, func(i int, f http2.Frame) {
+				if f.Header().StreamID != 3 {
+					t.Fatalf("size %d seed %d: frame %d on stream %d", size, seed, i, f.Header().StreamID)
+				}
+				last := i == len(frames)-1
+				switch f := f.(type) {
+				case *http2.HeadersFrame:
+					if i != 0 {
+						t.Fatalf("size %d seed %d: HEADERS at %d", size, seed, i)
+					}
+					if f.StreamEnded() != endStream {
+						t.Errorf("size %d seed %d: END_STREAM %v, want %v", size, seed, f.StreamEnded(), endStream)
+					}
+					if f.HeadersEnded() != last {
+						t.Errorf("size %d seed %d: END_HEADERS %v on the first of %d frames", size, seed, f.HeadersEnded(), len(frames))
+					}
+					got = append(got, f.HeaderBlockFragment()...)
+				case *http2.ContinuationFrame:
+					if f.HeadersEnded() != last {
+						t.Errorf("size %d seed %d: END_HEADERS %v on frame %d of %d", size, seed, f.HeadersEnded(), i, len(frames))
+					}
+					got = append(got, f.HeaderBlockFragment()...)
+				default:
+					t.Fatalf("size %d seed %d: unexpected %v", size, seed, f.Header().Type)
+				}
+			})
+			if !bytes.Equal(got, block) {
+				t.Errorf("size %d seed %d: fragments don't add up to the block", size, seed)
+			}
+		}
+	}
+}
+
+func TestDataFrames(t *testing.T) {
+	for _, size := range []int{1, 2, 255, 256, 257, 4096, maxResponseFrame, maxResponseFrame + 1, 40000} {
+		for seed := int64(0); seed < 40; seed++ {
+			r := rand.New(rand.NewSource(seed))
+			body := bytes.Repeat([]byte{byte(seed)}, size)
+			endStream := seed%2 == 0
+			frames := dataFrames(r, 5, body, endStream)
+
+			var got []byte
+			eachFrame(t, frames, func(i int, f http2.Frame) {
+				data, ok := f.(*http2.DataFrame)
+				if !ok {
+					t.Fatalf("size %d seed %d: unexpected %v", size, seed, f.Header().Type)
+				}
+				if data.StreamID != 5 {
+					t.Fatalf("size %d seed %d: frame %d on stream %d", size, seed, i, data.StreamID)
+				}
+				if want := endStream && i == len(frames)-1; data.StreamEnded() != want {
+					t.Errorf("size %d seed %d: END_STREAM %v on frame %d of %d", size, seed, data.StreamEnded(), i, len(frames))
+				}
+				got = append(got, data.Data()...)
+			})
+			if !bytes.Equal(got, body) {
+				t.Errorf("size %d seed %d: got %d bytes of body, want %d", size, seed, len(got), len(body))
+			}
+		}
+	}
+}
+
+func TestGenerateResponse(t *testing.T) {
+	var buf bytes.Buffer
+	enc := hpack.NewEncoder(&buf)
+	var fields []hpack.HeaderField
+	dec := hpack.NewDecoder(4096, func(f hpack.HeaderField) { fields = append(fields, f) })
+
+	for seed := int64(0); seed < 500; seed++ {
+		r := rand.New(rand.NewSource(seed))
+		method := "GET"
+		if seed%5 == 0 {
+			method = "HEAD"
+		}
+		req := Request{StreamID: uint32(2*seed + 1), Headers: []replay.HeaderField{{Name: ":method", Value: method}}}
+		frames := GenerateResponse(r, req, enc, &buf)
+
+		// Every block has to decode with a decoder that saw the ones
+		// before it, or the client's table would be out of step.
+		blocks := [][]hpack.HeaderField{}
+		var block []byte
+		closed := false
+		eachFrame(t, frames, func(i int, f http2.Frame) {
+			if f.Header().StreamID != req.StreamID {
+				t.Fatalf("seed %d: frame %d on stream %d", seed, i, f.Header().StreamID)
+			}
+			// CONTINUATION frames may follow END_STREAM, nothing else.
+			if closed && f.Header().Type != http2.FrameContinuation {
+				t.Errorf("seed %d: %v at %d after END_STREAM", seed, f.Header().Type, i)
+			}
+			ended := false
+			switch f := f.(type) {
+			case *http2.HeadersFrame:
+				closed = f.StreamEnded()
+				block, ended = append(block[:0], f.HeaderBlockFragment()...), f.HeadersEnded()
+			case *http2.ContinuationFrame:
+				block, ended = append(block, f.HeaderBlockFragment()...), f.HeadersEnded()
+			case *http2.DataFrame:
+				closed = f.StreamEnded()
+				if method == "HEAD" {
+					t.Errorf("seed %d: DATA in response to HEAD", seed)
+				}
+			}
+			if !ended {
+				return
+			}
+			fields = nil
+			if _, err := dec.Write(block); err != nil {
+				t.Fatalf("seed %d: decoding block %d: %v", seed, len(blocks), err)
+			}
+			if err := dec.Close(); err != nil {
+				t.Fatalf("seed %d: decoding block %d: %v", seed, len(blocks), err)
+			}
+			blocks = append(blocks, fields)
+		})
+
+		if len(blocks) == 0 || len(blocks[0]) == 0 || blocks[0][0].Name != ":status" {
+			t.Fatalf("seed %d: response doesn't start with :status: %v", seed, blocks)
+		}
+	}
+}
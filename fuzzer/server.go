@@ -6,101 +6,143 @@ package fuzzer
 
 import (
 	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"io"
+	"log/slog"
+	"math/rand"
 	"net"
+	"time"
 
+	"github.com/c0nrad/http2fuzz/capture"
+	"github.com/c0nrad/http2fuzz/certs"
 	"github.com/c0nrad/http2fuzz/config"
 	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/transport"
 )
 
-func FuzzConnection(conn net.Conn) {
+// FuzzConnection runs the strategies of bundle on a connection we accepted.
+func FuzzConnection(conn net.Conn, bundle Bundle) {
 	restartFuzzer := false
 	isTLS := true
-	choice := 2 //rand.Intn(9)
 
-	// time.Sleep(time.Millisecond * 1000)
-	switch choice {
-	case -1:
-		fuzzer := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer.PingFuzzer()
-	case 0:
-		fuzzer := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer.PingFuzzer()
-		go fuzzer.DataFuzzer()
-		go fuzzer.HeaderFuzzer()
-	case 1:
-		fuzzer := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer.RawFrameFuzzer()
-	case 2:
-		fuzzer2 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer2.PriorityFuzzer()
-		go fuzzer2.PingFuzzer()
-		go fuzzer2.HeaderFuzzer()
-	case 3:
-		fuzzer3 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer3.PriorityFuzzer()
-		go fuzzer3.PingFuzzer()
-		go fuzzer3.HeaderFuzzer()
-		go fuzzer3.WindowUpdateFuzzer()
-	case 4:
-		fuzzer4 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer4.PriorityFuzzer()
-		go fuzzer4.PingFuzzer()
-		go fuzzer4.HeaderFuzzer()
-		go fuzzer4.ResetFuzzer()
-	case 5:
-		fuzzer5 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer5.SettingsFuzzer()
-		go fuzzer5.HeaderFuzzer()
-	case 6:
-		fuzzer6 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer6.DataFuzzer()
-		go fuzzer6.HeaderFuzzer()
-	case 7:
-		fuzzer7 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer7.ContinuationFuzzer()
-		go fuzzer7.HeaderFuzzer()
-	case 8:
-		fuzzer8 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer8.PushPromiseFuzzer()
-		go fuzzer8.HeaderFuzzer()
-	case 9:
-		fuzzer9 := NewFuzzer(NewServerConnection(conn, isTLS), restartFuzzer)
-		go fuzzer9.RawTCPFuzzer()
+	// PrefaceFuzzer sends something else in place of our SETTINGS, so it
+	// has to go before the other strategies. SettingsAckFuzzer ACKs the
+	// client's SETTINGS itself.
+	sendSettings, autoAck := true, true
+	for _, name := range bundle.Strategies {
+		switch name {
+		case "PrefaceFuzzer":
+			sendSettings = false
+		case "SettingsAckFuzzer":
+			autoAck = false
+		}
+	}
+
+	conn = wrapTransport(conn)
+	fuzzer := NewFuzzer(NewServerConnection(conn, isTLS, sendSettings, autoAck), restartFuzzer)
+	fuzzer.Conn.logger.Info("Running bundle", "bundle", bundle.Name, "strategies", bundle.Strategies)
+	if !sendSettings {
+		fuzzer.PrefaceFuzzer()
+	}
+	for _, name := range bundle.Strategies {
+		if name != "PrefaceFuzzer" {
+			go Strategies[name](fuzzer)
+		}
 	}
 }
 
-func Server() {
-	host := config.Interface + ":" + config.Port
-	cert, err := tls.LoadX509KeyPair("./certs/localhost1437319773023.pem", "./certs/localhost1437319773023.key")
+// serverCertificate loads the certificate from config.CertFile and
+// config.KeyFile, or generates one for config.CertHosts the way
+// config.CertMode says.
+func serverCertificate() (func(*tls.ClientHelloInfo) (*tls.Certificate, error), error) {
+	if config.CertFile == "" && config.KeyFile == "" {
+		return certs.GetCertificate(config.CertMode, config.CertHosts)
+	}
+	if config.CertFile == "" || config.KeyFile == "" {
+		return nil, errors.New("-cert and -key go together")
+	}
+	cert, err := tls.LoadX509KeyPair(config.CertFile, config.KeyFile)
 	if err != nil {
-		panic(err)
+		return nil, err
 	}
-	config := tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2", "h2-14"}}
-	listener, err := tls.Listen("tcp", host, &config)
-	fmt.Println("Listening on https://" + host)
-	fmt.Println("setInterval(function() { $.get('https://" + host + "') }, 750)")
+	return func(*tls.ClientHelloInfo) (*tls.Certificate, error) { return &cert, nil }, nil
+}
+
+// acceptBackoff is how long Server waits after a temporary Accept error,
+// like running out of file descriptors, before accepting again.
+const acceptBackoff = 100 * time.Millisecond
 
+// Server listens for clients to fuzz, and picks a bundle of strategies for
+// each connection as config.ServerBundle or config.CampaignFile say.
+func Server() error {
+	picker, err := NewBundlePicker(config.ServerBundle, config.CampaignFile)
 	if err != nil {
-		panic(err)
+		return err
 	}
 
-	for {
-		conn, err := listener.Accept()
+	getCertificate, err := serverCertificate()
+	if err != nil {
+		return err
+	}
+	var negotiationCases []NegotiationCase
+	if config.TLSFuzz != "" {
+		if negotiationCases, err = ParseNegotiationCases(ServerNegotiationCases, config.TLSFuzz); err != nil {
+			return err
+		}
+	}
 
-		if err != nil {
-			panic(err)
+	host := config.Interface + ":" + config.Port
+	tcpListener, err := net.Listen("tcp", host)
+	if err != nil {
+		return err
+	}
+	defer tcpListener.Close()
+	tcpListener = transport.Listener{Listener: tcpListener, NoDelay: config.NoDelay}
+	var keyLog io.Writer
+	if config.PcapDir != "" {
+		tcpListener = capture.Listener{Listener: tcpListener, Dir: config.PcapDir}
+		if keyLog, err = capture.KeyLogWriter(config.PcapDir); err != nil {
+			return err
 		}
-		proto := conn.(*tls.Conn).ConnectionState().NegotiatedProtocol
-		log.Println("Negotiated proto", proto)
+	}
 
+	config := tls.Config{GetCertificate: getCertificate, NextProtos: []string{"h2", "h2-14"}, KeyLogWriter: keyLog}
+	fmt.Println("Listening on https://" + host)
+	fmt.Println("setInterval(function() { $.get('https://" + host + "') }, 750)")
+
+	for {
+		conn, err := tcpListener.Accept()
+		var netErr net.Error
+		if errors.As(err, &netErr) && netErr.Temporary() {
+			slog.Warn("Accept failed", "err", err)
+			time.Sleep(acceptBackoff)
+			continue
+		}
 		if err != nil {
-			log.Printf("server: accept: %s", err)
-			break
+			return err
+		}
+		// Negotiation cases do their own handshakes.
+		if negotiationCases != nil {
+			c := negotiationCases[rand.Intn(len(negotiationCases))]
+			go serveNegotiation(conn, c, &config, picker.Next())
+		} else {
+			go serveTLS(conn, &config, picker.Next())
 		}
-		log.Printf("server: accepted from %s", conn.RemoteAddr())
-		replay.TruncateFile()
-		FuzzConnection(conn)
 	}
 }
+
+// serveTLS finishes the handshake on a connection we accepted and fuzzes it.
+func serveTLS(raw net.Conn, cfg *tls.Config, bundle Bundle) {
+	tc := tls.Server(raw, cfg)
+	tc.SetDeadline(time.Now().Add(ProbeTimeout))
+	if err := tc.Handshake(); err != nil {
+		slog.Info("Handshake failed", "peer", raw.RemoteAddr(), "err", err)
+		tc.Close()
+		return
+	}
+	tc.SetDeadline(time.Time{})
+	slog.Info("Accepted", "peer", raw.RemoteAddr(), "proto", tc.ConnectionState().NegotiatedProtocol)
+	replay.TruncateFile()
+	FuzzConnection(tc, bundle)
+}
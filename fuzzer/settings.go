@@ -0,0 +1,199 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+
+	"github.com/bradfitz/http2"
+)
+
+const (
+	settingsFrameType = 0x4
+	settingsFlagAck   = 0x1
+)
+
+// SettingsAckTimeout is how long SettingsAckFuzzer lets our SETTINGS go
+// unacknowledged before it reports the peer.
+const SettingsAckTimeout = 5 * time.Second
+
+// SettingEnableConnectProtocol lets clients use extended CONNECT (RFC 8441
+// section 3).
+const SettingEnableConnectProtocol http2.SettingID = 0x8
+
+// SettingIDs are the settings defined by RFC 7540 section 6.5.2.
+var SettingIDs = []http2.SettingID{
+	http2.SettingHeaderTableSize,
+	http2.SettingEnablePush,
+	http2.SettingMaxConcurrentStreams,
+	http2.SettingInitialWindowSize,
+	http2.SettingMaxFrameSize,
+	http2.SettingMaxHeaderListSize,
+}
+
+// settingNames names the settings http2.SettingID doesn't know.
+var settingNames = map[http2.SettingID]string{
+	SettingEnableConnectProtocol: "ENABLE_CONNECT_PROTOCOL",
+}
+
+func settingName(id http2.SettingID) string {
+	if name, ok := settingNames[id]; ok {
+		return name
+	}
+	return id.String()
+}
+
+// SettingBoundaries holds the interesting values for each known setting:
+// the edges of the legal range and the first values past them.
+var SettingBoundaries = map[http2.SettingID][]uint32{
+	http2.SettingHeaderTableSize:      {0, 1, 4096, 1<<16 - 1, 1 << 31, 1<<32 - 1},
+	http2.SettingEnablePush:           {0, 1, 2, 1<<32 - 1},
+	http2.SettingMaxConcurrentStreams: {0, 1, 100, 1<<31 - 1, 1<<32 - 1},
+	http2.SettingInitialWindowSize:    {0, 1, 65535, 1<<31 - 1, 1 << 31, 1<<32 - 1},
+	http2.SettingMaxFrameSize:         {0, 1, 16383, 16384, 1<<24 - 1, 1 << 24, 1<<32 - 1},
+	http2.SettingMaxHeaderListSize:    {0, 1, 1<<31 - 1, 1<<32 - 1},
+}
+
+func randomSettingID(r *rand.Rand) http2.SettingID {
+	return SettingIDs[r.Intn(len(SettingIDs))]
+}
+
+// randomUnknownSettingID returns an id outside of the ones defined by RFC 7540,
+// including the reserved id 0.
+func randomUnknownSettingID(r *rand.Rand) http2.SettingID {
+	for {
+		id := http2.SettingID(r.Intn(0x10000))
+		if _, ok := SettingBoundaries[id]; !ok {
+			return id
+		}
+	}
+}
+
+func randomBoundarySetting(r *rand.Rand) http2.Setting {
+	id := randomSettingID(r)
+	values := SettingBoundaries[id]
+	return http2.Setting{ID: id, Val: values[r.Intn(len(values))]}
+}
+
+// RandomBoundarySettings builds the settings list for one SETTINGS frame. It
+// mixes boundary values, unknown ids and duplicated ids.
+func RandomBoundarySettings(r *rand.Rand) []http2.Setting {
+	settings := []http2.Setting{}
+	numberSettings := r.Intn(8)
+	for i := 0; i < numberSettings; i++ {
+		switch r.Intn(4) {
+		case 0:
+			settings = append(settings, http2.Setting{ID: randomUnknownSettingID(r), Val: r.Uint32()})
+		case 1:
+			if len(settings) > 0 {
+				duplicate := settings[r.Intn(len(settings))]
+				duplicate.Val = randomBoundarySetting(r).Val
+				settings = append(settings, duplicate)
+				continue
+			}
+			fallthrough
+		default:
+			settings = append(settings, randomBoundarySetting(r))
+		}
+	}
+	return settings
+}
+
+// EncodeSettings serializes settings into a SETTINGS frame payload without
+// validating them.
+func EncodeSettings(settings []http2.Setting) []byte {
+	payload := make([]byte, 6*len(settings))
+	for i, s := range settings {
+		binary.BigEndian.PutUint16(payload[i*6:], uint16(s.ID))
+		binary.BigEndian.PutUint32(payload[i*6+2:], s.Val)
+	}
+	return payload
+}
+
+// DecodeSettings is the inverse of EncodeSettings. A trailing partial setting
+// is dropped.
+func DecodeSettings(payload []byte) []http2.Setting {
+	settings := []http2.Setting{}
+	for i := 0; i+6 <= len(payload); i += 6 {
+		settings = append(settings, http2.Setting{
+			ID:  http2.SettingID(binary.BigEndian.Uint16(payload[i:])),
+			Val: binary.BigEndian.Uint32(payload[i+2:]),
+		})
+	}
+	return settings
+}
+
+// GenerateSettingsBoundaryFrame builds a SETTINGS frame from
+// RandomBoundarySettings. One in five carries the ACK flag along with a
+// payload, which an ACK must not have.
+func GenerateSettingsBoundaryFrame(r *rand.Rand) replay.RawFrame {
+	settings := RandomBoundarySettings(r)
+	if r.Intn(5) == 0 {
+		if len(settings) == 0 {
+			settings = append(settings, randomBoundarySetting(r))
+		}
+		return replay.RawFrame{FrameType: settingsFrameType, Flags: settingsFlagAck, Payload: EncodeSettings(settings)}
+	}
+	return replay.RawFrame{FrameType: settingsFrameType, Payload: EncodeSettings(settings)}
+}
+
+func (fuzzer *Fuzzer) SettingsBoundaryFuzzer() {
+	fuzzer.generatorFuzzer("SettingsBoundaryFuzzer", GenerateSettingsBoundaryFrame, true)
+}
+
+// SettingsAckFuzzer withholds ACKs, sends duplicate ACKs, or ACKs settings
+// the peer never sent, to exercise the peer's SETTINGS_TIMEOUT handling. It
+// wants a connection opened without auto-ACK, so that the peer's first
+// SETTINGS is left to it as well.
+func (fuzzer *Fuzzer) SettingsAckFuzzer() {
+	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
+
+	for fuzzer.Alive {
+		fuzzer.Mu.Lock()
+		conn := fuzzer.Conn
+		if conn.IsAutoAck {
+			// Too late for the first SETTINGS, but not for the ones after.
+			conn.SetAutoAck(false)
+		}
+		sent := conn.Counters().FramesSent
+
+		switch r.Intn(4) {
+		case 0:
+			// Withhold: send our own settings and leave the peer's unacknowledged.
+			conn.WriteSettingsFrame([]http2.Setting{randomBoundarySetting(r)})
+		case 1:
+			// Duplicate ACKs.
+			for i := r.Intn(4) + 2; i > 0; i-- {
+				conn.WriteSettingsAck()
+			}
+		case 2:
+			// ACK settings that were never sent.
+			if conn.PeerSettingsPending() == 0 {
+				conn.WriteSettingsAck()
+			}
+		case 3:
+			// Late ACK of everything the peer is waiting on.
+			for i := conn.PeerSettingsPending(); i > 0; i-- {
+				conn.WriteSettingsAck()
+			}
+		}
+		fuzzer.sent("SettingsAckFuzzer", http2.FrameSettings.String(), conn.Counters().FramesSent-sent)
+
+		if age, ok := conn.OldestPendingSettings(); ok && age > SettingsAckTimeout {
+			conn.logger.Warn("Peer hasn't ACKed our SETTINGS", "strategy", "SettingsAckFuzzer", "after", age)
+		}
+		fuzzer.Mu.Unlock()
+
+		time.Sleep(config.FuzzDelay)
+		fuzzer.CheckConnection()
+	}
+	fuzzer.stopped("SettingsAckFuzzer")
+}
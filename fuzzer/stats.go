@@ -0,0 +1,215 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
+
+	"github.com/bradfitz/http2"
+)
+
+// Counters adds up what happened on one or more connections.
+type Counters struct {
+	FramesSent     uint64
+	FramesReceived uint64
+	// GoAway and Reset count the error codes of the GOAWAY and RST_STREAM
+	// frames the peer sent.
+	GoAway map[http2.ErrCode]uint64
+	Reset  map[http2.ErrCode]uint64
+}
+
+func (c *Counters) add(o Counters) {
+	c.FramesSent += o.FramesSent
+	c.FramesReceived += o.FramesReceived
+	c.GoAway = addCodes(c.GoAway, o.GoAway)
+	c.Reset = addCodes(c.Reset, o.Reset)
+}
+
+func addCodes(dst, src map[http2.ErrCode]uint64) map[http2.ErrCode]uint64 {
+	if len(src) == 0 {
+		return dst
+	}
+	if dst == nil {
+		dst = map[http2.ErrCode]uint64{}
+	}
+	for code, n := range src {
+		dst[code] += n
+	}
+	return dst
+}
+
+func countCode(codes map[http2.ErrCode]uint64, code http2.ErrCode) map[http2.ErrCode]uint64 {
+	if codes == nil {
+		codes = map[http2.ErrCode]uint64{}
+	}
+	codes[code]++
+	return codes
+}
+
+// Counters returns a copy of conn's counters.
+func (conn *Connection) Counters() Counters {
+	conn.countersMu.Lock()
+	defer conn.countersMu.Unlock()
+	c := Counters{}
+	c.add(conn.counters)
+	return c
+}
+
+func (conn *Connection) count(fn func(c *Counters)) {
+	conn.countersMu.Lock()
+	fn(&conn.counters)
+	conn.countersMu.Unlock()
+}
+
+// A FuzzerStatus is a snapshot of a fuzzer for the status view.
+type FuzzerStatus struct {
+	Alive           bool
+	ConnID          uint64
+	RestartAttempts int
+	Reconnects      int
+	// Frames is what each strategy sent, and Counters covers every
+	// connection the fuzzer has had.
+	Frames   map[string]uint64
+	Counters Counters
+}
+
+func (fuzzer *Fuzzer) Status() FuzzerStatus {
+	fuzzer.statsMu.Lock()
+	defer fuzzer.statsMu.Unlock()
+	s := FuzzerStatus{
+		Alive:           fuzzer.Alive,
+		ConnID:          fuzzer.Conn.ID,
+		RestartAttempts: fuzzer.RestartAttempts,
+		Reconnects:      fuzzer.Reconnects,
+		Frames:          map[string]uint64{},
+	}
+	for name, n := range fuzzer.Frames {
+		s.Frames[name] = n
+	}
+	s.Counters.add(fuzzer.retired)
+	s.Counters.add(fuzzer.Conn.Counters())
+	return s
+}
+
+// sent counts n frames of frameType from strategy name.
+func (fuzzer *Fuzzer) sent(name, frameType string, n uint64) {
+	fuzzer.statsMu.Lock()
+	fuzzer.Frames[name] += n
+	fuzzer.statsMu.Unlock()
+	framesSentMetric.Add(float64(n), strconv.Itoa(fuzzer.ID), name, frameType)
+}
+
+var (
+	fuzzersMu sync.Mutex
+	fuzzers   []*Fuzzer
+)
+
+func register(fuzzer *Fuzzer) {
+	fuzzersMu.Lock()
+	fuzzer.ID = len(fuzzers)
+	fuzzers = append(fuzzers, fuzzer)
+	fuzzersMu.Unlock()
+}
+
+// Fuzzers returns every fuzzer started so far, dead ones included.
+func Fuzzers() []*Fuzzer {
+	fuzzersMu.Lock()
+	defer fuzzersMu.Unlock()
+	return append([]*Fuzzer{}, fuzzers...)
+}
+
+// Dashboard redraws the status of every fuzzer on w once a second. It's meant
+// for a terminal, so logs are best sent elsewhere while it runs.
+func Dashboard(w io.Writer) {
+	d := &dashboard{start: time.Now(), last: map[string]uint64{}}
+	for range time.Tick(time.Second) {
+		d.draw(w)
+	}
+}
+
+// dashboard remembers the counts of the previous draw, for working out rates.
+type dashboard struct {
+	start    time.Time
+	lastSent uint64
+	last     map[string]uint64 // frames per strategy
+}
+
+func (d *dashboard) draw(w io.Writer) {
+	all := Fuzzers()
+	statuses := make([]FuzzerStatus, len(all))
+	total := Counters{}
+	strategies := map[string]uint64{}
+	live, reconnects := 0, 0
+	for i, fuzzer := range all {
+		s := fuzzer.Status()
+		statuses[i] = s
+		total.add(s.Counters)
+		for name, n := range s.Frames {
+			strategies[name] += n
+		}
+		if s.Alive {
+			live++
+		}
+		reconnects += s.Reconnects
+	}
+
+	// Clear the screen and move to the top left.
+	fmt.Fprint(w, "\033[H\033[2J")
+	fmt.Fprintf(w, "http2fuzz  up %v\n\n", time.Since(d.start).Round(time.Second))
+	fmt.Fprintf(w, "Frames sent %d (%d/s), received %d\n", total.FramesSent, total.FramesSent-d.lastSent, total.FramesReceived)
+	d.lastSent = total.FramesSent
+	fmt.Fprintf(w, "Fuzzers %d live, %d dead; %d reconnects\n\n", live, len(all)-live, reconnects)
+
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "FUZZER\tSTATE\tCONN\tRESTARTS\tRECONNECTS\tSENT\tRECEIVED\tSTRATEGIES")
+	for i, s := range statuses {
+		state := "live"
+		if !s.Alive {
+			state = "dead"
+		}
+		fmt.Fprintf(tw, "%d\t%s\t#%d\t%d\t%d\t%d\t%d\t%s\n", all[i].ID, state, s.ConnID, s.RestartAttempts, s.Reconnects,
+			s.Counters.FramesSent, s.Counters.FramesReceived, strings.Join(sortedKeys(s.Frames), " "))
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "STRATEGY\tFRAMES\tRATE")
+	for _, name := range sortedKeys(strategies) {
+		fmt.Fprintf(tw, "%s\t%d\t%d/s\n", name, strategies[name], strategies[name]-d.last[name])
+		d.last[name] = strategies[name]
+	}
+	fmt.Fprintln(tw)
+
+	fmt.Fprintln(tw, "PEER ERROR\tCODE\tCOUNT")
+	writeCodes(tw, "GOAWAY", total.GoAway)
+	writeCodes(tw, "RST_STREAM", total.Reset)
+	tw.Flush()
+}
+
+func writeCodes(w io.Writer, frame string, codes map[http2.ErrCode]uint64) {
+	sorted := make([]http2.ErrCode, 0, len(codes))
+	for code := range codes {
+		sorted = append(sorted, code)
+	}
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i] < sorted[j] })
+	for _, code := range sorted {
+		fmt.Fprintf(w, "%s\t%v\t%d\n", frame, code, codes[code])
+	}
+}
+
+func sortedKeys(m map[string]uint64) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
@@ -0,0 +1,165 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"math/rand"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/config"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+var errStepQuit = errors.New("quit by operator")
+
+// stepper pauses before every frame so an operator can send, skip or mutate
+// it while watching the target.
+type stepper struct {
+	in   *bufio.Reader
+	hdec *hpack.Decoder
+}
+
+// Step runs a single strategy against config.Target on one connection,
+// pausing before each frame it writes.
+func Step(name string) {
+	strategy, ok := Strategies[name]
+	if !ok {
+		names := []string{}
+		for n := range Strategies {
+			names = append(names, n)
+		}
+		sort.Strings(names)
+		fmt.Printf("Unknown strategy %q, pick one of: %s\n", name, strings.Join(names, ", "))
+		return
+	}
+
+	s := &stepper{in: bufio.NewReader(os.Stdin)}
+	// PrefaceFuzzer writes the preface itself.
+	preface := name != "PrefaceFuzzer"
+	// SettingsAckFuzzer ACKs the peer's SETTINGS itself, the first one too.
+	autoAck := name != "SettingsAckFuzzer"
+	conn := NewConnection(config.Target, config.IsTLS(), preface, preface, autoAck)
+	conn.WriteHook = s.hook
+	strategy(NewFuzzer(conn, false))
+}
+
+func (s *stepper) hook(frame []byte) ([]byte, error) {
+	for {
+		s.show(frame)
+		fmt.Print("[s]end, s[k]ip, [m]utate [<offset> <hex>], [q]uit (enter sends) > ")
+		line, err := s.in.ReadString('\n')
+		if err != nil {
+			return nil, errStepQuit
+		}
+
+		args := strings.Fields(line)
+		if len(args) == 0 {
+			return frame, nil
+		}
+		switch args[0] {
+		case "s", "send":
+			return frame, nil
+		case "k", "skip":
+			return nil, nil
+		case "q", "quit":
+			return nil, errStepQuit
+		case "m", "mutate":
+			mutated, err := mutateFrame(frame, args[1:])
+			if err != nil {
+				fmt.Println("Error:", err)
+				continue
+			}
+			frame = mutated
+		default:
+			fmt.Printf("Unknown command %q\n", args[0])
+		}
+	}
+}
+
+func (s *stepper) show(frame []byte) {
+	fmt.Println()
+	f, err := http2.NewFramer(nil, bytes.NewReader(frame)).ReadFrame()
+	if err != nil {
+		raw, _ := parseRawFrame(frame)
+		fmt.Printf("Undecodable frame type=%d flags=0x%x stream=%d len=%d: %v\n", raw.FrameType, raw.Flags, raw.StreamID, len(raw.Payload), err)
+	} else {
+		fmt.Println(f)
+		s.describe(f)
+	}
+	fmt.Print(hex.Dump(frame))
+}
+
+func (s *stepper) describe(f http2.Frame) {
+	switch f := f.(type) {
+	case *http2.SettingsFrame:
+		f.ForeachSetting(func(setting http2.Setting) error {
+			fmt.Printf("  %v\n", setting)
+			return nil
+		})
+	case *http2.PingFrame:
+		fmt.Printf("  Data = %q\n", f.Data)
+	case *http2.WindowUpdateFrame:
+		fmt.Printf("  Window-Increment = %v\n", f.Increment)
+	case *http2.RSTStreamFrame:
+		fmt.Printf("  Error-Code = %v\n", f.ErrCode)
+	case *http2.PriorityFrame:
+		fmt.Printf("  PRIORITY = %+v\n", f.PriorityParam)
+	case *http2.DataFrame:
+		fmt.Printf("  %d bytes of data\n", len(f.Data()))
+	case *http2.HeadersFrame:
+		if s.hdec == nil {
+			s.hdec = hpack.NewDecoder(4<<10, func(hf hpack.HeaderField) {
+				fmt.Printf("  %s = %q\n", hf.Name, hf.Value)
+			})
+		}
+		if _, err := s.hdec.Write(f.HeaderBlockFragment()); err != nil {
+			fmt.Println("  HPACK error:", err)
+			s.hdec = nil
+		}
+	}
+}
+
+// mutateFrame flips a few random payload bytes, or with an offset and hex
+// string overwrites the frame starting at that offset.
+func mutateFrame(frame []byte, args []string) ([]byte, error) {
+	mutated := append([]byte{}, frame...)
+
+	if len(args) == 0 {
+		if len(mutated) == frameHeaderLen {
+			mutated[4] ^= byte(rand.Intn(255) + 1)
+			return mutated, nil
+		}
+		for i := rand.Intn(4) + 1; i > 0; i-- {
+			mutated[frameHeaderLen+rand.Intn(len(mutated)-frameHeaderLen)] ^= byte(rand.Intn(255) + 1)
+		}
+		return mutated, nil
+	}
+
+	if len(args) != 2 {
+		return nil, errors.New("usage: m <offset> <hex>")
+	}
+	offset, err := parseUint(args[0], 31)
+	if err != nil {
+		return nil, err
+	}
+	b, err := hex.DecodeString(args[1])
+	if err != nil {
+		return nil, err
+	}
+	if int(offset)+len(b) > len(mutated) {
+		return nil, fmt.Errorf("frame is only %d bytes", len(mutated))
+	}
+	copy(mutated[offset:], b)
+	return mutated, nil
+}
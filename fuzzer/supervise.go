@@ -0,0 +1,56 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/supervisor"
+)
+
+// TargetSupervisor is set when the fuzzer launched the target itself.
+var TargetSupervisor *supervisor.Supervisor
+
+// Supervise launches the server under test and keeps it running. Each crash
+// is saved to config.CrashDir along with the frames sent since the previous
+// one.
+func Supervise(command []string) error {
+	s := supervisor.New(command, config.Target)
+	s.MaxRSS = config.MaxRSS
+	s.RestartDelay = config.RestartDelay
+	s.OnCrash = saveCrash
+	if err := s.Start(); err != nil {
+		return err
+	}
+	TargetSupervisor = s
+	return nil
+}
+
+func saveCrash(crash supervisor.Crash) {
+	crashesMetric.Inc()
+	if err := os.MkdirAll(config.CrashDir, 0755); err != nil {
+		slog.Error("Error saving crash", "err", err)
+		return
+	}
+	base := filepath.Join(config.CrashDir, fmt.Sprintf("crash-%d-%d", crash.Time.Unix(), crash.Pid))
+
+	entries := History.Drain()
+	if err := replay.SaveLog(base+".json", entries); err != nil {
+		slog.Error("Error saving crash", "err", err)
+	}
+
+	report := crash.String() + "\n\nstderr:\n" + strings.Join(crash.Stderr, "\n") + "\n"
+	if err := ioutil.WriteFile(base+".txt", []byte(report), 0644); err != nil {
+		slog.Error("Error saving crash", "err", err)
+	}
+	slog.Info("Saved crash", "frames", len(entries), "file", base+".json")
+}
@@ -0,0 +1,130 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+// clientTLS is what LoadClientTLS made of the TLS flags. Connections start
+// from a copy of it.
+var clientTLS *tls.Config
+
+var tlsVersions = map[string]uint16{
+	"1.0": tls.VersionTLS10,
+	"1.1": tls.VersionTLS11,
+	"1.2": tls.VersionTLS12,
+	"1.3": tls.VersionTLS13,
+}
+
+// LoadClientTLS reads the client certificate, CA bundle, versions and
+// cipher suites the flags ask for, so the connections to the target use
+// them. Without -ca the target's certificate isn't checked.
+func LoadClientTLS() error {
+	cfg := &tls.Config{
+		NextProtos:         []string{"h2", "h2-14"},
+		InsecureSkipVerify: true,
+	}
+
+	if config.ClientCert != "" || config.ClientKey != "" {
+		if config.ClientCert == "" || config.ClientKey == "" {
+			return errors.New("-client-cert and -client-key go together")
+		}
+		cert, err := tls.LoadX509KeyPair(config.ClientCert, config.ClientKey)
+		if err != nil {
+			return err
+		}
+		cfg.Certificates = []tls.Certificate{cert}
+	}
+
+	if config.CAFile != "" {
+		pem, err := os.ReadFile(config.CAFile)
+		if err != nil {
+			return err
+		}
+		cfg.RootCAs = x509.NewCertPool()
+		if !cfg.RootCAs.AppendCertsFromPEM(pem) {
+			return fmt.Errorf("no certificates in %s", config.CAFile)
+		}
+		cfg.InsecureSkipVerify = false
+	}
+
+	var err error
+	if cfg.MinVersion, err = parseTLSVersion(config.TLSMinVersion); err != nil {
+		return err
+	}
+	if cfg.MaxVersion, err = parseTLSVersion(config.TLSMaxVersion); err != nil {
+		return err
+	}
+	if cfg.CipherSuites, err = parseCipherSuites(config.CipherSuites); err != nil {
+		return err
+	}
+
+	clientTLS = cfg
+	return nil
+}
+
+func parseTLSVersion(s string) (uint16, error) {
+	if s == "" {
+		return 0, nil
+	}
+	v, ok := tlsVersions[s]
+	if !ok {
+		return 0, fmt.Errorf("unknown TLS version %q, pick 1.0, 1.1, 1.2 or 1.3", s)
+	}
+	return v, nil
+}
+
+// parseCipherSuites reads suites by name, like
+// TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256, or by number, like 0xc02f,
+// separated by commas.
+func parseCipherSuites(s string) ([]uint16, error) {
+	if s == "" {
+		return nil, nil
+	}
+	suites := map[string]*tls.CipherSuite{}
+	for _, suite := range append(tls.CipherSuites(), tls.InsecureCipherSuites()...) {
+		suites[suite.Name] = suite
+	}
+
+	ids := []uint16{}
+	for _, name := range strings.Split(s, ",") {
+		name = strings.TrimSpace(name)
+		var id uint16
+		if suite, ok := suites[name]; ok {
+			id = suite.ID
+		} else if n, err := strconv.ParseUint(name, 0, 16); err == nil {
+			id = uint16(n)
+		} else {
+			return nil, fmt.Errorf("unknown cipher suite %q", name)
+		}
+		if strings.HasPrefix(tls.CipherSuiteName(id), "TLS_AES_") || strings.HasPrefix(tls.CipherSuiteName(id), "TLS_CHACHA20_") {
+			return nil, fmt.Errorf("%s is a TLS 1.3 suite, which can't be chosen", tls.CipherSuiteName(id))
+		}
+		ids = append(ids, id)
+	}
+	return ids, nil
+}
+
+// serverName is the SNI sent to host: config.SNI if it's set, or the host
+// without its port.
+func serverName(host string) string {
+	if config.SNI != "" {
+		return config.SNI
+	}
+	if name, _, err := net.SplitHostPort(host); err == nil {
+		return name
+	}
+	return host
+}
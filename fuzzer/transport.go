@@ -0,0 +1,75 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"errors"
+	"log/slog"
+	"net"
+	"net/url"
+	"sync"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/transport"
+)
+
+// transportOptions is what LoadTransport made of the segmenting flags.
+var transportOptions transport.Options
+
+// proxies are the proxies of config.Proxy, nil for a direct connection.
+// Each connection takes the next one.
+var proxies []*url.URL
+var proxyMu sync.Mutex
+var proxyNext int
+
+// LoadTransport reads how the flags want writes cut up, for every connection
+// we dial or accept, and the proxies to dial through.
+func LoadTransport() error {
+	min, max, err := transport.ParseSegment(config.Segment)
+	if err != nil {
+		return err
+	}
+	if config.Coalesce < 0 {
+		return errors.New("-coalesce can't be negative")
+	}
+	if proxies, err = transport.ParseProxies(config.Proxy); err != nil {
+		return err
+	}
+	transportOptions = transport.Options{
+		MinSegment: min,
+		MaxSegment: max,
+		Delay:      config.SegmentDelay,
+		Coalesce:   config.Coalesce,
+	}
+	return nil
+}
+
+// wrapTransport puts c behind the transport options. Under TLS each segment
+// becomes a record of its own, which the peer's HTTP/2 parser reads apart.
+func wrapTransport(c net.Conn) net.Conn {
+	return transport.New(c, transportOptions)
+}
+
+func nextProxy() *url.URL {
+	proxyMu.Lock()
+	defer proxyMu.Unlock()
+	if len(proxies) == 0 {
+		return nil
+	}
+	proxy := proxies[proxyNext%len(proxies)]
+	proxyNext++
+	return proxy
+}
+
+// dialDirectOrProxy connects to host, through the next proxy if there is
+// one.
+func dialDirectOrProxy(host string) (net.Conn, error) {
+	proxy := nextProxy()
+	if proxy == nil {
+		return net.Dial("tcp", host)
+	}
+	slog.Debug("Connecting through proxy", "host", host, "proxy", proxy.Redacted())
+	return transport.DialProxy(proxy, host)
+}
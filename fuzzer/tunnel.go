@@ -0,0 +1,284 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/util"
+
+	"github.com/bradfitz/http2"
+)
+
+// tunnelMagic starts the bytes sent into each tunnel, followed by the
+// tunnel's number, so the upstream can tell which tunnel a connection is.
+var tunnelMagic = []byte("h2fz")
+
+const tunnelTagLen = 8
+
+var tunnelCount uint32
+
+func tunnelTag(id uint32) []byte {
+	return binary.BigEndian.AppendUint32(append([]byte{}, tunnelMagic...), id)
+}
+
+// An Upstream is the server CONNECT tunnels are opened to, standing in for
+// the real ones behind a proxy. It reads and discards what the tunnel
+// carries, closes when the tunnel half-closes, and warns when a tunnel that was closed cleanly didn't
+// carry exactly what was sent into it.
+type Upstream struct {
+	net.Listener
+
+	mu       sync.Mutex
+	expected map[uint32]int
+}
+
+var upstream *Upstream
+var upstreamErr error
+var upstreamOnce sync.Once
+
+// sharedUpstream starts the Upstream on config.UpstreamAddr the first time
+// it's needed.
+func sharedUpstream() (*Upstream, error) {
+	upstreamOnce.Do(func() {
+		upstream, upstreamErr = StartUpstream(config.UpstreamAddr)
+	})
+	return upstream, upstreamErr
+}
+
+// StartUpstream listens on addr and serves tunnels until the listener is
+// closed.
+func StartUpstream(addr string) (*Upstream, error) {
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return nil, err
+	}
+	u := &Upstream{Listener: l, expected: map[uint32]int{}}
+	slog.Info("Upstream listening", "addr", l.Addr())
+	go u.serve()
+	return u, nil
+}
+
+func (u *Upstream) serve() {
+	for {
+		c, err := u.Accept()
+		if err != nil {
+			return
+		}
+		go u.handle(c)
+	}
+}
+
+// Authority is the :authority that reaches u from conn's side. If u
+// listens on every interface, that's the address conn comes from.
+func (u *Upstream) Authority(conn *Connection) string {
+	addr := u.Addr().(*net.TCPAddr)
+	if !addr.IP.IsUnspecified() || conn.Raw == nil {
+		return addr.String()
+	}
+	if local, ok := conn.Raw.LocalAddr().(*net.TCPAddr); ok {
+		return net.JoinHostPort(local.IP.String(), strconv.Itoa(addr.Port))
+	}
+	return addr.String()
+}
+
+// expect tells u that tunnel id is sending n bytes and then half-closing.
+func (u *Upstream) expect(id uint32, n int) {
+	u.mu.Lock()
+	u.expected[id] = n
+	u.mu.Unlock()
+}
+
+func (u *Upstream) take(id uint32) (int, bool) {
+	u.mu.Lock()
+	defer u.mu.Unlock()
+	n, ok := u.expected[id]
+	delete(u.expected, id)
+	return n, ok
+}
+
+func (u *Upstream) handle(c net.Conn) {
+	defer c.Close()
+	head := []byte{}
+	total := 0
+	buf := make([]byte, 32<<10)
+	var err error
+	for {
+		var n int
+		n, err = c.Read(buf)
+		if n > 0 {
+			if len(head) < tunnelTagLen {
+				head = append(head, buf[:min(n, tunnelTagLen-len(head))]...)
+			}
+			total += n
+		}
+		if err != nil {
+			break
+		}
+	}
+
+	end := "eof"
+	if !errors.Is(err, io.EOF) {
+		end = err.Error()
+	}
+
+	if len(head) < tunnelTagLen || !bytes.Equal(head[:4], tunnelMagic) {
+		slog.Debug("Upstream connection closed", "peer", c.RemoteAddr(), "bytes", total, "end", end)
+		return
+	}
+	id := binary.BigEndian.Uint32(head[4:])
+	slog.Debug("Upstream connection closed", "peer", c.RemoteAddr(), "tunnel", id, "bytes", total, "end", end)
+	if sent, ok := u.take(id); ok && end == "eof" && sent != total {
+		slog.Warn("Tunnel didn't carry what was sent", "tunnel", id, "sent", sent, "arrived", total)
+	}
+}
+
+// badAuthorities mangle a good CONNECT :authority.
+var badAuthorities = []func(r *rand.Rand, authority string) string{
+	func(r *rand.Rand, authority string) string { return "" },
+	func(r *rand.Rand, authority string) string {
+		host, _, _ := net.SplitHostPort(authority)
+		return host
+	},
+	func(r *rand.Rand, authority string) string { return "user:password@" + authority },
+	func(r *rand.Rand, authority string) string { return authority + "/path" },
+	func(r *rand.Rand, authority string) string {
+		host, _, _ := net.SplitHostPort(authority)
+		ports := []string{"0", "65536", "-1", "99999999999", "http"}
+		return host + ":" + ports[r.Intn(len(ports))]
+	},
+	func(r *rand.Rand, authority string) string { return "::1:" + strconv.Itoa(r.Intn(65536)) },
+	func(r *rand.Rand, authority string) string { return "no-such-host.invalid:443" },
+	func(r *rand.Rand, authority string) string { return string(randomPayload(r, 300)) },
+}
+
+// ConnectTunnelFuzzer opens classic CONNECT tunnels (RFC 7540 section 8.3),
+// :method and :authority only, through an HTTP/2 proxy to the stand-in
+// upstream, and fuzzes what flows through them: random DATA, half-closes,
+// data after the half-close, HEADERS inside the tunnel, RST_STREAM and
+// DATA before the tunnel is up, and bad authorities.
+func (fuzzer *Fuzzer) ConnectTunnelFuzzer() {
+	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
+
+	up, err := sharedUpstream()
+	if err != nil {
+		fuzzer.Conn.logger.Warn("No upstream for ConnectTunnelFuzzer", "err", err)
+		fuzzer.kill()
+	}
+
+	for fuzzer.Alive {
+		fuzzer.Mu.Lock()
+		conn := fuzzer.Conn
+		fuzzer.Mu.Unlock()
+		if conn.Requests != nil {
+			conn.logger.Warn("ConnectTunnelFuzzer only runs against servers")
+			fuzzer.kill()
+			break
+		}
+
+		id := atomic.AddUint32(&tunnelCount, 1)
+		body := append(tunnelTag(id), randomPayload(r, 20000)...)
+		authority := up.Authority(conn)
+		endStream, wait, expect := false, true, false
+		var before []replay.RawFrame
+		var after func(streamID uint32) []replay.RawFrame
+
+		// How the tunnel ends: half-closed, reset or left open.
+		end := r.Intn(3)
+		tunnelEnd := func(streamID uint32) []replay.RawFrame {
+			frames := dataFrames(r, streamID, body, end == 0)
+			if end == 1 {
+				frames = append(frames, mustCapture(func(f *http2.Framer) error { return f.WriteRSTStream(streamID, http2.ErrCodeCancel) }))
+			}
+			return frames
+		}
+
+		var kind string
+		switch r.Intn(8) {
+		case 0:
+			kind = "rst-during-setup"
+			wait = false
+			before = []replay.RawFrame{{FrameType: uint8(http2.FrameRSTStream), Payload: binary.BigEndian.AppendUint32(nil, uint32(http2.ErrCodeCancel))}}
+		case 1:
+			kind = "data-before-response"
+			before = dataFrames(r, 0, body, end == 0)
+		case 2:
+			kind = "end-stream-on-headers"
+			endStream = true
+			after = tunnelEnd
+		case 3:
+			kind = "bad-authority"
+			authority = badAuthorities[r.Intn(len(badAuthorities))](r, authority)
+			after = tunnelEnd
+		case 4:
+			kind = "headers-in-tunnel"
+			after = func(streamID uint32) []replay.RawFrame {
+				block := encodeFields(conn.HEnc, &conn.HBuf, randomResponseHeaders(r, 4))
+				return append(dataFrames(r, streamID, body, false), headerFrames(r, streamID, block, r.Intn(2) == 0)...)
+			}
+		case 5:
+			kind = "data-after-half-close"
+			expect = true
+			after = func(streamID uint32) []replay.RawFrame {
+				return append(dataFrames(r, streamID, body, true), dataFrames(r, streamID, randomPayload(r, 1000), false)...)
+			}
+		default:
+			kind = "tunnel"
+			expect = end == 0
+			after = tunnelEnd
+		}
+
+		fuzzer.Mu.Lock()
+		streamID := conn.nextStreamID()
+		response := conn.expectResponse(streamID)
+		block := append([]byte{}, conn.encodeConnect(authority, nil)...)
+		frames := headerFrames(r, streamID, block, endStream)
+		for _, frame := range before {
+			frame.StreamID = streamID
+			frames = append(frames, frame)
+		}
+		fuzzer.writeFrames(conn, "ConnectTunnelFuzzer", frames)
+		fuzzer.Mu.Unlock()
+
+		status, ok := "", false
+		if wait {
+			status, ok = conn.waitResponse(streamID, response, ConnectWait)
+		} else {
+			conn.forgetResponse(streamID)
+		}
+		conn.logger.Debug("CONNECT tunnel", "strategy", "ConnectTunnelFuzzer", "case", kind, "stream", streamID,
+			"tunnel", id, "authority", authority, "status", status, "answered", ok)
+
+		if after != nil && conn.closeErr() == nil {
+			if expect && len(status) == 3 && status[0] == '2' {
+				up.expect(id, len(body))
+			}
+			fuzzer.Mu.Lock()
+			fuzzer.writeFrames(conn, "ConnectTunnelFuzzer", after(streamID))
+			fuzzer.Mu.Unlock()
+		}
+
+		if config.KeyboardDelay {
+			util.WaitForEnter()
+		} else {
+			time.Sleep(config.FuzzDelay)
+		}
+		fuzzer.CheckConnection()
+	}
+	fuzzer.stopped("ConnectTunnelFuzzer")
+}
@@ -0,0 +1,366 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package fuzzer
+
+import (
+	"encoding/binary"
+	"math/rand"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/util"
+
+	"github.com/bradfitz/http2"
+	"github.com/bradfitz/http2/hpack"
+)
+
+// ConnectWait is how long the CONNECT strategies wait for the response that
+// opens a tunnel before sending into it anyway.
+const ConnectWait = 2 * time.Second
+
+// WebSocket opcodes, RFC 6455 section 5.2.
+const (
+	wsContinuation = 0x0
+	wsText         = 0x1
+	wsBinary       = 0x2
+	wsClose        = 0x8
+	wsPing         = 0x9
+	wsPong         = 0xa
+)
+
+var wsReservedOpcodes = []byte{0x3, 0x4, 0x5, 0x6, 0x7, 0xb, 0xc, 0xd, 0xe, 0xf}
+
+// wsBadCloseCodes may not be sent in a close frame.
+var wsBadCloseCodes = []uint16{0, 999, 1004, 1005, 1006, 1015, 1016, 2999, 5000, 65535}
+
+// WebSocketPaths are the :path values tried for extended CONNECT.
+var WebSocketPaths = []string{"/", "/ws", "/websocket", "/socket", "/chat", "/socket.io/?EIO=4&transport=websocket"}
+
+// A WebSocketFrame is a frame from RFC 6455 section 5.2, with every field
+// under our control.
+type WebSocketFrame struct {
+	Fin     bool
+	RSV     byte // the three RSV bits
+	Opcode  byte
+	Masked  bool
+	Key     [4]byte
+	Payload []byte
+
+	// Length is written in place of len(Payload) if LengthSize is set, in
+	// the 7, 16 or 64 bit form for a LengthSize of 1, 2 or 8.
+	Length     uint64
+	LengthSize int
+}
+
+// Bytes serializes f, masking the payload if f.Masked.
+func (f WebSocketFrame) Bytes() []byte {
+	b0 := f.RSV&7<<4 | f.Opcode&0xf
+	if f.Fin {
+		b0 |= 0x80
+	}
+	length, size := uint64(len(f.Payload)), f.LengthSize
+	if size == 0 {
+		switch {
+		case length < 126:
+			size = 1
+		case length < 1<<16:
+			size = 2
+		default:
+			size = 8
+		}
+	} else {
+		length = f.Length
+	}
+
+	var mask byte
+	if f.Masked {
+		mask = 0x80
+	}
+	b := []byte{b0}
+	switch size {
+	case 1:
+		b = append(b, mask|byte(length&0x7f))
+	case 2:
+		b = append(b, mask|126, byte(length>>8), byte(length))
+	default:
+		b = append(b, mask|127)
+		b = binary.BigEndian.AppendUint64(b, length)
+	}
+
+	payload := append([]byte{}, f.Payload...)
+	if f.Masked {
+		b = append(b, f.Key[:]...)
+		for i := range payload {
+			payload[i] ^= f.Key[i%4]
+		}
+	}
+	return append(b, payload...)
+}
+
+func randomWebSocketFrame(r *rand.Rand, opcode byte, payload []byte) WebSocketFrame {
+	f := WebSocketFrame{Fin: true, Opcode: opcode, Masked: true, Payload: payload}
+	r.Read(f.Key[:])
+	return f
+}
+
+// GenerateWebSocketFrames builds the bytes a client sends down a WebSocket:
+// mostly a well formed message or two, with frames that break RFC 6455 in
+// one way or another mixed in.
+func GenerateWebSocketFrames(r *rand.Rand) []byte {
+	out := []byte{}
+	for i := r.Intn(4) + 1; i > 0; i-- {
+		var frames []WebSocketFrame
+		switch r.Intn(12) {
+		case 0:
+			// A message fragmented over several frames.
+			n := r.Intn(4) + 2
+			for j := 0; j < n; j++ {
+				opcode := byte(wsContinuation)
+				if j == 0 {
+					opcode = wsText
+				}
+				f := randomWebSocketFrame(r, opcode, []byte("fragment"))
+				f.Fin = j == n-1
+				frames = append(frames, f)
+			}
+			// Sometimes a new message starts before the last one ended, or a
+			// continuation comes out of nowhere.
+			switch r.Intn(3) {
+			case 0:
+				frames[len(frames)-1].Opcode = wsBinary
+			case 1:
+				frames = frames[1:]
+			}
+		case 1:
+			f := randomWebSocketFrame(r, wsReservedOpcodes[r.Intn(len(wsReservedOpcodes))], randomPayload(r, 64))
+			frames = append(frames, f)
+		case 2:
+			// RSV bits without an extension that defines them.
+			f := randomWebSocketFrame(r, wsText, []byte("rsv"))
+			f.RSV = byte(1 + r.Intn(7))
+			frames = append(frames, f)
+		case 3:
+			// Clients have to mask.
+			f := randomWebSocketFrame(r, wsBinary, randomPayload(r, 256))
+			f.Masked = false
+			frames = append(frames, f)
+		case 4:
+			// A length in a longer form than it needs, or past the 63 bits
+			// allowed.
+			f := randomWebSocketFrame(r, wsBinary, randomPayload(r, 100))
+			f.Length, f.LengthSize = uint64(len(f.Payload)), []int{2, 8}[r.Intn(2)]
+			if r.Intn(2) == 0 {
+				f.Length, f.LengthSize = 1<<63|uint64(len(f.Payload)), 8
+			}
+			frames = append(frames, f)
+		case 5:
+			// A length that claims more than follows.
+			f := randomWebSocketFrame(r, wsBinary, randomPayload(r, 100))
+			f.Length, f.LengthSize = uint64(len(f.Payload))+uint64(r.Intn(1<<20)+1), 8
+			frames = append(frames, f)
+		case 6:
+			// Control frames may not be fragmented or carry more than 125
+			// bytes.
+			f := randomWebSocketFrame(r, []byte{wsPing, wsPong, wsClose}[r.Intn(3)], randomPayload(r, 300))
+			f.Fin = r.Intn(2) == 0
+			frames = append(frames, f)
+		case 7:
+			// Text that isn't UTF-8.
+			frames = append(frames, randomWebSocketFrame(r, wsText, []byte{0xc3, 0x28, 0xed, 0xa0, 0x80, 0xff}))
+		case 8:
+			// Close frames with a code that can't be sent, a one byte body,
+			// or a reason that isn't UTF-8.
+			var payload []byte
+			switch r.Intn(3) {
+			case 0:
+				payload = binary.BigEndian.AppendUint16(nil, wsBadCloseCodes[r.Intn(len(wsBadCloseCodes))])
+			case 1:
+				payload = []byte{3}
+			default:
+				payload = append(binary.BigEndian.AppendUint16(nil, 1000), 0xff, 0xfe)
+			}
+			frames = append(frames, randomWebSocketFrame(r, wsClose, payload))
+		case 9:
+			// Big enough for the 64 bit length.
+			frames = append(frames, randomWebSocketFrame(r, wsBinary, randomPayload(r, 70000)))
+		default:
+			opcode := []byte{wsText, wsBinary, wsPing, wsPong}[r.Intn(4)]
+			frames = append(frames, randomWebSocketFrame(r, opcode, []byte("http2fuzz")))
+		}
+		for _, f := range frames {
+			out = append(out, f.Bytes()...)
+		}
+	}
+	return out
+}
+
+// extendedConnectFields builds the extended CONNECT request of RFC 8441
+// section 4 for a WebSocket.
+func extendedConnectFields(conn *Connection, r *rand.Rand) []hpack.HeaderField {
+	scheme := "http"
+	if conn.IsTLS {
+		scheme = "https"
+	}
+	fields := []hpack.HeaderField{
+		{Name: ":method", Value: "CONNECT"},
+		{Name: ":protocol", Value: "websocket"},
+		{Name: ":scheme", Value: scheme},
+		{Name: ":path", Value: WebSocketPaths[r.Intn(len(WebSocketPaths))]},
+		{Name: ":authority", Value: conn.Host},
+		{Name: "sec-websocket-version", Value: "13"},
+		{Name: "origin", Value: scheme + "://" + conn.Host},
+	}
+	if r.Intn(2) == 0 {
+		fields = append(fields, hpack.HeaderField{Name: "sec-websocket-protocol", Value: "chat, superchat"})
+	}
+	if r.Intn(2) == 0 {
+		fields = append(fields, hpack.HeaderField{Name: "sec-websocket-extensions", Value: "permessage-deflate"})
+	}
+	return fields
+}
+
+// withoutField drops the fields called name.
+func withoutField(fields []hpack.HeaderField, name string) []hpack.HeaderField {
+	out := []hpack.HeaderField{}
+	for _, f := range fields {
+		if f.Name != name {
+			out = append(out, f)
+		}
+	}
+	return out
+}
+
+// withField sets the first field called name to value, or adds it.
+func withField(fields []hpack.HeaderField, name, value string) []hpack.HeaderField {
+	out := append([]hpack.HeaderField{}, fields...)
+	for i := range out {
+		if out[i].Name == name {
+			out[i].Value = value
+			return out
+		}
+	}
+	return append(out, hpack.HeaderField{Name: name, Value: value})
+}
+
+// An ExtendedConnectCase is a way ExtendedConnectFuzzer gets extended
+// CONNECT wrong.
+type ExtendedConnectCase struct {
+	Name string
+	// Request builds the request, and SETTINGS to send before it.
+	Request func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting)
+}
+
+// ExtendedConnectCases are the bad requests ExtendedConnectFuzzer sends.
+var ExtendedConnectCases = []ExtendedConnectCase{
+	// RFC 7540 section 8.3: CONNECT without :protocol has no :path or
+	// :scheme.
+	{"connect-with-path", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return withoutField(withoutField(extendedConnectFields(conn, r), ":protocol"), ":scheme"), nil
+	}},
+	{"connect-with-scheme", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return withoutField(withoutField(extendedConnectFields(conn, r), ":protocol"), ":path"), nil
+	}},
+	{"protocol-on-get", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return withField(extendedConnectFields(conn, r), ":method", "GET"), nil
+	}},
+	{"missing-path", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return withoutField(extendedConnectFields(conn, r), ":path"), nil
+	}},
+	{"missing-scheme", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return withoutField(extendedConnectFields(conn, r), ":scheme"), nil
+	}},
+	{"unknown-protocol", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		protocols := []string{"", "WebSocket", "h2c", "connect-udp", string(randomPayload(r, 32))}
+		return withField(extendedConnectFields(conn, r), ":protocol", protocols[r.Intn(len(protocols))]), nil
+	}},
+	{"duplicate-protocol", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return append(extendedConnectFields(conn, r), hpack.HeaderField{Name: ":protocol", Value: "websocket"}), nil
+	}},
+	// The setting is the server's to send. Here the client sends it, with a
+	// value it can't have or turned off again.
+	{"bad-setting", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return extendedConnectFields(conn, r), []http2.Setting{{ID: SettingEnableConnectProtocol, Val: 2 + uint32(r.Intn(1<<20))}}
+	}},
+	{"setting-off", func(conn *Connection, r *rand.Rand) ([]hpack.HeaderField, []http2.Setting) {
+		return extendedConnectFields(conn, r), []http2.Setting{{ID: SettingEnableConnectProtocol, Val: 1}, {ID: SettingEnableConnectProtocol, Val: 0}}
+	}},
+}
+
+// ExtendedConnectFuzzer opens WebSockets over HTTP/2 with extended CONNECT
+// (RFC 8441) and fuzzes the WebSocket frames it sends down them in DATA
+// frames. Half of the requests are valid, which is a :protocol without
+// ENABLE_CONNECT_PROTOCOL unless the peer sent it. The rest are
+// ExtendedConnectCases.
+func (fuzzer *Fuzzer) ExtendedConnectFuzzer() {
+	fuzzer.CheckConnection()
+	r := rand.New(rand.NewSource(rand.Int63()))
+
+	for fuzzer.Alive {
+		fuzzer.Mu.Lock()
+		conn := fuzzer.Conn
+		fuzzer.Mu.Unlock()
+		if conn.Requests != nil {
+			conn.logger.Warn("ExtendedConnectFuzzer only runs against servers")
+			fuzzer.kill()
+			break
+		}
+
+		kind := "websocket"
+		if !conn.ConnectProtocolEnabled() {
+			kind = "protocol-without-setting"
+		}
+		fields, settings := extendedConnectFields(conn, r), []http2.Setting(nil)
+		if r.Intn(2) == 0 {
+			c := ExtendedConnectCases[r.Intn(len(ExtendedConnectCases))]
+			kind = c.Name
+			fields, settings = c.Request(conn, r)
+		}
+
+		fuzzer.Mu.Lock()
+		for _, s := range settings {
+			conn.WriteSettingsFrame([]http2.Setting{s})
+		}
+		streamID := conn.nextStreamID()
+		response := conn.expectResponse(streamID)
+		fuzzer.writeFrames(conn, "ExtendedConnectFuzzer", headerFrames(r, streamID, encodeFields(conn.HEnc, &conn.HBuf, fields), false))
+		fuzzer.Mu.Unlock()
+
+		status, ok := conn.waitResponse(streamID, response, ConnectWait)
+		conn.logger.Debug("Extended CONNECT", "strategy", "ExtendedConnectFuzzer", "case", kind, "stream", streamID, "status", status, "answered", ok)
+
+		// Whatever the answer, the WebSocket frames go down the stream. Then
+		// it's closed, reset or left open.
+		end := r.Intn(3)
+		frames := dataFrames(r, streamID, GenerateWebSocketFrames(r), end == 0)
+		if end == 1 {
+			frames = append(frames, mustCapture(func(f *http2.Framer) error { return f.WriteRSTStream(streamID, http2.ErrCodeCancel) }))
+		}
+		fuzzer.Mu.Lock()
+		fuzzer.writeFrames(conn, "ExtendedConnectFuzzer", frames)
+		fuzzer.Mu.Unlock()
+
+		if config.KeyboardDelay {
+			util.WaitForEnter()
+		} else {
+			time.Sleep(config.FuzzDelay)
+		}
+		fuzzer.CheckConnection()
+	}
+	fuzzer.stopped("ExtendedConnectFuzzer")
+}
+
+// writeFrames writes frames on conn until one fails. conn is the connection
+// the frames were made for, which is no longer fuzzer.Conn if it has been
+// reconnected since. The caller holds fuzzer.Mu.
+func (fuzzer *Fuzzer) writeFrames(conn *Connection, name string, frames []replay.RawFrame) error {
+	for _, frame := range frames {
+		if err := conn.WriteRawFrame(frame.FrameType, frame.Flags, frame.StreamID, frame.Payload); err != nil {
+			return err
+		}
+		fuzzer.sent(name, http2.FrameType(frame.FrameType).String(), 1)
+	}
+	return nil
+}
@@ -0,0 +1,64 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package harness
+
+import (
+	"crypto/sha1"
+	"fmt"
+	"io/ioutil"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// Corpus holds the frame sequences that reached new code. Every entry is
+// also saved in Dir as a replay file, so a later run picks up where this one
+// stopped and any entry can be replayed against a real server.
+type Corpus struct {
+	Dir     string
+	Entries [][]replay.RawFrame
+}
+
+func LoadCorpus(dir string) (*Corpus, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	corpus := &Corpus{Dir: dir}
+	for _, file := range files {
+		if file.IsDir() || !strings.HasSuffix(file.Name(), ".json") {
+			continue
+		}
+		frames, err := replay.LoadFile(filepath.Join(dir, file.Name()))
+		if err != nil {
+			return nil, err
+		}
+		corpus.Entries = append(corpus.Entries, frames)
+	}
+	return corpus, nil
+}
+
+// Add keeps frames in the corpus, named after the hash of their contents.
+func (c *Corpus) Add(frames []replay.RawFrame) error {
+	c.Entries = append(c.Entries, frames)
+
+	h := sha1.New()
+	for _, frame := range frames {
+		h.Write(frame.Bytes())
+	}
+	session := &replay.Session{Frames: frames}
+	return session.Save(filepath.Join(c.Dir, fmt.Sprintf("%x.json", h.Sum(nil))))
+}
+
+func (c *Corpus) Pick(r *rand.Rand) []replay.RawFrame {
+	return c.Entries[r.Intn(len(c.Entries))]
+}
@@ -0,0 +1,139 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package harness
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"runtime/coverage"
+)
+
+// Sizes of the fixed parts of a coverage counter data file, see
+// internal/coverage/defs.go in the Go source tree.
+const (
+	counterFileHeaderLen    = 32
+	counterSegmentHeaderLen = 16
+
+	counterFlavorRaw     = 1
+	counterFlavorULeb128 = 2
+)
+
+var counterMagic = []byte{0x00, 0x63, 0x77, 0x6d}
+
+type block struct {
+	pkg, fn, index uint32
+}
+
+// Coverage remembers which coverage counters of the running binary have
+// fired. It needs the binary to be built with -cover, otherwise Enabled is
+// false and no run ever finds anything new.
+type Coverage struct {
+	Enabled bool
+	seen    map[block]struct{}
+}
+
+// NewCoverage takes a first snapshot, so code that ran during startup
+// doesn't count as new.
+func NewCoverage() *Coverage {
+	c := &Coverage{seen: make(map[block]struct{})}
+	_, err := c.Update()
+	c.Enabled = err == nil
+	return c
+}
+
+// Update reads the counters and returns how many blocks fired for the first
+// time since the last call.
+func (c *Coverage) Update() (int, error) {
+	var buf bytes.Buffer
+	if err := coverage.WriteCounters(&buf); err != nil {
+		return 0, err
+	}
+
+	newBlocks := 0
+	err := decodeCounters(buf.Bytes(), func(b block) {
+		if _, ok := c.seen[b]; !ok {
+			c.seen[b] = struct{}{}
+			newBlocks++
+		}
+	})
+	return newBlocks, err
+}
+
+// Blocks is the number of distinct blocks seen so far.
+func (c *Coverage) Blocks() int {
+	return len(c.seen)
+}
+
+// decodeCounters walks the single segment that runtime/coverage.WriteCounters
+// emits and calls visit for every non-zero counter.
+func decodeCounters(data []byte, visit func(block)) error {
+	if len(data) < counterFileHeaderLen+counterSegmentHeaderLen || !bytes.Equal(data[:4], counterMagic) {
+		return errors.New("not a coverage counter file")
+	}
+	flavor := data[24]
+	var order binary.ByteOrder = binary.LittleEndian
+	if data[25] != 0 {
+		order = binary.BigEndian
+	}
+
+	segment := data[counterFileHeaderLen:]
+	entries := order.Uint64(segment)
+	skip := counterSegmentHeaderLen + int(order.Uint32(segment[8:])) + int(order.Uint32(segment[12:]))
+	if skip > len(segment) {
+		return errors.New("truncated coverage segment")
+	}
+	r := &counterReader{data: segment[skip:], flavor: flavor, order: order}
+
+	for i := uint64(0); i < entries; i++ {
+		n, pkg, fn := r.next(), r.next(), r.next()
+		for j := uint32(0); j < n; j++ {
+			if r.next() != 0 {
+				visit(block{pkg, fn, j})
+			}
+		}
+		if r.err != nil {
+			return r.err
+		}
+	}
+	return nil
+}
+
+type counterReader struct {
+	data   []byte
+	flavor byte
+	order  binary.ByteOrder
+	err    error
+}
+
+func (r *counterReader) next() uint32 {
+	if r.err != nil {
+		return 0
+	}
+	switch r.flavor {
+	case counterFlavorRaw:
+		if len(r.data) < 4 {
+			r.err = errors.New("truncated coverage counters")
+			return 0
+		}
+		v := r.order.Uint32(r.data)
+		r.data = r.data[4:]
+		return v
+	case counterFlavorULeb128:
+		v, shift := uint32(0), uint(0)
+		for i, b := range r.data {
+			v |= uint32(b&0x7f) << shift
+			if b&0x80 == 0 {
+				r.data = r.data[i+1:]
+				return v
+			}
+			shift += 7
+		}
+		r.err = errors.New("truncated coverage counters")
+		return 0
+	}
+	r.err = errors.New("unknown coverage counter flavor")
+	return 0
+}
@@ -0,0 +1,84 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package harness
+
+import (
+	"log/slog"
+	"math/rand"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/mutate"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// Number of generated sequences an empty corpus starts from.
+const seedCount = 32
+
+type Options struct {
+	// CorpusDir holds the sequences that reached new code. It is created if
+	// it doesn't exist.
+	CorpusDir string
+	// CurrentFile, if set, gets each input before it runs, so a crash that
+	// takes the whole process down leaves the input behind.
+	CurrentFile string
+	// Iterations is how many mutated inputs to run, 0 for no limit.
+	Iterations int
+}
+
+// Fuzz runs mutated frame sequences against the harness, keeping the ones
+// that reach new code in the corpus. The binary has to be built with
+// -cover (and -coverpkg for the packages of interest) for coverage to be
+// collected; otherwise it mutates blindly.
+func (h *Harness) Fuzz(opts Options) error {
+	corpus, err := LoadCorpus(opts.CorpusDir)
+	if err != nil {
+		return err
+	}
+	cov := NewCoverage()
+	if !cov.Enabled {
+		slog.Warn("Binary wasn't built with -cover, mutating without coverage feedback")
+	}
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+
+	if len(corpus.Entries) == 0 {
+		for i := 0; i < seedCount; i++ {
+			if err := corpus.Add(mutate.Generate(r, 8)); err != nil {
+				return err
+			}
+		}
+	}
+	for _, frames := range corpus.Entries {
+		h.run(opts, frames)
+	}
+	cov.Update()
+	slog.Info("Loaded corpus", "entries", len(corpus.Entries), "blocks", cov.Blocks())
+
+	lastReport := time.Now()
+	for execs := 1; opts.Iterations == 0 || execs <= opts.Iterations; execs++ {
+		frames := mutate.Sequence(r, corpus.Pick(r))
+		h.run(opts, frames)
+
+		if newBlocks, _ := cov.Update(); newBlocks > 0 {
+			if err := corpus.Add(frames); err != nil {
+				return err
+			}
+			slog.Info("New coverage", "exec", execs, "new_blocks", newBlocks, "frames", len(frames), "corpus", len(corpus.Entries))
+		}
+
+		if time.Since(lastReport) > time.Second {
+			slog.Info("Progress", "execs", execs, "corpus", len(corpus.Entries), "blocks", cov.Blocks())
+			lastReport = time.Now()
+		}
+	}
+	return nil
+}
+
+func (h *Harness) run(opts Options, frames []replay.RawFrame) {
+	if opts.CurrentFile != "" {
+		session := &replay.Session{Frames: frames}
+		session.Save(opts.CurrentFile)
+	}
+	h.Run(frames)
+}
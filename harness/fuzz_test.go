@@ -0,0 +1,72 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package harness
+
+import (
+	"io"
+	"io/ioutil"
+	"math/rand"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/fuzzer"
+	"github.com/c0nrad/http2fuzz/mutate"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// echo reads the whole request and echoes it back with a trailer, so
+// request bodies and trailers get exercised as well as the frame handling.
+func echo(w http.ResponseWriter, req *http.Request) {
+	body, _ := ioutil.ReadAll(req.Body)
+	w.Header().Set("Content-Type", "application/octet-stream")
+	w.Header().Set("Trailer", "X-Method")
+	w.WriteHeader(http.StatusOK)
+	w.Write(body)
+	io.WriteString(w, req.Method+" "+req.URL.String())
+	w.Header().Set("X-Method", req.Method)
+}
+
+// standIn is the local server the fuzz targets run against.
+var standIn = newStandIn()
+
+func newStandIn() *Harness {
+	h := New(http.HandlerFunc(echo))
+	h.Timeout = 200 * time.Millisecond
+	return h
+}
+
+// fuzzFrames seeds f with a few random inputs and runs every input through
+// frames against the stand-in. A panic in the server fails the input.
+func fuzzFrames(f *testing.F, frames func(data []byte) []replay.RawFrame) {
+	r := rand.New(rand.NewSource(0))
+	for _, n := range []int{0, 8, 64, 512} {
+		seed := make([]byte, n)
+		r.Read(seed)
+		f.Add(seed)
+	}
+	f.Fuzz(func(t *testing.T, data []byte) {
+		standIn.Run(frames(data))
+	})
+}
+
+func fuzzGenerator(f *testing.F, name string) {
+	fuzzFrames(f, fuzzer.FrameGenerators[name].FromBytes)
+}
+
+func FuzzContinuation(f *testing.F)     { fuzzGenerator(f, "Continuation") }
+func FuzzPushPromise(f *testing.F)      { fuzzGenerator(f, "PushPromise") }
+func FuzzData(f *testing.F)             { fuzzGenerator(f, "Data") }
+func FuzzRawFrame(f *testing.F)         { fuzzGenerator(f, "RawFrame") }
+func FuzzWindowUpdate(f *testing.F)     { fuzzGenerator(f, "WindowUpdate") }
+func FuzzReset(f *testing.F)            { fuzzGenerator(f, "Reset") }
+func FuzzPing(f *testing.F)             { fuzzGenerator(f, "Ping") }
+func FuzzPriority(f *testing.F)         { fuzzGenerator(f, "Priority") }
+func FuzzHeaders(f *testing.F)          { fuzzGenerator(f, "Headers") }
+func FuzzSettings(f *testing.F)         { fuzzGenerator(f, "Settings") }
+func FuzzSettingsBoundary(f *testing.F) { fuzzGenerator(f, "SettingsBoundary") }
+
+// FuzzSequence mixes frames from every generator in one connection.
+func FuzzSequence(f *testing.F) { fuzzFrames(f, mutate.FromBytes) }
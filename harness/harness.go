@@ -0,0 +1,116 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package harness
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"net/http"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/replay"
+
+	"golang.org/x/net/http2"
+)
+
+// Harness serves Handler with golang.org/x/net/http2 over an in-memory
+// pipe, so frame sequences reach a Go HTTP/2 server without any network in
+// between.
+type Harness struct {
+	Handler http.Handler
+	Server  *http2.Server
+	// Timeout bounds how long a single run may take.
+	Timeout time.Duration
+	// SendSettings sends an empty SETTINGS frame after the preface, as
+	// Connection does, so runs get past the server's preface checks.
+	SendSettings bool
+}
+
+func New(handler http.Handler) *Harness {
+	return &Harness{Handler: handler, Server: &http2.Server{}, Timeout: time.Second, SendSettings: true}
+}
+
+// ShutdownWait bounds how long Run waits for the server to finish with a
+// connection after closing it. After sending a GOAWAY, net/http's server
+// holds the connection for a second whatever the client does.
+var ShutdownWait = 2 * time.Second
+
+// syncPing is sent after the last frame. The server handles frames in order,
+// so once it ACKs this PING it has seen everything before it.
+var syncPing = [8]byte{'h', '2', 'f', 'u', 'z', 'z'}
+
+// Run sends the client preface and frames on a fresh server connection.
+// Once the server has handled them, or rejected the connection, it closes
+// the connection and waits for the server to finish with it.
+func (h *Harness) Run(frames []replay.RawFrame) {
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		h.Server.ServeConn(server, &http2.ServeConnOpts{Handler: h.Handler})
+		close(done)
+	}()
+
+	if h.SendSettings {
+		frames = append([]replay.RawFrame{{FrameType: uint8(http2.FrameSettings)}}, frames...)
+	}
+	frames = append(frames, replay.RawFrame{FrameType: uint8(http2.FramePing), Payload: syncPing[:]})
+
+	go func() {
+		if _, err := io.WriteString(client, http2.ClientPreface); err != nil {
+			return
+		}
+		for _, frame := range frames {
+			if _, err := client.Write(frame.Bytes()); err != nil {
+				return
+			}
+		}
+	}()
+
+	// net.Pipe is unbuffered, so the server's writes have to be read for it
+	// to make progress.
+	finished := make(chan struct{})
+	go func() {
+		defer close(finished)
+		framer := http2.NewFramer(ioutil.Discard, client)
+		for {
+			f, err := framer.ReadFrame()
+			if err != nil {
+				if _, ok := err.(http2.ConnectionError); ok {
+					continue
+				}
+				return
+			}
+			switch f := f.(type) {
+			case *http2.GoAwayFrame:
+				return
+			case *http2.PingFrame:
+				if f.IsAck() && f.Data == syncPing {
+					return
+				}
+			}
+		}
+	}()
+
+	timer := time.NewTimer(h.Timeout)
+	defer timer.Stop()
+	select {
+	case <-finished:
+	case <-timer.C:
+	}
+	// Closing also unblocks any writes the server stopped reading, and
+	// ends the connection even if the server was holding it open after a
+	// GOAWAY.
+	client.Close()
+
+	// Wait for the server to be done with the connection, so the coverage
+	// it reaches is credited to this run and not the next one.
+	wait := time.NewTimer(ShutdownWait)
+	defer wait.Stop()
+	select {
+	case <-done:
+	case <-wait.C:
+	}
+}
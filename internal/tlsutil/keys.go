@@ -0,0 +1,71 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsutil
+
+import (
+	"crypto/hmac"
+	"hash"
+)
+
+// PRF12 is the TLS 1.2 PRF, P_hash from RFC 5246 section 5.
+func PRF12(h func() hash.Hash, secret []byte, label string, seed []byte, n int) []byte {
+	seed = append([]byte(label), seed...)
+	out := []byte{}
+	a := seed
+	for len(out) < n {
+		mac := hmac.New(h, secret)
+		mac.Write(a)
+		a = mac.Sum(nil)
+
+		mac = hmac.New(h, secret)
+		mac.Write(a)
+		mac.Write(seed)
+		out = mac.Sum(out)
+	}
+	return out[:n]
+}
+
+// Transcript hashes the handshake messages msgs.
+func Transcript(h func() hash.Hash, msgs []byte) []byte {
+	d := h()
+	d.Write(msgs)
+	return d.Sum(nil)
+}
+
+// Extract is HKDF-Extract, with a zero salt if salt is nil.
+func Extract(h func() hash.Hash, salt, ikm []byte) []byte {
+	if salt == nil {
+		salt = make([]byte, h().Size())
+	}
+	mac := hmac.New(h, salt)
+	mac.Write(ikm)
+	return mac.Sum(nil)
+}
+
+// DeriveSecret is Derive-Secret from RFC 8446 section 7.1.
+func DeriveSecret(h func() hash.Hash, secret []byte, label string, msgs []byte) []byte {
+	return ExpandLabel(h, secret, label, Transcript(h, msgs), h().Size())
+}
+
+// ExpandLabel is HKDF-Expand-Label from RFC 8446 section 7.1.
+func ExpandLabel(h func() hash.Hash, secret []byte, label string, context []byte, n int) []byte {
+	label = "tls13 " + label
+	info := []byte{byte(n >> 8), byte(n), byte(len(label))}
+	info = append(info, label...)
+	info = append(info, byte(len(context)))
+	info = append(info, context...)
+
+	out := []byte{}
+	var t []byte
+	for i := byte(1); len(out) < n; i++ {
+		mac := hmac.New(h, secret)
+		mac.Write(t)
+		mac.Write(info)
+		mac.Write([]byte{i})
+		t = mac.Sum(nil)
+		out = append(out, t...)
+	}
+	return out[:n]
+}
@@ -0,0 +1,76 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"testing"
+)
+
+func unhex(t *testing.T, s string) []byte {
+	t.Helper()
+	b, err := hex.DecodeString(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return b
+}
+
+func checkHex(t *testing.T, what string, got []byte, want string) {
+	t.Helper()
+	if hex.EncodeToString(got) != want {
+		t.Errorf("%s:\n got %x\nwant %s", what, got, want)
+	}
+}
+
+// The P_SHA256 test vector circulated on the TLS working group list.
+func TestPRF12(t *testing.T) {
+	secret := unhex(t, "9bbe436ba940f017b17652849a71db35")
+	seed := unhex(t, "a0ba9f936cda311827a6f796ffd5198c")
+	want := "e3f229ba727be17b8d122620557cd453c2aab21d07c3d495329b52d4e61edb5a" +
+		"6b301791e90d35c9c9a46b4e14baf9af0fa022f7077def17abfd3797c0564bab" +
+		"4fbc91666e9def9b97fce34f796789baa48082d122ee42c5a72e5a5110fff701" +
+		"87347b66"
+	checkHex(t, "PRF", PRF12(sha256.New, secret, "test label", seed, 100), want)
+
+	// Shorter outputs are prefixes.
+	checkHex(t, "PRF[:20]", PRF12(sha256.New, secret, "test label", seed, 20), want[:40])
+}
+
+// The key schedule of the simple 1-RTT handshake in RFC 8448 section 3.
+func TestKeySchedule(t *testing.T) {
+	h := sha256.New
+	early := Extract(h, nil, make([]byte, 32))
+	checkHex(t, "early secret", early, "33ad0a1c607ec03b09e6cd9893680ce210adf300aa1f2660e1b22e10f170f92a")
+
+	derived := DeriveSecret(h, early, "derived", nil)
+	checkHex(t, "derived", derived, "6f2615a108c702c5678f54fc9dbab69716c076189c48250cebeac3576c3611ba")
+
+	shared := unhex(t, "8bd4054fb55b9d63fdfbacf9f04b9f0d35e6d63f537563efd46272900f89492d")
+	handshake := Extract(h, derived, shared)
+	checkHex(t, "handshake secret", handshake, "1dc826e93606aa6fdc0aadc12f741b01046aa6b99f691ed221a9f0ca043fbeac")
+
+	// The RFC gives the hash of ClientHello and ServerHello, not the
+	// messages, so these go through ExpandLabel the way DeriveSecret would.
+	hello := unhex(t, "860c06edc07858ee8e78f0e7428c58edd6b43f2ca3e6e95f02ed063cf0e1cad8")
+	checkHex(t, "client handshake traffic secret", ExpandLabel(h, handshake, "c hs traffic", hello, 32),
+		"b3eddb126e067f35a780b3abf45e2d8f3b1a950738f52e9600746a0e27a55a21")
+	server := ExpandLabel(h, handshake, "s hs traffic", hello, 32)
+	checkHex(t, "server handshake traffic secret", server,
+		"b67b7d690cc16c4e75e54213cb2d37b4e9c912bcded9105d42befd59d391ad38")
+	checkHex(t, "server handshake key", ExpandLabel(h, server, "key", nil, 16), "3fce516009c21727d0f2e4e86ee403bc")
+	checkHex(t, "server handshake iv", ExpandLabel(h, server, "iv", nil, 12), "5d313eb2671276ee13000b30")
+}
+
+func TestDeriveSecretHashesMessages(t *testing.T) {
+	h := sha256.New
+	secret := bytes.Repeat([]byte{7}, 32)
+	msgs := []byte("ClientHello...ServerHello")
+	if got, want := DeriveSecret(h, secret, "c hs traffic", msgs), ExpandLabel(h, secret, "c hs traffic", Transcript(h, msgs), 32); !bytes.Equal(got, want) {
+		t.Errorf("got %x, want %x", got, want)
+	}
+}
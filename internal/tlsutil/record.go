@@ -0,0 +1,117 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/cipher"
+	"encoding/binary"
+	"errors"
+)
+
+const recordHandshake = 22
+
+// A Record is one TLS record, pointing into the bytes it was split from.
+type Record struct {
+	Header []byte
+	Type   byte
+	Body   []byte
+}
+
+// Records splits b into TLS records, dropping a truncated one at the end.
+func Records(b []byte) []Record {
+	out := []Record{}
+	for len(b) >= 5 {
+		n := int(binary.BigEndian.Uint16(b[3:]))
+		if len(b) < 5+n {
+			break
+		}
+		out = append(out, Record{Header: b[:5], Type: b[0], Body: b[5 : 5+n]})
+		b = b[5+n:]
+	}
+	return out
+}
+
+// HandshakeMessage returns the first whole handshake message of msgType in
+// the plaintext handshake records of rs, with its four byte header.
+func HandshakeMessage(rs []Record, msgType byte) ([]byte, error) {
+	var hs []byte
+	for _, r := range rs {
+		if r.Type != recordHandshake {
+			continue
+		}
+		hs = append(hs, r.Body...)
+		for len(hs) >= 4 {
+			n := 4 + (int(hs[1])<<16 | int(hs[2])<<8 | int(hs[3]))
+			if len(hs) < n {
+				break
+			}
+			if hs[0] == msgType {
+				return hs[:n], nil
+			}
+			hs = hs[n:]
+		}
+	}
+	return nil, errors.New("no handshake message of that type")
+}
+
+// aad12 is the additional data of a TLS 1.2 AEAD record: the sequence
+// number, type, version and plaintext length.
+func aad12(seq uint64, typ byte, n int) []byte {
+	aad := make([]byte, 13)
+	binary.BigEndian.PutUint64(aad, seq)
+	aad[8], aad[9], aad[10] = typ, 3, 3
+	binary.BigEndian.PutUint16(aad[11:], uint16(n))
+	return aad
+}
+
+// Open12 decrypts a TLS 1.2 AES-GCM record, whose body starts with the
+// explicit part of the nonce.
+func Open12(aead cipher.AEAD, iv []byte, seq uint64, r Record) ([]byte, error) {
+	if len(r.Body) < 8+aead.Overhead() {
+		return nil, errors.New("short record")
+	}
+	nonce := append(append([]byte{}, iv...), r.Body[:8]...)
+	ciphertext := r.Body[8:]
+	return aead.Open(nil, nonce, ciphertext, aad12(seq, r.Type, len(ciphertext)-aead.Overhead()))
+}
+
+// Seal12 encrypts plaintext as the body of a TLS 1.2 AES-GCM record, with
+// the sequence number as explicit nonce like crypto/tls does.
+func Seal12(aead cipher.AEAD, iv []byte, seq uint64, typ byte, plaintext []byte) []byte {
+	explicit := binary.BigEndian.AppendUint64(nil, seq)
+	nonce := append(append([]byte{}, iv...), explicit...)
+	return aead.Seal(explicit, nonce, plaintext, aad12(seq, typ, len(plaintext)))
+}
+
+func nonce13(iv []byte, seq uint64) []byte {
+	nonce := append([]byte{}, iv...)
+	for i := 0; i < 8; i++ {
+		nonce[len(nonce)-1-i] ^= byte(seq >> (8 * i))
+	}
+	return nonce
+}
+
+// Open13 decrypts a TLS 1.3 record and returns its content type and
+// plaintext.
+func Open13(aead cipher.AEAD, iv []byte, seq uint64, r Record) (byte, []byte, error) {
+	inner, err := aead.Open(nil, nonce13(iv, seq), r.Body, r.Header)
+	if err != nil {
+		return 0, nil, err
+	}
+	inner = bytes.TrimRight(inner, "\x00")
+	if len(inner) == 0 {
+		return 0, nil, errors.New("record without content type")
+	}
+	return inner[len(inner)-1], inner[:len(inner)-1], nil
+}
+
+// Seal13 encrypts content of type typ as a whole TLS 1.3 record.
+func Seal13(aead cipher.AEAD, iv []byte, seq uint64, typ byte, content []byte) []byte {
+	inner := append(append([]byte{}, content...), typ)
+	n := len(inner) + aead.Overhead()
+	header := []byte{23, 3, 3, byte(n >> 8), byte(n)}
+	return aead.Seal(header, nonce13(iv, seq), inner, header)
+}
@@ -0,0 +1,81 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsutil
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"testing"
+)
+
+func TestHandshakeMessage(t *testing.T) {
+	// A ServerHello split over two records, with a ChangeCipherSpec record
+	// and a Certificate message before it in the stream.
+	cert := []byte{11, 0, 0, 3, 'a', 'b', 'c'}
+	hello := []byte{2, 0, 0, 5, 1, 2, 3, 4, 5}
+	hs := append(append([]byte{}, cert...), hello...)
+	b := []byte{20, 3, 3, 0, 1, 1}
+	b = append(append(b, 22, 3, 3, 0, 9), hs[:9]...)
+	b = append(append(b, 22, 3, 3, 0, byte(len(hs)-9)), hs[9:]...)
+	b = append(b, 22, 3, 3, 0, 40) // truncated
+
+	rs := Records(b)
+	if len(rs) != 3 {
+		t.Fatalf("got %d records, want 3", len(rs))
+	}
+	msg, err := HandshakeMessage(rs, 2)
+	if err != nil || !bytes.Equal(msg, hello) {
+		t.Errorf("got %x, %v; want %x", msg, err, hello)
+	}
+	if _, err := HandshakeMessage(rs, 1); err == nil {
+		t.Error("found a ClientHello that isn't there")
+	}
+}
+
+func testAEAD(t *testing.T) cipher.AEAD {
+	t.Helper()
+	block, err := aes.NewCipher(bytes.Repeat([]byte{1}, 16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return aead
+}
+
+func TestSealOpen12(t *testing.T) {
+	aead, iv := testAEAD(t), []byte{1, 2, 3, 4}
+	body := Seal12(aead, iv, 7, 22, []byte("finished"))
+	r := Record{Header: []byte{22, 3, 3, byte(len(body) >> 8), byte(len(body))}, Type: 22, Body: body}
+	if got, err := Open12(aead, iv, 7, r); err != nil || string(got) != "finished" {
+		t.Errorf("got %q, %v", got, err)
+	}
+	// The sequence number and type are authenticated.
+	if _, err := Open12(aead, iv, 8, r); err == nil {
+		t.Error("opened with the wrong sequence number")
+	}
+	r.Type = 23
+	if _, err := Open12(aead, iv, 7, r); err == nil {
+		t.Error("opened with the wrong type")
+	}
+}
+
+func TestSealOpen13(t *testing.T) {
+	aead, iv := testAEAD(t), bytes.Repeat([]byte{9}, 12)
+	rs := Records(Seal13(aead, iv, 300, 21, []byte{2, 40}))
+	if len(rs) != 1 || rs[0].Type != 23 {
+		t.Fatalf("got %+v, want one application data record", rs)
+	}
+	typ, got, err := Open13(aead, iv, 300, rs[0])
+	if err != nil || typ != 21 || !bytes.Equal(got, []byte{2, 40}) {
+		t.Errorf("got %d %x, %v", typ, got, err)
+	}
+	if _, _, err := Open13(aead, iv, 301, rs[0]); err == nil {
+		t.Error("opened with the wrong sequence number")
+	}
+}
@@ -0,0 +1,67 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package logging
+
+import (
+	"encoding/hex"
+	"fmt"
+	"log/slog"
+	"os"
+	"strings"
+
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+// MaxPayload is how many bytes of a payload Payload shows.
+const MaxPayload = 32
+
+// Setup points the default slog logger at stderr in the format and level
+// chosen on the command line. Until it's called, logs go through the log
+// package at info level.
+func Setup() error {
+	l, err := parseLevel(config.LogLevel)
+	if err != nil {
+		return err
+	}
+	if config.Quiet {
+		l = slog.LevelError
+	}
+
+	opts := &slog.HandlerOptions{Level: l}
+	var handler slog.Handler
+	switch config.LogFormat {
+	case config.LogFormatText:
+		handler = slog.NewTextHandler(os.Stderr, opts)
+	case config.LogFormatJSON:
+		handler = slog.NewJSONHandler(os.Stderr, opts)
+	default:
+		return fmt.Errorf("unknown log format %q, want %s or %s", config.LogFormat, config.LogFormatText, config.LogFormatJSON)
+	}
+	slog.SetDefault(slog.New(handler))
+	return nil
+}
+
+func parseLevel(name string) (slog.Level, error) {
+	var l slog.Level
+	if err := l.UnmarshalText([]byte(strings.ToUpper(name))); err != nil {
+		return 0, fmt.Errorf("unknown log level %q, want debug, info, warn or error", name)
+	}
+	return l, nil
+}
+
+// Payload logs b as hex, cut off after MaxPayload bytes. It's only rendered
+// if the message it's attached to is actually written.
+func Payload(b []byte) slog.LogValuer {
+	return payload(b)
+}
+
+type payload []byte
+
+func (p payload) LogValue() slog.Value {
+	if len(p) <= MaxPayload {
+		return slog.StringValue(hex.EncodeToString(p))
+	}
+	return slog.StringValue(fmt.Sprintf("%s...(%d bytes)", hex.EncodeToString(p[:MaxPayload]), len(p)))
+}
@@ -2,18 +2,82 @@ package main
 
 import (
 	"flag"
+	"log/slog"
 	"os"
+	"strings"
 
+	"github.com/c0nrad/http2fuzz/capture"
 	"github.com/c0nrad/http2fuzz/config"
 	"github.com/c0nrad/http2fuzz/fuzzer"
+	"github.com/c0nrad/http2fuzz/logging"
+	"github.com/c0nrad/http2fuzz/metrics"
+	"github.com/c0nrad/http2fuzz/minimize"
+	"github.com/c0nrad/http2fuzz/mutate"
 )
 
 func main() {
+	config.Parse()
+	if err := logging.Setup(); err != nil {
+		fatal(err)
+	}
+
+	if config.Target != "" {
+		if err := fuzzer.LoadClientTLS(); err != nil {
+			fatal(err)
+		}
+	}
+	if err := fuzzer.LoadTransport(); err != nil {
+		fatal(err)
+	}
+
+	if config.MetricsAddr != "" {
+		go func() {
+			if err := metrics.Serve(config.MetricsAddr); err != nil {
+				fatal(err)
+			}
+		}()
+	}
+	if config.ProbeInterval > 0 && config.Target != "" && (config.FuzzMode == config.ModeClient || config.FuzzMode == config.ModeSeeds) {
+		go fuzzer.ProbeLoop()
+	}
+	if config.Stats && (config.FuzzMode == config.ModeClient || config.FuzzMode == config.ModeServer) {
+		go fuzzer.Dashboard(os.Stdout)
+	}
 
 	if config.FuzzMode == config.ModeClient {
+		supervise()
 		fuzzer.Client()
+	} else if config.FuzzMode == config.ModeSeeds && config.Target != "" {
+		supervise()
+		if err := mutate.Run(); err != nil {
+			fatal(err)
+		}
+		return
+	} else if config.FuzzMode == config.ModeTLS {
+		supervise()
+		if err := fuzzer.NegotiationFuzzer(); err != nil {
+			fatal(err)
+		}
 	} else if config.FuzzMode == config.ModeServer {
-		fuzzer.Server()
+		if err := fuzzer.Server(); err != nil {
+			fatal(err)
+		}
+	} else if config.FuzzMode == config.ModeInteractive && config.Target != "" {
+		fuzzer.Interactive()
+		return
+	} else if config.FuzzMode == config.ModeStep && config.Target != "" {
+		fuzzer.Step(config.StepStrategy)
+		return
+	} else if config.FuzzMode == config.ModeImport {
+		if err := capture.Run(); err != nil {
+			fatal(err)
+		}
+		return
+	} else if config.FuzzMode == config.ModeMinimize && config.Target != "" {
+		if err := minimize.Run(); err != nil {
+			fatal(err)
+		}
+		return
 	} else {
 		flag.Usage()
 		os.Exit(1)
@@ -21,3 +85,16 @@ func main() {
 
 	select {}
 }
+
+func supervise() {
+	if config.TargetCommand != "" {
+		if err := fuzzer.Supervise(strings.Fields(config.TargetCommand)); err != nil {
+			fatal(err)
+		}
+	}
+}
+
+func fatal(err error) {
+	slog.Error(err.Error())
+	os.Exit(1)
+}
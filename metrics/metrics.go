@@ -0,0 +1,223 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package metrics
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"math"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// A metric writes itself in the Prometheus text exposition format.
+type metric interface {
+	write(w io.Writer)
+}
+
+var (
+	registryMu sync.Mutex
+	registry   []metric
+)
+
+func register(m metric) {
+	registryMu.Lock()
+	registry = append(registry, m)
+	registryMu.Unlock()
+}
+
+// WriteTo writes every registered metric to w.
+func WriteTo(w io.Writer) error {
+	registryMu.Lock()
+	metrics := append([]metric{}, registry...)
+	registryMu.Unlock()
+
+	bw := bufio.NewWriter(w)
+	for _, m := range metrics {
+		m.write(bw)
+	}
+	return bw.Flush()
+}
+
+// Handler serves the registered metrics to Prometheus.
+func Handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		WriteTo(w)
+	})
+}
+
+// Serve answers on addr with the metrics at /metrics.
+func Serve(addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", Handler())
+	return http.ListenAndServe(addr, mux)
+}
+
+// series holds the values of a metric under each combination of labels.
+type series struct {
+	name, help, kind string
+	labels           []string
+
+	mu     sync.Mutex
+	values map[string][]string // key -> label values
+	keys   []string
+}
+
+// key looks up the series for labelValues, adding it if it's new.
+func (s *series) key(labelValues []string) (string, bool) {
+	if len(labelValues) != len(s.labels) {
+		panic(fmt.Sprintf("%s: got %d label values, want %d", s.name, len(labelValues), len(s.labels)))
+	}
+	key := strings.Join(labelValues, "\xff")
+	if _, ok := s.values[key]; ok {
+		return key, false
+	}
+	s.values[key] = append([]string{}, labelValues...)
+	s.keys = append(s.keys, key)
+	sort.Strings(s.keys)
+	return key, true
+}
+
+func (s *series) header(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", s.name, s.help, s.name, s.kind)
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+// labelString renders the labels of key, plus any extra name/value pairs.
+func (s *series) labelString(key string, extra ...string) string {
+	values := s.values[key]
+	pairs := []string{}
+	for i, name := range s.labels {
+		pairs = append(pairs, name+`="`+labelEscaper.Replace(values[i])+`"`)
+	}
+	for i := 0; i+1 < len(extra); i += 2 {
+		pairs = append(pairs, extra[i]+`="`+labelEscaper.Replace(extra[i+1])+`"`)
+	}
+	if len(pairs) == 0 {
+		return ""
+	}
+	return "{" + strings.Join(pairs, ",") + "}"
+}
+
+// A CounterVec is a counter for each combination of its labels.
+type CounterVec struct {
+	series
+	counts map[string]float64
+}
+
+func NewCounterVec(name, help string, labels ...string) *CounterVec {
+	c := &CounterVec{
+		series: series{name: name, help: help, kind: "counter", labels: labels, values: map[string][]string{}},
+		counts: map[string]float64{},
+	}
+	if len(labels) == 0 {
+		// Without labels there's only one series, and it starts at zero.
+		c.key(nil)
+	}
+	register(c)
+	return c
+}
+
+func (c *CounterVec) Inc(labelValues ...string) {
+	c.Add(1, labelValues...)
+}
+
+func (c *CounterVec) Add(n float64, labelValues ...string) {
+	c.mu.Lock()
+	key, _ := c.key(labelValues)
+	c.counts[key] += n
+	c.mu.Unlock()
+}
+
+func (c *CounterVec) write(w io.Writer) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.header(w)
+	for _, key := range c.keys {
+		fmt.Fprintf(w, "%s%s %s\n", c.name, c.labelString(key), formatFloat(c.counts[key]))
+	}
+}
+
+// A HistogramVec is a histogram for each combination of its labels.
+type HistogramVec struct {
+	series
+	buckets []float64
+	counts  map[string][]uint64 // per bucket, not cumulative
+	sums    map[string]float64
+	totals  map[string]uint64
+}
+
+// NewHistogramVec makes a histogram with the given upper bounds, in
+// increasing order. The +Inf bucket is added for you.
+func NewHistogramVec(name, help string, buckets []float64, labels ...string) *HistogramVec {
+	h := &HistogramVec{
+		series:  series{name: name, help: help, kind: "histogram", labels: labels, values: map[string][]string{}},
+		buckets: buckets,
+		counts:  map[string][]uint64{},
+		sums:    map[string]float64{},
+		totals:  map[string]uint64{},
+	}
+	register(h)
+	return h
+}
+
+func (h *HistogramVec) Observe(v float64, labelValues ...string) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	key, added := h.key(labelValues)
+	if added {
+		h.counts[key] = make([]uint64, len(h.buckets))
+	}
+	if i := sort.SearchFloat64s(h.buckets, v); i < len(h.buckets) {
+		h.counts[key][i]++
+	}
+	h.sums[key] += v
+	h.totals[key]++
+}
+
+func (h *HistogramVec) write(w io.Writer) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	h.header(w)
+	for _, key := range h.keys {
+		var cumulative uint64
+		for i, le := range h.buckets {
+			cumulative += h.counts[key][i]
+			fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", formatFloat(le)), cumulative)
+		}
+		fmt.Fprintf(w, "%s_bucket%s %d\n", h.name, h.labelString(key, "le", "+Inf"), h.totals[key])
+		fmt.Fprintf(w, "%s_sum%s %s\n", h.name, h.labelString(key), formatFloat(h.sums[key]))
+		fmt.Fprintf(w, "%s_count%s %d\n", h.name, h.labelString(key), h.totals[key])
+	}
+}
+
+// A GaugeFunc reports whatever its function returns at scrape time.
+type GaugeFunc struct {
+	name, help string
+	fn         func() float64
+}
+
+func NewGaugeFunc(name, help string, fn func() float64) *GaugeFunc {
+	g := &GaugeFunc{name: name, help: help, fn: fn}
+	register(g)
+	return g
+}
+
+func (g *GaugeFunc) write(w io.Writer) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s gauge\n%s %s\n", g.name, g.help, g.name, g.name, formatFloat(g.fn()))
+}
+
+func formatFloat(v float64) string {
+	if math.IsInf(v, 1) {
+		return "+Inf"
+	}
+	return strconv.FormatFloat(v, 'g', -1, 64)
+}
@@ -0,0 +1,178 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package minimize
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// Run shrinks config.MinimizeFile to the smallest frame sequence that still
+// reproduces under config.Oracle and writes it to config.MinimizeOutput.
+func Run() error {
+	frames, err := replay.LoadFile(config.MinimizeFile)
+	if err != nil {
+		return err
+	}
+	oracle, err := NewOracle(config.Oracle)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("Checking that the crash reproduces", "frames", len(frames), "file", config.MinimizeFile)
+	ok, err := oracle.Reproduces(frames)
+	if err != nil {
+		return err
+	}
+	if !ok {
+		return errors.New("replay file does not reproduce with -oracle " + config.Oracle)
+	}
+
+	frames, err = Frames(frames, oracle)
+	if err != nil {
+		return err
+	}
+	slog.Info("Shrinking payloads", "frames", len(frames))
+
+	frames, err = Payloads(frames, oracle)
+	if err != nil {
+		return err
+	}
+
+	session := &replay.Session{Frames: frames}
+	if err := session.Save(config.MinimizeOutput); err != nil {
+		return err
+	}
+	fmt.Printf("Minimized to %d frames, saved to %s\n", len(frames), config.MinimizeOutput)
+	return nil
+}
+
+// Frames removes every frame that isn't needed to reproduce.
+func Frames(frames []replay.RawFrame, oracle Oracle) ([]replay.RawFrame, error) {
+	pick := func(keep []int) []replay.RawFrame {
+		picked := make([]replay.RawFrame, len(keep))
+		for i, k := range keep {
+			picked[i] = frames[k]
+		}
+		return picked
+	}
+
+	keep, err := ddmin(len(frames), func(keep []int) (bool, error) {
+		return oracle.Reproduces(pick(keep))
+	})
+	if err != nil {
+		return nil, err
+	}
+	return pick(keep), nil
+}
+
+// Payloads removes bytes from each frame's payload, one frame at a time.
+func Payloads(frames []replay.RawFrame, oracle Oracle) ([]replay.RawFrame, error) {
+	frames = append([]replay.RawFrame{}, frames...)
+	for i := range frames {
+		payload := frames[i].Payload
+		pick := func(keep []int) []byte {
+			picked := make([]byte, len(keep))
+			for j, k := range keep {
+				picked[j] = payload[k]
+			}
+			return picked
+		}
+
+		keep, err := ddmin(len(payload), func(keep []int) (bool, error) {
+			frames[i].Payload = pick(keep)
+			return oracle.Reproduces(frames)
+		})
+		if err != nil {
+			return nil, err
+		}
+		frames[i].Payload = pick(keep)
+		slog.Info("Shrank payload", "frame", i, "from", len(payload), "to", len(keep))
+	}
+	return frames, nil
+}
+
+// ddmin is Zeller's delta debugging minimization over the indexes 0..n-1.
+// test reports whether a subset of indexes still reproduces, and the
+// returned subset is 1-minimal: removing any single index stops it
+// reproducing.
+func ddmin(n int, test func(keep []int) (bool, error)) ([]int, error) {
+	items := make([]int, n)
+	for i := range items {
+		items[i] = i
+	}
+	if n == 0 {
+		return items, nil
+	}
+	if ok, err := test([]int{}); err != nil || ok {
+		return []int{}, err
+	}
+
+	granularity := 2
+	for len(items) >= 2 {
+		chunks := split(items, granularity)
+		reduced := false
+
+		for _, chunk := range chunks {
+			ok, err := test(chunk)
+			if err != nil {
+				return nil, err
+			}
+			if ok {
+				items, granularity, reduced = chunk, 2, true
+				break
+			}
+		}
+
+		if !reduced && granularity > 2 {
+			for i := range chunks {
+				complement := []int{}
+				for j, chunk := range chunks {
+					if j != i {
+						complement = append(complement, chunk...)
+					}
+				}
+				ok, err := test(complement)
+				if err != nil {
+					return nil, err
+				}
+				if ok {
+					items, reduced = complement, true
+					if granularity > 2 {
+						granularity--
+					}
+					break
+				}
+			}
+		}
+
+		if !reduced {
+			if granularity >= len(items) {
+				break
+			}
+			granularity *= 2
+			if granularity > len(items) {
+				granularity = len(items)
+			}
+		}
+	}
+	return items, nil
+}
+
+// split divides items into n chunks of nearly equal size.
+func split(items []int, n int) [][]int {
+	chunks := [][]int{}
+	start := 0
+	for i := 0; i < n; i++ {
+		end := start + (len(items)-start)/(n-i)
+		chunks = append(chunks, items[start:end])
+		start = end
+	}
+	return chunks
+}
@@ -0,0 +1,120 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package minimize
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+)
+
+// has returns an oracle that reproduces when keep holds all of want.
+func has(want ...int) func(keep []int) bool {
+	return func(keep []int) bool {
+		for _, w := range want {
+			found := false
+			for _, k := range keep {
+				found = found || k == w
+			}
+			if !found {
+				return false
+			}
+		}
+		return true
+	}
+}
+
+// anyTwo reproduces when keep holds at least two of set.
+func anyTwo(set ...int) func(keep []int) bool {
+	return func(keep []int) bool {
+		n := 0
+		for _, s := range set {
+			if has(s)(keep) {
+				n++
+			}
+		}
+		return n >= 2
+	}
+}
+
+func without(items []int, i int) []int {
+	return append(append([]int{}, items[:i]...), items[i+1:]...)
+}
+
+func TestDDMin(t *testing.T) {
+	tests := []struct {
+		name   string
+		n      int
+		oracle func(keep []int) bool
+		want   []int
+	}{
+		{"single", 16, has(7), []int{7}},
+		{"single-first", 9, has(0), []int{0}},
+		{"single-last", 9, has(8), []int{8}},
+		{"one-item", 1, has(0), []int{0}},
+		{"pair", 16, has(3, 11), []int{3, 11}},
+		{"pair-adjacent", 13, has(5, 6), []int{5, 6}},
+		{"scattered", 37, has(1, 17, 18, 36), []int{1, 17, 18, 36}},
+		{"nothing", 10, func([]int) bool { return false }, []int{0, 1, 2, 3, 4, 5, 6, 7, 8, 9}},
+		{"empty-reproduces", 10, func([]int) bool { return true }, []int{}},
+		{"no-items", 0, has(), []int{}},
+		{"any-two", 20, anyTwo(4, 9, 15), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := ddmin(tt.n, func(keep []int) (bool, error) { return tt.oracle(keep), nil })
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.want != nil && !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("got %v, want %v", got, tt.want)
+			}
+			if tt.n == 0 || !tt.oracle(got) {
+				return
+			}
+			for i := range got {
+				if smaller := without(got, i); tt.oracle(smaller) {
+					t.Errorf("%v isn't 1-minimal, %v reproduces", got, smaller)
+				}
+			}
+		})
+	}
+}
+
+func TestDDMinError(t *testing.T) {
+	boom := errors.New("boom")
+	calls := 0
+	_, err := ddmin(8, func(keep []int) (bool, error) {
+		if calls++; calls == 3 {
+			return false, boom
+		}
+		return has(5)(keep), nil
+	})
+	if err != boom {
+		t.Errorf("got %v, want %v", err, boom)
+	}
+}
+
+func TestSplit(t *testing.T) {
+	items := []int{0, 1, 2, 3, 4, 5, 6}
+	for n := 1; n <= 10; n++ {
+		chunks := split(items, n)
+		if len(chunks) != n {
+			t.Fatalf("split into %d: got %d chunks", n, len(chunks))
+		}
+		joined := []int{}
+		shortest, longest := len(items), 0
+		for _, c := range chunks {
+			joined = append(joined, c...)
+			shortest, longest = min(shortest, len(c)), max(longest, len(c))
+		}
+		if !reflect.DeepEqual(joined, items) {
+			t.Errorf("split into %d: chunks %v don't make up %v", n, chunks, items)
+		}
+		if longest-shortest > 1 {
+			t.Errorf("split into %d: chunks %v differ by more than one", n, chunks)
+		}
+	}
+}
@@ -0,0 +1,131 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package minimize
+
+import (
+	"errors"
+	"fmt"
+	"log/slog"
+	"strings"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/fuzzer"
+	"github.com/c0nrad/http2fuzz/replay"
+	"github.com/c0nrad/http2fuzz/supervisor"
+)
+
+// How long the target gets to come back up between attempts.
+const recoverTimeout = 10 * time.Second
+
+// An Oracle replays frames against the target and reports whether the
+// crash reproduced. An error means the attempt couldn't be judged at all.
+type Oracle interface {
+	Reproduces(frames []replay.RawFrame) (bool, error)
+}
+
+func NewOracle(name string) (Oracle, error) {
+	switch name {
+	case config.OracleDrop:
+		return dropOracle{}, nil
+	case config.OracleProbe:
+		return probeOracle{}, nil
+	case config.OracleExit:
+		if config.TargetCommand == "" {
+			return nil, errors.New("-oracle exit needs -target-cmd")
+		}
+		return exitOracle{command: strings.Fields(config.TargetCommand)}, nil
+	}
+	return nil, fmt.Errorf("unknown oracle %q", name)
+}
+
+// send replays frames on a new connection and gives the target
+// config.OracleWait to fall over.
+func send(frames []replay.RawFrame) *fuzzer.Connection {
+	conn := fuzzer.NewReplayConnection(config.Target, config.IsTLS(), frames)
+	if conn.Err == nil {
+		conn.ReplayFrames(frames)
+		time.Sleep(config.OracleWait)
+	}
+	return conn
+}
+
+// waitForTarget probes the target until it answers, so a target that is
+// still down from the last attempt isn't blamed on the next one.
+func waitForTarget() error {
+	deadline := time.Now().Add(recoverTimeout)
+	for {
+		err := fuzzer.Probe(config.Target, config.IsTLS(), config.OracleWait)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("target did not recover: %v", err)
+		}
+		time.Sleep(config.RestartDelay)
+	}
+}
+
+// dropOracle reproduces when the target closes the connection without
+// sending a GOAWAY first.
+type dropOracle struct{}
+
+func (dropOracle) Reproduces(frames []replay.RawFrame) (bool, error) {
+	if err := waitForTarget(); err != nil {
+		return false, err
+	}
+	conn := send(frames)
+	dropped := conn.Err != nil && !conn.GoAway
+	if conn.Raw != nil {
+		conn.Raw.Close()
+	}
+	return dropped, nil
+}
+
+// probeOracle reproduces when the target stops answering a fresh request
+// after the frames were sent.
+type probeOracle struct{}
+
+func (probeOracle) Reproduces(frames []replay.RawFrame) (bool, error) {
+	if err := waitForTarget(); err != nil {
+		return false, err
+	}
+	conn := send(frames)
+	if conn.Raw != nil {
+		conn.Raw.Close()
+	}
+	return fuzzer.Probe(config.Target, config.IsTLS(), config.OracleWait) != nil, nil
+}
+
+// exitOracle starts a fresh target process for every attempt and reproduces
+// when that process exits on its own.
+type exitOracle struct {
+	command []string
+}
+
+func (o exitOracle) Reproduces(frames []replay.RawFrame) (bool, error) {
+	proc, err := supervisor.Start(o.command, config.MaxRSS)
+	if err != nil {
+		return false, err
+	}
+	if err := proc.WaitForListen(config.Target, recoverTimeout); err != nil {
+		proc.Kill()
+		return false, err
+	}
+
+	conn := send(frames)
+	if conn.Raw != nil {
+		conn.Raw.Close()
+	}
+
+	select {
+	case <-proc.Exited():
+		slog.Info("Target crashed", "crash", proc.Crash())
+		return true, nil
+	default:
+		proc.Kill()
+		return false, nil
+	}
+}
@@ -0,0 +1,241 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package mutate
+
+import (
+	"encoding/binary"
+	"math/rand"
+
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+const frameHeaderLen = 9
+
+// Frame types and flags that decide where a payload's fields are.
+const (
+	frameData         = 0x0
+	frameHeaders      = 0x1
+	framePriority     = 0x2
+	frameRSTStream    = 0x3
+	frameSettings     = 0x4
+	framePushPromise  = 0x5
+	framePing         = 0x6
+	frameGoAway       = 0x7
+	frameWindowUpdate = 0x8
+
+	flagPadded   = 0x8
+	flagPriority = 0x20
+)
+
+// A field is a value inside a frame's wire encoding. offset counts from the
+// start of the frame header, and stream marks fields holding a stream ID.
+// The length field is never listed, so a mutated frame still says how long
+// it is.
+type field struct {
+	offset, size int
+	stream       bool
+}
+
+// fields lists the header fields of frame and the payload fields its type
+// defines, as far as the payload is long enough to hold them. Raw data has
+// none.
+func fields(frame replay.RawFrame) []field {
+	if frame.Raw {
+		return nil
+	}
+	fs := []field{{offset: 3, size: 1}, {offset: 4, size: 1}, {offset: 5, size: 4, stream: true}}
+	add := func(offset, size int, stream bool) {
+		if offset+size <= len(frame.Payload) {
+			fs = append(fs, field{offset: frameHeaderLen + offset, size: size, stream: stream})
+		}
+	}
+
+	pad := 0
+	if frame.Flags&flagPadded != 0 && (frame.FrameType == frameData || frame.FrameType == frameHeaders || frame.FrameType == framePushPromise) {
+		add(0, 1, false)
+		pad = 1
+	}
+
+	switch frame.FrameType {
+	case frameHeaders:
+		if frame.Flags&flagPriority != 0 {
+			add(pad, 4, true)
+			add(pad+4, 1, false)
+		}
+	case framePriority:
+		add(0, 4, true)
+		add(4, 1, false)
+	case frameRSTStream, frameWindowUpdate:
+		add(0, 4, false)
+	case frameSettings:
+		for i := 0; i+6 <= len(frame.Payload); i += 6 {
+			add(i, 2, false)
+			add(i+2, 4, false)
+		}
+	case framePushPromise:
+		add(pad, 4, true)
+	case framePing:
+		add(0, 8, false)
+	case frameGoAway:
+		add(0, 4, true)
+		add(4, 4, false)
+	}
+	return fs
+}
+
+// interestingValues are the values worth trying in a field of each size:
+// the edges of the field, flow control and frame size limits, and the
+// defined error codes.
+var interestingValues = map[int][]uint64{
+	1: {0, 1, 0x7f, 0x80, 0xff},
+	2: {0, 1, 2, 3, 4, 5, 6, 7, 8, 0x7fff, 0x8000, 0xffff},
+	4: {
+		0, 1, 2, 0xd, 0xe,
+		0x3fff, 0x4000, 0x4001,
+		0xffff, 0x10000,
+		0xffffff, 0x1000000,
+		0x7ffffffe, 0x7fffffff, 0x80000000, 0xffffffff,
+	},
+	8: {0, 1, 0x7fffffffffffffff, 0xffffffffffffffff},
+}
+
+func getField(b []byte, f field) uint64 {
+	switch f.size {
+	case 1:
+		return uint64(b[f.offset])
+	case 2:
+		return uint64(binary.BigEndian.Uint16(b[f.offset:]))
+	case 4:
+		return uint64(binary.BigEndian.Uint32(b[f.offset:]))
+	}
+	return binary.BigEndian.Uint64(b[f.offset:])
+}
+
+func setField(b []byte, f field, v uint64) {
+	switch f.size {
+	case 1:
+		b[f.offset] = byte(v)
+	case 2:
+		binary.BigEndian.PutUint16(b[f.offset:], uint16(v))
+	case 4:
+		binary.BigEndian.PutUint32(b[f.offset:], uint32(v))
+	default:
+		binary.BigEndian.PutUint64(b[f.offset:], v)
+	}
+}
+
+// editFrame hands edit the wire encoding of frame and returns the frame it
+// was left holding.
+func editFrame(frame replay.RawFrame, edit func(b []byte)) replay.RawFrame {
+	b := frame.Bytes()
+	edit(b)
+	return replay.RawFrame{
+		FrameType: b[3],
+		Flags:     b[4],
+		StreamID:  binary.BigEndian.Uint32(b[5:]),
+		Payload:   b[frameHeaderLen:],
+	}
+}
+
+func flipFieldBit(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i := r.Intn(len(frames))
+	fs := fields(frames[i])
+	if len(fs) == 0 {
+		return flipPayloadByte(r, frames)
+	}
+	f := fs[r.Intn(len(fs))]
+	frames[i] = editFrame(frames[i], func(b []byte) {
+		setField(b, f, getField(b, f)^1<<uint(r.Intn(f.size*8)))
+	})
+	return frames
+}
+
+func setInterestingValue(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i := r.Intn(len(frames))
+	fs := fields(frames[i])
+	if len(fs) == 0 {
+		return flipPayloadByte(r, frames)
+	}
+	f := fs[r.Intn(len(fs))]
+	values := interestingValues[f.size]
+	frames[i] = editFrame(frames[i], func(b []byte) {
+		setField(b, f, values[r.Intn(len(values))])
+	})
+	return frames
+}
+
+// swapFieldValues exchanges the values of two same sized fields, which may
+// be in different frames, such as two SETTINGS values or an error code and
+// a window increment.
+func swapFieldValues(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i, j := r.Intn(len(frames)), r.Intn(len(frames))
+	fi := fields(frames[i])
+	if len(fi) == 0 {
+		return frames
+	}
+	a := fi[r.Intn(len(fi))]
+	candidates := []field{}
+	for _, f := range fields(frames[j]) {
+		if f.size == a.size {
+			candidates = append(candidates, f)
+		}
+	}
+	if len(candidates) == 0 {
+		return frames
+	}
+	c := candidates[r.Intn(len(candidates))]
+
+	va, vc := getField(frames[i].Bytes(), a), getField(frames[j].Bytes(), c)
+	frames[i] = editFrame(frames[i], func(b []byte) { setField(b, a, vc) })
+	frames[j] = editFrame(frames[j], func(b []byte) { setField(b, c, va) })
+	return frames
+}
+
+// remapStreamID moves every reference to one stream, in frame headers as
+// well as in PRIORITY dependencies, promised IDs and GOAWAY's last stream,
+// onto another stream ID.
+func remapStreamID(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	ids := []uint32{}
+	seen := map[uint32]bool{}
+	for _, frame := range frames {
+		b := frame.Bytes()
+		for _, f := range fields(frame) {
+			id := uint32(getField(b, f)) & 0x7fffffff
+			if f.stream && !seen[id] {
+				seen[id] = true
+				ids = append(ids, id)
+			}
+		}
+	}
+
+	if len(ids) == 0 {
+		return frames
+	}
+	from := ids[r.Intn(len(ids))]
+	to := []uint32{
+		ids[r.Intn(len(ids))],
+		from + 2,
+		from ^ 1,
+		0,
+		0x7fffffff,
+		uint32(r.Int31()),
+	}[r.Intn(6)]
+
+	for i, frame := range frames {
+		fs := fields(frame)
+		if len(fs) == 0 {
+			continue
+		}
+		frames[i] = editFrame(frame, func(b []byte) {
+			for _, f := range fs {
+				v := uint32(getField(b, f))
+				if f.stream && v&0x7fffffff == from {
+					setField(b, f, uint64(v&0x80000000|to))
+				}
+			}
+		})
+	}
+	return frames
+}
@@ -0,0 +1,240 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package mutate
+
+import (
+	"bytes"
+	"encoding/binary"
+	"math/rand"
+	"testing"
+
+	"github.com/c0nrad/http2fuzz/replay"
+
+	"github.com/bradfitz/http2"
+)
+
+// capture returns the frame write makes.
+func capture(t *testing.T, write func(f *http2.Framer) error) replay.RawFrame {
+	t.Helper()
+	var buf bytes.Buffer
+	framer := http2.NewFramer(&buf, nil)
+	framer.AllowIllegalWrites = true
+	if err := write(framer); err != nil {
+		t.Fatal(err)
+	}
+	b := buf.Bytes()
+	return replay.RawFrame{FrameType: b[3], Flags: b[4], StreamID: binary.BigEndian.Uint32(b[5:]), Payload: b[frameHeaderLen:]}
+}
+
+func raw(frameType, flags uint8, payload ...byte) func(f *http2.Framer) error {
+	return func(f *http2.Framer) error {
+		return f.WriteRawFrame(http2.FrameType(frameType), http2.Flags(flags), 1, payload)
+	}
+}
+
+// A wantField is a payload field and the value the frame holds in it.
+type wantField struct {
+	offset, size int
+	stream       bool
+	value        uint64
+}
+
+func TestFields(t *testing.T) {
+	block := []byte("block")
+	tests := []struct {
+		name  string
+		write func(f *http2.Framer) error
+		want  []wantField
+	}{
+		{"data", func(f *http2.Framer) error { return f.WriteData(1, false, []byte("abc")) }, nil},
+		{"data-padded", raw(frameData, flagPadded, 3, 'a', 0, 0, 0), []wantField{{9, 1, false, 3}}},
+		{"headers", func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block, EndHeaders: true})
+		}, nil},
+		{"headers-padded", func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block, EndHeaders: true, PadLength: 7})
+		}, []wantField{{9, 1, false, 7}}},
+		{"headers-priority", func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block, EndHeaders: true,
+				Priority: http2.PriorityParam{StreamDep: 5, Exclusive: true, Weight: 200}})
+		}, []wantField{{9, 4, true, 0x80000005}, {13, 1, false, 200}}},
+		{"headers-padded-priority", func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: block, EndHeaders: true, PadLength: 2,
+				Priority: http2.PriorityParam{StreamDep: 5, Weight: 16}})
+		}, []wantField{{9, 1, false, 2}, {10, 4, true, 5}, {14, 1, false, 16}}},
+		{"headers-priority-short", raw(frameHeaders, flagPriority, 0, 0, 5), nil},
+		{"headers-padded-priority-short", raw(frameHeaders, flagPadded|flagPriority, 0, 0, 0, 0, 5), []wantField{{9, 1, false, 0}, {10, 4, true, 5}}},
+		{"priority", func(f *http2.Framer) error {
+			return f.WritePriority(1, http2.PriorityParam{StreamDep: 3, Weight: 9})
+		}, []wantField{{9, 4, true, 3}, {13, 1, false, 9}}},
+		{"priority-short", raw(framePriority, 0, 0, 0, 3), nil},
+		{"rst-stream", func(f *http2.Framer) error { return f.WriteRSTStream(1, http2.ErrCodeCancel) }, []wantField{{9, 4, false, 8}}},
+		{"settings", func(f *http2.Framer) error {
+			return f.WriteSettings(http2.Setting{ID: http2.SettingMaxFrameSize, Val: 1 << 20}, http2.Setting{ID: 0xabcd, Val: 7})
+		}, []wantField{{9, 2, false, 5}, {11, 4, false, 1 << 20}, {15, 2, false, 0xabcd}, {17, 4, false, 7}}},
+		{"settings-partial", raw(frameSettings, 0, 0, 3, 0, 0, 0, 100, 0, 4), []wantField{{9, 2, false, 3}, {11, 4, false, 100}}},
+		{"settings-ack", func(f *http2.Framer) error { return f.WriteSettingsAck() }, nil},
+		{"push-promise", func(f *http2.Framer) error {
+			return f.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 4, BlockFragment: block, EndHeaders: true})
+		}, []wantField{{9, 4, true, 4}}},
+		{"push-promise-padded", func(f *http2.Framer) error {
+			return f.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 4, BlockFragment: block, EndHeaders: true, PadLength: 1})
+		}, []wantField{{9, 1, false, 1}, {10, 4, true, 4}}},
+		{"ping", func(f *http2.Framer) error {
+			return f.WritePing(false, [8]byte{1, 2, 3, 4, 5, 6, 7, 8})
+		}, []wantField{{9, 8, false, 0x0102030405060708}}},
+		{"goaway", func(f *http2.Framer) error { return f.WriteGoAway(9, http2.ErrCodeProtocol, []byte("debug")) },
+			[]wantField{{9, 4, true, 9}, {13, 4, false, 1}}},
+		{"goaway-short", raw(frameGoAway, 0, 0, 0, 0, 9, 0, 0), []wantField{{9, 4, true, 9}}},
+		{"window-update", func(f *http2.Framer) error { return f.WriteWindowUpdate(1, 1000) }, []wantField{{9, 4, false, 1000}}},
+		{"unknown", raw(0xa, 0xff, 1, 2, 3, 4, 5, 6, 7, 8), nil},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			frame := capture(t, tt.write)
+			b := frame.Bytes()
+			fs := fields(frame)
+
+			// The header fields come first, and the length is never one.
+			header := []wantField{{3, 1, false, uint64(frame.FrameType)}, {4, 1, false, uint64(frame.Flags)}, {5, 4, true, uint64(frame.StreamID)}}
+			want := append(header, tt.want...)
+			if len(fs) != len(want) {
+				t.Fatalf("got %d fields %+v, want %+v", len(fs), fs, want)
+			}
+			for i, f := range fs {
+				w := want[i]
+				if f.offset != w.offset || f.size != w.size || f.stream != w.stream {
+					t.Errorf("field %d is %+v, want offset %d size %d stream %v", i, f, w.offset, w.size, w.stream)
+					continue
+				}
+				if v := getField(b, f); v != w.value {
+					t.Errorf("field %d holds %#x, want %#x", i, v, w.value)
+				}
+			}
+		})
+	}
+
+	if fs := fields(replay.RawFrame{Raw: true, Payload: []byte("PRI * HTTP/2.0")}); fs != nil {
+		t.Errorf("raw data has fields %+v", fs)
+	}
+}
+
+// streamFrames refers to streams 1, 3 and 5 in every place a stream ID can
+// be, and holds 1 and 3 in fields that aren't stream IDs.
+func streamFrames(t *testing.T) []replay.RawFrame {
+	t.Helper()
+	return []replay.RawFrame{
+		capture(t, func(f *http2.Framer) error {
+			return f.WriteHeaders(http2.HeadersFrameParam{StreamID: 1, BlockFragment: []byte{3}, EndHeaders: true,
+				Priority: http2.PriorityParam{StreamDep: 3, Exclusive: true, Weight: 1}})
+		}),
+		capture(t, func(f *http2.Framer) error { return f.WritePriority(3, http2.PriorityParam{StreamDep: 1, Weight: 3}) }),
+		capture(t, func(f *http2.Framer) error {
+			return f.WritePushPromise(http2.PushPromiseParam{StreamID: 1, PromiseID: 5, BlockFragment: []byte{1}, EndHeaders: true})
+		}),
+		capture(t, func(f *http2.Framer) error { return f.WriteData(5, true, []byte{0, 0, 0, 1}) }),
+		capture(t, func(f *http2.Framer) error { return f.WriteWindowUpdate(3, 1) }),
+		capture(t, func(f *http2.Framer) error { return f.WriteRSTStream(1, http2.ErrCode(3)) }),
+		capture(t, func(f *http2.Framer) error { return f.WriteSettings(http2.Setting{ID: 3, Val: 1}) }),
+		capture(t, func(f *http2.Framer) error { return f.WriteGoAway(3, http2.ErrCode(1), nil) }),
+		{Raw: true, Payload: []byte{0, 0, 0, 1}},
+	}
+}
+
+// change is a field whose value a mutation changed.
+type change struct {
+	frame    int
+	field    field
+	old, new uint64
+}
+
+// changes compares before and after field by field, and fails if anything
+// outside the fields changed.
+func changes(t *testing.T, before, after []replay.RawFrame) []change {
+	t.Helper()
+	if len(before) != len(after) {
+		t.Fatalf("%d frames became %d", len(before), len(after))
+	}
+	cs := []change{}
+	for i := range before {
+		ob, nb := before[i].Bytes(), after[i].Bytes()
+		if len(ob) != len(nb) {
+			t.Fatalf("frame %d changed length", i)
+		}
+		masked := append([]byte{}, nb...)
+		for _, f := range fields(before[i]) {
+			if old, new := getField(ob, f), getField(nb, f); old != new {
+				cs = append(cs, change{i, f, old, new})
+			}
+			setField(masked, f, getField(ob, f))
+		}
+		if !bytes.Equal(masked, ob) {
+			t.Fatalf("frame %d changed outside its fields:\n%x\n%x", i, ob, nb)
+		}
+	}
+	return cs
+}
+
+func cloneFrames(frames []replay.RawFrame) []replay.RawFrame {
+	out := make([]replay.RawFrame, len(frames))
+	for i, frame := range frames {
+		out[i] = frame
+		out[i].Payload = append([]byte{}, frame.Payload...)
+	}
+	return out
+}
+
+func TestRemapStreamID(t *testing.T) {
+	for seed := int64(0); seed < 300; seed++ {
+		before := streamFrames(t)
+		after := remapStreamID(rand.New(rand.NewSource(seed)), cloneFrames(before))
+		cs := changes(t, before, after)
+		if len(cs) == 0 {
+			continue
+		}
+
+		from, to := uint32(cs[0].old)&0x7fffffff, uint32(cs[0].new)&0x7fffffff
+		for _, c := range cs {
+			if !c.field.stream {
+				t.Fatalf("seed %d: %+v isn't a stream ID", seed, c)
+			}
+			if uint32(c.old)&0x7fffffff != from || uint32(c.new) != uint32(c.old)&0x80000000|to {
+				t.Fatalf("seed %d: %+v, want %d moved to %d with the reserved bit kept", seed, c, from, to)
+			}
+		}
+		// Every reference to from moved.
+		for i, frame := range after {
+			b := frame.Bytes()
+			for _, f := range fields(frame) {
+				if f.stream && uint32(getField(b, f))&0x7fffffff == from && from != to {
+					t.Fatalf("seed %d: frame %d still refers to stream %d at %d", seed, i, from, f.offset)
+				}
+			}
+		}
+	}
+}
+
+func TestSwapFieldValues(t *testing.T) {
+	swapped := 0
+	for seed := int64(0); seed < 300; seed++ {
+		before := streamFrames(t)
+		after := swapFieldValues(rand.New(rand.NewSource(seed)), cloneFrames(before))
+		cs := changes(t, before, after)
+		switch len(cs) {
+		case 0:
+		case 2:
+			a, c := cs[0], cs[1]
+			if a.field.size != c.field.size || a.old != c.new || a.new != c.old {
+				t.Fatalf("seed %d: %+v and %+v aren't a swap", seed, a, c)
+			}
+			swapped++
+		default:
+			t.Fatalf("seed %d: %d fields changed: %+v", seed, len(cs), cs)
+		}
+	}
+	if swapped == 0 {
+		t.Error("nothing was ever swapped")
+	}
+}
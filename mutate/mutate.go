@@ -0,0 +1,142 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package mutate
+
+import (
+	"math/rand"
+	"sort"
+
+	"github.com/c0nrad/http2fuzz/fuzzer"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// MaxFrames caps how long a mutated sequence may grow.
+var MaxFrames = 64
+
+// generatorNames is fuzzer.FrameGenerators in a fixed order, so that a given
+// r always picks the same generator.
+var generatorNames []string
+
+func init() {
+	for name := range fuzzer.FrameGenerators {
+		generatorNames = append(generatorNames, name)
+	}
+	sort.Strings(generatorNames)
+}
+
+// Generate builds a fresh sequence of up to n frames from the strategies'
+// frame generators.
+func Generate(r *rand.Rand, n int) []replay.RawFrame {
+	frames := []replay.RawFrame{}
+	for i := r.Intn(n) + 1; i > 0; i-- {
+		frames = append(frames, generate(r))
+	}
+	return frames
+}
+
+// FromBytes builds frames from any of the generators until data runs out,
+// with data picking both the generator and what it builds.
+func FromBytes(data []byte) []replay.RawFrame {
+	r, more := fuzzer.BytesRand(data)
+	frames := []replay.RawFrame{}
+	for more() && len(frames) < MaxFrames {
+		frames = append(frames, generate(r))
+	}
+	return frames
+}
+
+func generate(r *rand.Rand) replay.RawFrame {
+	return fuzzer.FrameGenerators[generatorNames[r.Intn(len(generatorNames))]](r)
+}
+
+// An operator mutates a sequence that has at least one frame.
+type operator func(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame
+
+var operators = []operator{
+	insertFrame,
+	replaceFrame,
+	deleteFrame,
+	duplicateFrame,
+	swapFrames,
+	flipPayloadByte,
+	flipFlag,
+}
+
+// Sequence returns a copy of frames with a few random mutations applied.
+// frames itself is left alone.
+func Sequence(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	return apply(r, frames, operators)
+}
+
+func apply(r *rand.Rand, frames []replay.RawFrame, ops []operator) []replay.RawFrame {
+	mutated := make([]replay.RawFrame, len(frames))
+	for i, frame := range frames {
+		frame.Payload = append([]byte{}, frame.Payload...)
+		mutated[i] = frame
+	}
+
+	for i := r.Intn(4) + 1; i > 0; i-- {
+		if len(mutated) == 0 {
+			mutated = append(mutated, generate(r))
+			continue
+		}
+		mutated = ops[r.Intn(len(ops))](r, mutated)
+	}
+	// Sequences that were already longer, like captured sessions, may keep
+	// their length.
+	limit := MaxFrames
+	if len(frames) > limit {
+		limit = len(frames)
+	}
+	if len(mutated) > limit {
+		mutated = mutated[:limit]
+	}
+	return mutated
+}
+
+func insertFrame(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i := r.Intn(len(frames) + 1)
+	frames = append(frames, replay.RawFrame{})
+	copy(frames[i+1:], frames[i:])
+	frames[i] = generate(r)
+	return frames
+}
+
+func replaceFrame(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	frames[r.Intn(len(frames))] = generate(r)
+	return frames
+}
+
+func deleteFrame(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i := r.Intn(len(frames))
+	return append(frames[:i], frames[i+1:]...)
+}
+
+func duplicateFrame(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i := r.Intn(len(frames))
+	frame := frames[i]
+	frame.Payload = append([]byte{}, frame.Payload...)
+	return append(frames, frame)
+}
+
+func swapFrames(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	i, j := r.Intn(len(frames)), r.Intn(len(frames))
+	frames[i], frames[j] = frames[j], frames[i]
+	return frames
+}
+
+func flipPayloadByte(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	frame := &frames[r.Intn(len(frames))]
+	if len(frame.Payload) == 0 {
+		return flipFlag(r, frames)
+	}
+	frame.Payload[r.Intn(len(frame.Payload))] ^= 1 << uint(r.Intn(8))
+	return frames
+}
+
+func flipFlag(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	frames[r.Intn(len(frames))].Flags ^= 1 << uint(r.Intn(8))
+	return frames
+}
@@ -0,0 +1,123 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package mutate
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"log/slog"
+	"math/rand"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/fuzzer"
+	"github.com/c0nrad/http2fuzz/replay"
+)
+
+// A Seed is a recorded session, one replay file's worth of frames.
+type Seed struct {
+	Name   string
+	Frames []replay.RawFrame
+}
+
+// LoadSeeds reads path as a replay file, or every .json replay file in it
+// if it is a directory. Files without any frames are left out.
+func LoadSeeds(path string) ([]Seed, error) {
+	info, err := os.Stat(path)
+	if err != nil {
+		return nil, err
+	}
+
+	files := []string{path}
+	if info.IsDir() {
+		entries, err := ioutil.ReadDir(path)
+		if err != nil {
+			return nil, err
+		}
+		files = nil
+		for _, entry := range entries {
+			if !entry.IsDir() && strings.HasSuffix(entry.Name(), ".json") {
+				files = append(files, filepath.Join(path, entry.Name()))
+			}
+		}
+	}
+
+	seeds := []Seed{}
+	for _, file := range files {
+		frames, err := replay.LoadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		if len(frames) > 0 {
+			seeds = append(seeds, Seed{Name: file, Frames: frames})
+		}
+	}
+	return seeds, nil
+}
+
+// structuredOperators know where the fields of each frame type are, so
+// recorded sessions keep most of their shape and only a few values change.
+var structuredOperators = []operator{
+	flipFieldBit,
+	setInterestingValue,
+	swapFieldValues,
+	remapStreamID,
+	insertFrame,
+	deleteFrame,
+	duplicateFrame,
+}
+
+// Structured returns a copy of frames with a few field-aware mutations
+// applied. frames itself is left alone.
+func Structured(r *rand.Rand, frames []replay.RawFrame) []replay.RawFrame {
+	return apply(r, frames, structuredOperators)
+}
+
+// Run replays mutated copies of the sessions in config.SeedPath against
+// config.Target, each on a fresh Connection, until it can no longer
+// connect.
+func Run() error {
+	seeds, err := LoadSeeds(config.SeedPath)
+	if err != nil {
+		return err
+	}
+	if len(seeds) == 0 {
+		return errors.New("no frames found in " + config.SeedPath)
+	}
+	slog.Info("Loaded seeds", "sessions", len(seeds), "path", config.SeedPath)
+
+	r := rand.New(rand.NewSource(time.Now().UnixNano()))
+	failures := 0
+	for {
+		if fuzzer.TargetSupervisor != nil {
+			fuzzer.TargetSupervisor.WaitReady()
+		}
+
+		seed := seeds[r.Intn(len(seeds))]
+		frames := Structured(r, seed.Frames)
+		conn := fuzzer.NewReplayConnection(config.Target, config.IsTLS(), frames)
+		if conn.Err != nil {
+			failures++
+			if failures > config.MaxRestartAttempts {
+				return fmt.Errorf("can't connect to %s: %v", config.Target, conn.Err)
+			}
+			time.Sleep(config.RestartDelay)
+			continue
+		}
+		failures = 0
+
+		if err := conn.ReplayFrames(frames); err == nil {
+			time.Sleep(config.FuzzDelay)
+		}
+		if conn.Err != nil {
+			slog.Info("Mutated session ended", "conn", conn.ID, "strategy", "seeds", "seed", seed.Name, "err", conn.Err)
+		}
+		conn.Raw.Close()
+	}
+}
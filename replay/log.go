@@ -0,0 +1,129 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package replay
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/util"
+)
+
+type HeaderField struct {
+	Name      string
+	Value     string
+	Sensitive bool `json:",omitempty"`
+}
+
+// A LogEntry is a frame sent or received on a connection. Sent frames are
+// written as RawFrame lines, or RawData lines for bytes sent outside of a
+// frame, so a log can be replayed like any replay file, and received frames
+// as ReceivedFrame lines, which replaying skips.
+type LogEntry struct {
+	Time     time.Time
+	Received bool
+	Frame    RawFrame
+	// Summary describes a received frame, and Headers holds the header
+	// fields decoded from a received HEADERS frame.
+	Summary string
+	Headers []HeaderField
+}
+
+func (e LogEntry) ToJSON() []byte {
+	if e.Frame.Raw && !e.Received {
+		return util.ToJSON(map[string]interface{}{
+			"FrameMethod": "RawData",
+			"Time":        e.Time.Format(time.RFC3339Nano),
+			"Payload":     util.ToBase64(e.Frame.Payload),
+		})
+	}
+	method := "RawFrame"
+	if e.Received {
+		method = "ReceivedFrame"
+	}
+	entry := map[string]interface{}{
+		"FrameMethod": method,
+		"Time":        e.Time.Format(time.RFC3339Nano),
+		"FrameType":   e.Frame.FrameType,
+		"Flags":       e.Frame.Flags,
+		"StreamID":    e.Frame.StreamID,
+		"Payload":     util.ToBase64(e.Frame.Payload),
+	}
+	if e.Summary != "" {
+		entry["Summary"] = e.Summary
+	}
+	if len(e.Headers) > 0 {
+		entry["Headers"] = e.Headers
+	}
+	return util.ToJSON(entry)
+}
+
+// SaveLog writes entries to filename, one per line.
+func SaveLog(filename string, entries []LogEntry) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, entry := range entries {
+		if _, err := f.Write(append(entry.ToJSON(), '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+var sessionCount uint64
+
+// A SessionLog records both directions of one connection as they happen.
+type SessionLog struct {
+	Filename string
+
+	mu   sync.Mutex
+	file *os.File
+}
+
+// NewSessionLog creates a log in dir named after the time and a counter.
+func NewSessionLog(dir string) (*SessionLog, error) {
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return nil, err
+	}
+	name := fmt.Sprintf("session-%s-%d.json", time.Now().Format("20060102-150405"), atomic.AddUint64(&sessionCount, 1))
+	filename := filepath.Join(dir, name)
+	f, err := os.Create(filename)
+	if err != nil {
+		return nil, err
+	}
+	return &SessionLog{Filename: filename, file: f}, nil
+}
+
+// Add writes entry to the log. Entries added after Close are dropped.
+func (l *SessionLog) Add(entry LogEntry) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return
+	}
+	if _, err := l.file.Write(append(entry.ToJSON(), '\n')); err != nil {
+		l.file.Close()
+		l.file = nil
+	}
+}
+
+func (l *SessionLog) Close() error {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if l.file == nil {
+		return nil
+	}
+	err := l.file.Close()
+	l.file = nil
+	return err
+}
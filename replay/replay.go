@@ -4,14 +4,29 @@
 // http2fuzz - HTTP/2 Fuzzer
 package replay
 
-import "github.com/c0nrad/http2fuzz/util"
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"strings"
+	"sync"
 
-import "os"
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/util"
+)
 
 var ReplayWriteFile *os.File
+var openReplayWriteFile sync.Once
 
-func init() {
-	ReplayWriteFile = OpenWriteFile("replay.json")
+// replayWriteFile creates the replay file on first use, so that modes which
+// never write frames can still read an existing replay.json.
+func replayWriteFile() *os.File {
+	openReplayWriteFile.Do(func() {
+		ReplayWriteFile = OpenWriteFile(config.ReplayWriteFilename)
+	})
+	return ReplayWriteFile
 }
 
 type ReplayHandler struct {
@@ -27,30 +42,157 @@ func OpenWriteFile(filename string) *os.File {
 }
 
 func TruncateFile() {
-	ReplayWriteFile.Truncate(0)
-	ReplayWriteFile.Seek(0, 0)
+	f := replayWriteFile()
+	f.Truncate(0)
+	f.Seek(0, 0)
 }
 
 func WriteToReplayFile(data []byte) {
 	data = append(data, '\n')
-	_, err := ReplayWriteFile.Write(data)
+	f := replayWriteFile()
+	_, err := f.Write(data)
 	if err != nil {
 		panic(err)
 	}
-	ReplayWriteFile.Sync()
+	f.Sync()
 }
 
-func SaveRawFrame(frameType, flags uint8, streamID uint32, payload []byte) {
-	frame := map[string]interface{}{
+type RawFrame struct {
+	FrameType uint8
+	Flags     uint8
+	StreamID  uint32
+	Payload   []byte
+	// Raw is set for bytes written outside of any frame, such as a mangled
+	// connection preface. Payload is all there is, and goes out as is.
+	Raw bool
+}
+
+func (frame RawFrame) ToJSON() []byte {
+	if frame.Raw {
+		return util.ToJSON(map[string]interface{}{
+			"FrameMethod": "RawData",
+			"Payload":     util.ToBase64(frame.Payload),
+		})
+	}
+	return util.ToJSON(map[string]interface{}{
 		"FrameMethod": "RawFrame",
-		"FrameType":   frameType,
-		"Flags":       flags,
-		"StreamID":    streamID,
-		"Payload":     util.ToBase64(payload),
+		"FrameType":   frame.FrameType,
+		"Flags":       frame.Flags,
+		"StreamID":    frame.StreamID,
+		"Payload":     util.ToBase64(frame.Payload),
+	})
+}
+
+// Bytes serializes the frame, header included, as it goes on the wire.
+func (frame RawFrame) Bytes() []byte {
+	if frame.Raw {
+		return append([]byte{}, frame.Payload...)
+	}
+	length := len(frame.Payload)
+	b := make([]byte, 9, 9+length)
+	b[0], b[1], b[2] = byte(length>>16), byte(length>>8), byte(length)
+	b[3] = frame.FrameType
+	b[4] = frame.Flags
+	binary.BigEndian.PutUint32(b[5:], frame.StreamID)
+	return append(b, frame.Payload...)
+}
+
+func SaveRawFrame(frameType, flags uint8, streamID uint32, payload []byte) {
+	frame := RawFrame{FrameType: frameType, Flags: flags, StreamID: streamID, Payload: payload}
+	WriteToReplayFile(frame.ToJSON())
+}
+
+// SaveRawData saves bytes that were written outside of any frame.
+func SaveRawData(data []byte) {
+	WriteToReplayFile(RawFrame{Raw: true, Payload: data}.ToJSON())
+}
+
+// Session collects the frames sent on one connection so they can be saved
+// as a replay file of their own.
+type Session struct {
+	Frames []RawFrame
+}
+
+func (s *Session) Add(frameType, flags uint8, streamID uint32, payload []byte) {
+	s.Frames = append(s.Frames, RawFrame{FrameType: frameType, Flags: flags, StreamID: streamID, Payload: payload})
+}
+
+func (s *Session) Save(filename string) error {
+	f, err := os.Create(filename)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+
+	for _, frame := range s.Frames {
+		if _, err := f.Write(append(frame.ToJSON(), '\n')); err != nil {
+			return err
+		}
+	}
+	return f.Sync()
+}
+
+// History keeps the most recent frames sent and received across all
+// connections, so a crash can be tied to the frames that led up to it.
+type History struct {
+	mu      sync.Mutex
+	entries []LogEntry
+	size    int
+}
+
+func NewHistory(size int) *History {
+	return &History{size: size}
+}
+
+func (h *History) Add(entry LogEntry) {
+	h.mu.Lock()
+	h.entries = append(h.entries, entry)
+	if len(h.entries) > h.size {
+		h.entries = h.entries[len(h.entries)-h.size:]
 	}
+	h.mu.Unlock()
+}
+
+// Drain returns the entries seen since the last Drain, oldest first.
+func (h *History) Drain() []LogEntry {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	entries := h.entries
+	h.entries = nil
+	return entries
+}
 
-	out := util.ToJSON(frame)
-	WriteToReplayFile(out)
+// LoadFile reads the RawFrame and RawData lines of a replay file. Lines with
+// any other FrameMethod are skipped.
+func LoadFile(filename string) ([]RawFrame, error) {
+	data, err := ioutil.ReadFile(filename)
+	if err != nil {
+		return nil, err
+	}
+
+	frames := []RawFrame{}
+	for i, line := range strings.Split(string(data), "\n") {
+		if strings.TrimSpace(line) == "" {
+			continue
+		}
+		var frame struct {
+			FrameMethod string
+			FrameType   uint8
+			Flags       uint8
+			StreamID    uint32
+			Payload     []byte
+		}
+		if err := json.Unmarshal([]byte(line), &frame); err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", filename, i+1, err)
+		}
+		switch frame.FrameMethod {
+		case "RawFrame":
+			frames = append(frames, RawFrame{FrameType: frame.FrameType, Flags: frame.Flags, StreamID: frame.StreamID, Payload: frame.Payload})
+		case "RawData":
+			frames = append(frames, RawFrame{Payload: frame.Payload, Raw: true})
+		}
+	}
+	return frames, nil
 }
 
 // func RunReplay(c *fuzzer.Connection, frames []string) {
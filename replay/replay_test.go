@@ -0,0 +1,36 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package replay
+
+import (
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestLoadFileRawData(t *testing.T) {
+	entries := []LogEntry{
+		{Time: time.Now(), Frame: RawFrame{Payload: []byte("PRI * HTTP/2.0\r\n"), Raw: true}},
+		{Time: time.Now(), Frame: RawFrame{FrameType: 4, Payload: []byte{0, 3, 0, 0, 0, 100}}},
+		{Time: time.Now(), Received: true, Frame: RawFrame{FrameType: 7, Payload: make([]byte, 8)}},
+		{Time: time.Now(), Frame: RawFrame{FrameType: 6, Flags: 1, Payload: []byte("12345678")}},
+	}
+	filename := filepath.Join(t.TempDir(), "session.json")
+	if err := SaveLog(filename, entries); err != nil {
+		t.Fatal(err)
+	}
+	frames, err := LoadFile(filename)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []RawFrame{entries[0].Frame, entries[1].Frame, entries[3].Frame}
+	if !reflect.DeepEqual(frames, want) {
+		t.Fatalf("got %+v, want %+v", frames, want)
+	}
+	if got := string(frames[0].Bytes()); got != "PRI * HTTP/2.0\r\n" {
+		t.Errorf("raw data serializes as %q", got)
+	}
+}
@@ -0,0 +1,217 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package supervisor
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+// Number of stderr lines kept for the crash report.
+const stderrTail = 200
+
+// sanitizerMarkers are stderr prefixes or substrings that name the reason a
+// target died. The first one seen wins.
+var sanitizerMarkers = []struct {
+	Marker string
+	Reason string
+}{
+	{"ERROR: AddressSanitizer", "AddressSanitizer"},
+	{"ERROR: LeakSanitizer", "LeakSanitizer"},
+	{"ERROR: MemorySanitizer", "MemorySanitizer"},
+	{"WARNING: ThreadSanitizer", "ThreadSanitizer"},
+	{"UndefinedBehaviorSanitizer", "UndefinedBehaviorSanitizer"},
+	{"panic: ", "Go panic"},
+	{"fatal error: ", "Go fatal error"},
+	{": runtime error: ", "UndefinedBehaviorSanitizer"},
+}
+
+// Crash describes how a target process died.
+type Crash struct {
+	Time     time.Time
+	Pid      int
+	Uptime   time.Duration
+	ExitCode int
+	Signal   string
+	Reason   string
+	PeakRSS  uint64
+	Stderr   []string
+}
+
+func (c Crash) String() string {
+	how := fmt.Sprintf("exit code %d", c.ExitCode)
+	if c.Signal != "" {
+		how = "signal " + c.Signal
+	}
+	if c.Reason != "" {
+		how = c.Reason + ", " + how
+	}
+	return fmt.Sprintf("pid %d died after %v (%s, peak RSS %d kB)", c.Pid, c.Uptime.Round(time.Millisecond), how, c.PeakRSS/1024)
+}
+
+// Process is one run of the server under test.
+type Process struct {
+	Cmd     *exec.Cmd
+	Started time.Time
+	MaxRSS  uint64
+
+	exited chan struct{}
+
+	mu      sync.Mutex
+	crash   Crash
+	stderr  []string
+	reason  string
+	peakRSS uint64
+}
+
+// Start launches command. Its stdout and stderr are passed through, and
+// stderr is also scanned for sanitizer and Go panic reports. If maxRSS is
+// non-zero the process is killed once its resident set grows past it.
+func Start(command []string, maxRSS uint64) (*Process, error) {
+	if len(command) == 0 {
+		return nil, fmt.Errorf("no target command")
+	}
+	cmd := exec.Command(command[0], command[1:]...)
+	cmd.Stdout = os.Stdout
+	stderr, err := cmd.StderrPipe()
+	if err != nil {
+		return nil, err
+	}
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+
+	p := &Process{Cmd: cmd, Started: time.Now(), MaxRSS: maxRSS, exited: make(chan struct{})}
+	go func() {
+		scanner := bufio.NewScanner(stderr)
+		for scanner.Scan() {
+			p.onStderr(scanner.Text())
+		}
+		p.wait()
+	}()
+	go p.watchRSS()
+
+	return p, nil
+}
+
+func (p *Process) onStderr(line string) {
+	fmt.Fprintln(os.Stderr, line)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.stderr = append(p.stderr, line)
+	if len(p.stderr) > stderrTail {
+		p.stderr = p.stderr[len(p.stderr)-stderrTail:]
+	}
+	if p.reason != "" {
+		return
+	}
+	for _, m := range sanitizerMarkers {
+		if strings.Contains(line, m.Marker) {
+			p.reason = m.Reason
+			return
+		}
+	}
+}
+
+func (p *Process) wait() {
+	p.Cmd.Wait()
+
+	p.mu.Lock()
+	state := p.Cmd.ProcessState
+	p.crash = Crash{
+		Time:     time.Now(),
+		Pid:      p.Cmd.Process.Pid,
+		Uptime:   time.Since(p.Started),
+		ExitCode: state.ExitCode(),
+		Reason:   p.reason,
+		PeakRSS:  p.peakRSS,
+		Stderr:   p.stderr,
+	}
+	if ws, ok := state.Sys().(syscall.WaitStatus); ok && ws.Signaled() {
+		p.crash.Signal = ws.Signal().String()
+	}
+	p.mu.Unlock()
+
+	close(p.exited)
+}
+
+func (p *Process) watchRSS() {
+	ticker := time.NewTicker(time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-p.exited:
+			return
+		case <-ticker.C:
+		}
+
+		rss, ok := processRSS(p.Cmd.Process.Pid)
+		if !ok {
+			continue
+		}
+		p.mu.Lock()
+		if rss > p.peakRSS {
+			p.peakRSS = rss
+		}
+		overLimit := p.MaxRSS != 0 && rss > p.MaxRSS && p.reason == ""
+		if overLimit {
+			p.reason = fmt.Sprintf("RSS limit exceeded (%d kB)", rss/1024)
+		}
+		p.mu.Unlock()
+
+		if overLimit {
+			p.Kill()
+		}
+	}
+}
+
+// Exited is closed once the process has exited and Crash is filled in.
+func (p *Process) Exited() <-chan struct{} {
+	return p.exited
+}
+
+// Crash returns how the process died. Only valid once Exited is closed.
+func (p *Process) Crash() Crash {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return p.crash
+}
+
+// Kill stops the process and waits for it to be reaped.
+func (p *Process) Kill() {
+	p.Cmd.Process.Kill()
+	<-p.exited
+}
+
+// WaitForListen polls addr until it accepts TCP connections, the process
+// exits, or timeout passes.
+func (p *Process) WaitForListen(addr string, timeout time.Duration) error {
+	deadline := time.Now().Add(timeout)
+	for {
+		select {
+		case <-p.exited:
+			return fmt.Errorf("target exited before listening: %v", p.Crash())
+		default:
+		}
+
+		c, err := net.DialTimeout("tcp", addr, time.Second)
+		if err == nil {
+			c.Close()
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return fmt.Errorf("target never started listening: %v", err)
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+}
@@ -0,0 +1,14 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+
+//go:build !linux
+// +build !linux
+
+package supervisor
+
+// processRSS is only implemented on Linux.
+func processRSS(pid int) (uint64, bool) {
+	return 0, false
+}
@@ -0,0 +1,140 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package supervisor
+
+import (
+	"errors"
+	"log/slog"
+	"sync"
+	"time"
+)
+
+// How long a freshly started target gets to start listening.
+const listenTimeout = 10 * time.Second
+
+var errStopped = errors.New("supervisor stopped")
+
+// Supervisor keeps the server under test running. Whenever the process
+// exits it reports the crash and starts it again.
+type Supervisor struct {
+	Command      []string
+	Addr         string
+	MaxRSS       uint64
+	RestartDelay time.Duration
+	OnCrash      func(Crash)
+
+	Crashes  int
+	Restarts int
+
+	mu      sync.Mutex
+	proc    *Process
+	ready   chan struct{}
+	stopped bool
+}
+
+func New(command []string, addr string) *Supervisor {
+	return &Supervisor{Command: command, Addr: addr, ready: make(chan struct{})}
+}
+
+// Start launches the target and returns once it is listening on Addr.
+func (s *Supervisor) Start() error {
+	proc, err := s.launch()
+	if err != nil {
+		return err
+	}
+	go s.loop(proc)
+	return nil
+}
+
+func (s *Supervisor) launch() (*Process, error) {
+	proc, err := Start(s.Command, s.MaxRSS)
+	if err != nil {
+		return nil, err
+	}
+	slog.Info("Started target", "pid", proc.Cmd.Process.Pid, "cmd", s.Command)
+
+	if err := proc.WaitForListen(s.Addr, listenTimeout); err != nil {
+		proc.Kill()
+		return nil, err
+	}
+
+	s.mu.Lock()
+	if s.stopped {
+		// Stop came while the target was starting.
+		s.mu.Unlock()
+		proc.Kill()
+		return nil, errStopped
+	}
+	s.proc = proc
+	close(s.ready)
+	s.mu.Unlock()
+	return proc, nil
+}
+
+func (s *Supervisor) loop(proc *Process) {
+	for {
+		<-proc.Exited()
+
+		s.mu.Lock()
+		stopped := s.stopped
+		if !stopped {
+			s.ready = make(chan struct{})
+		}
+		s.mu.Unlock()
+		if stopped {
+			return
+		}
+
+		crash := proc.Crash()
+		s.mu.Lock()
+		s.Crashes++
+		s.mu.Unlock()
+		slog.Error("Target crashed", "crash", crash)
+		if s.OnCrash != nil {
+			s.OnCrash(crash)
+		}
+
+		for {
+			time.Sleep(s.RestartDelay)
+			s.mu.Lock()
+			stopped := s.stopped
+			if !stopped {
+				s.Restarts++
+			}
+			s.mu.Unlock()
+			if stopped {
+				return
+			}
+			var err error
+			if proc, err = s.launch(); err == nil {
+				break
+			}
+			if errors.Is(err, errStopped) {
+				return
+			}
+			slog.Error("Restarting target failed", "err", err)
+		}
+	}
+}
+
+// WaitReady blocks until the target is up and listening.
+func (s *Supervisor) WaitReady() {
+	s.mu.Lock()
+	ready := s.ready
+	s.mu.Unlock()
+	<-ready
+}
+
+// Stop kills the target without reporting it as a crash, and keeps it from
+// being started again.
+func (s *Supervisor) Stop() {
+	s.mu.Lock()
+	s.stopped = true
+	proc := s.proc
+	s.mu.Unlock()
+	if proc != nil {
+		proc.Kill()
+	}
+}
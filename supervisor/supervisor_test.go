@@ -0,0 +1,172 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package supervisor
+
+import (
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// TestStub isn't a test. Run as a target, it listens on
+// SUPERVISOR_STUB_ADDR until it's killed. If SUPERVISOR_STUB_ONCE names a
+// file that exists it exits 1 instead, and otherwise creates it, so only the
+// first run comes up. SUPERVISOR_STUB_DELAY holds off the listening.
+func TestStub(t *testing.T) {
+	addr := os.Getenv("SUPERVISOR_STUB_ADDR")
+	if addr == "" {
+		t.Skip("only runs as a target")
+	}
+	if once := os.Getenv("SUPERVISOR_STUB_ONCE"); once != "" {
+		if _, err := os.Stat(once); err == nil {
+			os.Exit(1)
+		}
+		os.WriteFile(once, nil, 0644)
+	}
+	if delay, err := time.ParseDuration(os.Getenv("SUPERVISOR_STUB_DELAY")); err == nil {
+		time.Sleep(delay)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		os.Exit(2)
+	}
+	for {
+		c, err := l.Accept()
+		if err != nil {
+			os.Exit(3)
+		}
+		c.Close()
+	}
+}
+
+// stub returns a supervisor for a TestStub target on a free port.
+func stub(t *testing.T) *Supervisor {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := l.Addr().String()
+	l.Close()
+	t.Setenv("SUPERVISOR_STUB_ADDR", addr)
+	s := New([]string{os.Args[0], "-test.run=^TestStub$"}, addr)
+	t.Cleanup(s.Stop)
+	return s
+}
+
+func (s *Supervisor) current() *Process {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.proc
+}
+
+func (s *Supervisor) restarts() int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.Restarts
+}
+
+func listening(addr string) bool {
+	c, err := net.DialTimeout("tcp", addr, time.Second)
+	if err == nil {
+		c.Close()
+	}
+	return err == nil
+}
+
+func TestStartExits(t *testing.T) {
+	s := New([]string{"sh", "-c", "echo 'panic: boom' >&2; exit 1"}, "127.0.0.1:1")
+	err := s.Start()
+	if err == nil || !strings.Contains(err.Error(), "exited before listening") {
+		t.Fatalf("got %v, want the target to exit before listening", err)
+	}
+	if !strings.Contains(err.Error(), "Go panic, exit code 1") {
+		t.Errorf("crash not described: %v", err)
+	}
+}
+
+func TestRestart(t *testing.T) {
+	s := stub(t)
+	crashes := make(chan Crash, 1)
+	s.OnCrash = func(c Crash) { crashes <- c }
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	first := s.current()
+
+	first.Cmd.Process.Kill()
+	select {
+	case c := <-crashes:
+		if c.Pid != first.Cmd.Process.Pid || c.Signal != "killed" {
+			t.Errorf("got crash %v, want pid %d killed", c, first.Cmd.Process.Pid)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("crash not reported")
+	}
+	s.WaitReady()
+	second := s.current()
+	if second == first {
+		t.Fatal("target not restarted")
+	}
+	if !listening(s.Addr) {
+		t.Error("restarted target isn't listening")
+	}
+
+	s.Stop()
+	select {
+	case <-second.Exited():
+	case <-time.After(5 * time.Second):
+		t.Fatal("Stop left the target running")
+	}
+	select {
+	case c := <-crashes:
+		t.Errorf("Stop reported a crash: %v", c)
+	case <-time.After(100 * time.Millisecond):
+	}
+}
+
+// Stop while restarts are failing ends them.
+func TestStopWhileDown(t *testing.T) {
+	s := stub(t)
+	t.Setenv("SUPERVISOR_STUB_ONCE", filepath.Join(t.TempDir(), "started"))
+	s.RestartDelay = 10 * time.Millisecond
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	s.current().Cmd.Process.Kill()
+	for s.restarts() < 2 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Stop()
+	time.Sleep(200 * time.Millisecond)
+	n := s.restarts()
+	time.Sleep(200 * time.Millisecond)
+	if got := s.restarts(); got != n {
+		t.Errorf("%d restarts after Stop", got-n)
+	}
+}
+
+// A target that comes up after Stop is killed.
+func TestStopWhileStarting(t *testing.T) {
+	s := stub(t)
+	if err := s.Start(); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("SUPERVISOR_STUB_DELAY", "300ms")
+	s.current().Cmd.Process.Kill()
+	for s.restarts() < 1 {
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	s.Stop()
+	time.Sleep(time.Second)
+	if listening(s.Addr) {
+		t.Error("target started after Stop is still running")
+	}
+}
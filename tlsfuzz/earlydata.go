@@ -0,0 +1,357 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsfuzz
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/sha512"
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/internal/tlsutil"
+)
+
+// helloRetryRandom is the ServerHello random of a HelloRetryRequest.
+var helloRetryRandom = []byte{
+	0xcf, 0x21, 0xad, 0x74, 0xe5, 0x9a, 0x61, 0x11, 0xbe, 0x1d, 0x8c, 0x02, 0x1e, 0x65, 0xb8, 0x91,
+	0xc2, 0xa2, 0x11, 0x16, 0x7a, 0xbb, 0x8c, 0x5e, 0x07, 0x9e, 0x09, 0xe2, 0xc8, 0xa8, 0x33, 0x9c,
+}
+
+// tls13Suites is what the key schedule needs of each TLS 1.3 suite. ChaCha20
+// isn't in the standard library outside crypto/tls, so it's left out.
+var tls13Suites = map[uint16]struct {
+	hash   func() hash.Hash
+	keyLen int
+}{
+	tls.TLS_AES_128_GCM_SHA256: {sha256.New, 16},
+	tls.TLS_AES_256_GCM_SHA384: {sha512.New384, 32},
+}
+
+// An EarlyResult is what the server made of a 0-RTT attempt.
+type EarlyResult struct {
+	// Resumed is whether the server took the session ticket.
+	Resumed bool
+	// Accepted is whether it took the early data too.
+	Accepted bool
+	// Alert is set if the server answered with an alert instead.
+	Alert string
+}
+
+// ticketCache is a tls.ClientSessionCache that only keeps the last ticket.
+type ticketCache struct {
+	mu    sync.Mutex
+	state *tls.ClientSessionState
+}
+
+func (c *ticketCache) Get(string) (*tls.ClientSessionState, bool) { return nil, false }
+
+func (c *ticketCache) Put(_ string, cs *tls.ClientSessionState) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if cs != nil {
+		c.state = cs
+	}
+}
+
+func (c *ticketCache) get() *tls.ClientSessionState {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.state
+}
+
+// EarlyData makes two connections with dial. The first is a full TLS 1.3
+// handshake with cfg that writes first and waits for a session ticket. The
+// second resumes the session with a ClientHello of our own that offers early
+// data, and sends early right behind it as 0-RTT data. It reads as far as
+// the server's EncryptedExtensions, to see whether the early data was taken,
+// and hangs up without finishing the handshake. If early is nil, early data
+// isn't offered at all and only the resumption is tried.
+func EarlyData(dial func() (net.Conn, error), cfg *tls.Config, first, early []byte, timeout time.Duration) (EarlyResult, error) {
+	ticket, psk, ageAdd, created, suiteID, err := sessionTicket(dial, cfg, first, timeout)
+	if err != nil {
+		return EarlyResult{}, err
+	}
+	suite, ok := tls13Suites[suiteID]
+	if !ok {
+		return EarlyResult{}, fmt.Errorf("can't encrypt with cipher suite 0x%04x", suiteID)
+	}
+
+	key, err := ecdh.X25519().GenerateKey(rand.Reader)
+	if err != nil {
+		return EarlyResult{}, err
+	}
+	age := uint32(time.Since(created).Milliseconds()) + ageAdd
+	ch := resumptionHello(cfg, suiteID, key.PublicKey().Bytes(), ticket, age, suite.hash().Size(), early != nil)
+
+	// The binder signs the ClientHello up to the binders themselves.
+	earlySecret := tlsutil.Extract(suite.hash, nil, psk)
+	binderKey := tlsutil.DeriveSecret(suite.hash, earlySecret, "res binder", nil)
+	finishedKey := tlsutil.ExpandLabel(suite.hash, binderKey, "finished", nil, suite.hash().Size())
+	binderLen := suite.hash().Size()
+	mac := hmac.New(suite.hash, finishedKey)
+	mac.Write(tlsutil.Transcript(suite.hash, ch[:len(ch)-3-binderLen]))
+	copy(ch[len(ch)-binderLen:], mac.Sum(nil))
+
+	out := appendRecords(nil, recordHandshake, ch)
+	out = append(out, recordChangeCipherSpec, 3, 3, 0, 1, 1)
+	earlyKey, earlyIV, err := trafficKey(suite.hash, suite.keyLen, tlsutil.DeriveSecret(suite.hash, earlySecret, "c e traffic", ch))
+	if err != nil {
+		return EarlyResult{}, err
+	}
+	for seq := uint64(0); len(early) > 0; seq++ {
+		n := len(early)
+		if n > maxRecord-256 {
+			n = maxRecord - 256
+		}
+		out = append(out, tlsutil.Seal13(earlyKey, earlyIV, seq, recordApplicationData, early[:n])...)
+		early = early[n:]
+	}
+
+	conn, err := dial()
+	if err != nil {
+		return EarlyResult{}, err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(timeout))
+	if _, err := conn.Write(out); err != nil {
+		return EarlyResult{}, err
+	}
+	return readEarlyResult(conn, suite.hash, suite.keyLen, earlySecret, key, ch)
+}
+
+// sessionTicket runs a full handshake and returns the ticket the server
+// sent, with the PSK it stands for, its age_add, when it came, and its
+// cipher suite.
+func sessionTicket(dial func() (net.Conn, error), cfg *tls.Config, first []byte, timeout time.Duration) (ticket, psk []byte, ageAdd uint32, created time.Time, suite uint16, err error) {
+	conn, err := dial()
+	if err != nil {
+		return
+	}
+	cache := &ticketCache{}
+	cfg = cfg.Clone()
+	cfg.MinVersion, cfg.MaxVersion = tls.VersionTLS13, tls.VersionTLS13
+	cfg.ClientSessionCache = cache
+	tc := tls.Client(conn, cfg)
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(timeout))
+	if err = tc.Handshake(); err != nil {
+		return
+	}
+	if _, err = tc.Write(first); err != nil {
+		return
+	}
+	// Tickets are handled as they're read.
+	buf := make([]byte, 4096)
+	for cache.get() == nil {
+		if _, err = tc.Read(buf); err != nil {
+			err = fmt.Errorf("no session ticket: %w", err)
+			return
+		}
+	}
+
+	ticket, state, err := cache.get().ResumptionState()
+	if err != nil {
+		return
+	}
+	b, err := state.Bytes()
+	if err != nil {
+		return
+	}
+	// See the SessionState encoding in crypto/tls: version, type, cipher
+	// suite, created_at and the secret lead, and a client's TLS 1.3 state
+	// ends with use_by and age_add.
+	if len(b) < 14 || binary.BigEndian.Uint16(b) != tls.VersionTLS13 || len(b) < 14+int(b[13])+12 {
+		err = errors.New("not a TLS 1.3 session")
+		return
+	}
+	suite = binary.BigEndian.Uint16(b[3:])
+	created = time.Unix(int64(binary.BigEndian.Uint64(b[5:])), 0)
+	psk = b[14 : 14+int(b[13])]
+	ageAdd = binary.BigEndian.Uint32(b[len(b)-4:])
+	return ticket, psk, ageAdd, created, suite, nil
+}
+
+// resumptionHello builds a ClientHello that offers the ticket, with early
+// data if offerEarly is set, and a zeroed binder of binderLen bytes at the
+// very end.
+func resumptionHello(cfg *tls.Config, suite uint16, keyShare, ticket []byte, age uint32, binderLen int, offerEarly bool) []byte {
+	exts := []byte{}
+	add := func(typ uint16, body []byte) {
+		exts = binary.BigEndian.AppendUint16(exts, typ)
+		exts = binary.BigEndian.AppendUint16(exts, uint16(len(body)))
+		exts = append(exts, body...)
+	}
+	if name := cfg.ServerName; name != "" && net.ParseIP(name) == nil {
+		sni := binary.BigEndian.AppendUint16(nil, uint16(3+len(name)))
+		sni = append(sni, 0)
+		sni = binary.BigEndian.AppendUint16(sni, uint16(len(name)))
+		add(extensionServerName, append(sni, name...))
+	}
+	add(extensionSupportedGroups, []byte{0, 2, 0, 0x1d})
+	add(extensionSignatureAlgs, []byte{0, 16, 4, 3, 5, 3, 6, 3, 8, 7, 8, 4, 8, 5, 8, 6, 4, 1})
+	if len(cfg.NextProtos) > 0 {
+		add(ExtensionALPN, ALPN(cfg.NextProtos...))
+	}
+	add(extensionSupportedVersion, []byte{2, 3, 4})
+	add(extensionPSKModes, []byte{1, 1})
+	share := []byte{0, byte(4 + len(keyShare)), 0, 0x1d, 0, byte(len(keyShare))}
+	add(extensionKeyShare, append(share, keyShare...))
+	if offerEarly {
+		add(extensionEarlyData, nil)
+	}
+
+	// pre_shared_key has to come last.
+	identity := binary.BigEndian.AppendUint16(nil, uint16(len(ticket)))
+	identity = append(identity, ticket...)
+	identity = binary.BigEndian.AppendUint32(identity, age)
+	psk := binary.BigEndian.AppendUint16(nil, uint16(len(identity)))
+	psk = append(psk, identity...)
+	psk = binary.BigEndian.AppendUint16(psk, uint16(1+binderLen))
+	psk = append(psk, byte(binderLen))
+	add(extensionPreSharedKey, append(psk, make([]byte, binderLen)...))
+
+	body := []byte{3, 3}
+	random := make([]byte, 64)
+	rand.Read(random)
+	body = append(body, random[:32]...)
+	body = append(body, 32)
+	body = append(body, random[32:]...)
+	body = append(body, 0, 2, byte(suite>>8), byte(suite), 1, 0)
+	body = binary.BigEndian.AppendUint16(body, uint16(len(exts)))
+	body = append(body, exts...)
+	return appendHandshake(nil, handshakeClientHello, body)
+}
+
+// readEarlyResult reads the server's answer to ch up to EncryptedExtensions.
+func readEarlyResult(conn net.Conn, h func() hash.Hash, keyLen int, earlySecret []byte, key *ecdh.PrivateKey, ch []byte) (EarlyResult, error) {
+	result := EarlyResult{}
+	var in []byte
+	var sh []byte
+	var serverKey cipher.AEAD
+	var serverIV []byte
+	var seq uint64
+	var hs []byte
+	buf := make([]byte, 16384)
+
+	for {
+		n, err := conn.Read(buf)
+		in = append(in, buf[:n]...)
+		rs := tlsutil.Records(in)
+		consumed := 0
+		for _, r := range rs {
+			consumed += 5 + len(r.Body)
+			switch {
+			case r.Type == recordAlert && len(r.Body) == 2:
+				result.Alert = alertName(r.Body[1])
+				return result, nil
+			case r.Type == recordHandshake && sh == nil:
+				hs = append(hs, r.Body...)
+				msg, err := tlsutil.HandshakeMessage([]tlsutil.Record{{Type: recordHandshake, Body: hs}}, handshakeServerHello)
+				if err != nil {
+					continue
+				}
+				sh, hs = msg, nil
+				if len(sh) >= 38 && bytes.Equal(sh[6:38], helloRetryRandom) {
+					return result, errors.New("server sent a HelloRetryRequest")
+				}
+				_, result.Resumed = Extension(sh, extensionPreSharedKey)
+				share, ok := Extension(sh, extensionKeyShare)
+				if !ok || len(share) < 4 {
+					return result, errors.New("ServerHello without a key share")
+				}
+				pub, err := ecdh.X25519().NewPublicKey(share[4:])
+				if err != nil {
+					return result, err
+				}
+				shared, err := key.ECDH(pub)
+				if err != nil {
+					return result, err
+				}
+				handshakeSecret := tlsutil.Extract(h, tlsutil.DeriveSecret(h, earlySecret, "derived", nil), shared)
+				secret := tlsutil.DeriveSecret(h, handshakeSecret, "s hs traffic", append(append([]byte{}, ch...), sh...))
+				if serverKey, serverIV, err = trafficKey(h, keyLen, secret); err != nil {
+					return result, err
+				}
+			case r.Type == recordApplicationData && serverKey != nil:
+				typ, plaintext, err := tlsutil.Open13(serverKey, serverIV, seq, r)
+				if err != nil {
+					return result, fmt.Errorf("decrypting handshake: %w", err)
+				}
+				seq++
+				if typ == recordAlert && len(plaintext) == 2 {
+					result.Alert = alertName(plaintext[1])
+					return result, nil
+				}
+				hs = append(hs, plaintext...)
+				if len(hs) >= 4 && hs[0] == handshakeEncryptedExtension {
+					exts := hs[4:]
+					if len(exts) < 2 {
+						continue
+					}
+					exts = exts[2:]
+					for len(exts) >= 4 {
+						typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+						if typ == extensionEarlyData {
+							result.Accepted = true
+						}
+						if len(exts) < 4+n {
+							break
+						}
+						exts = exts[4+n:]
+					}
+					return result, nil
+				}
+			}
+		}
+		in = in[consumed:]
+		if err != nil {
+			return result, err
+		}
+	}
+}
+
+func trafficKey(h func() hash.Hash, keyLen int, secret []byte) (cipher.AEAD, []byte, error) {
+	block, err := aes.NewCipher(tlsutil.ExpandLabel(h, secret, "key", nil, keyLen))
+	if err != nil {
+		return nil, nil, err
+	}
+	aead, err := cipher.NewGCM(block)
+	return aead, tlsutil.ExpandLabel(h, secret, "iv", nil, 12), err
+}
+
+var alertNames = map[byte]string{
+	0:   "close_notify",
+	10:  "unexpected_message",
+	20:  "bad_record_mac",
+	40:  "handshake_failure",
+	47:  "illegal_parameter",
+	50:  "decode_error",
+	51:  "decrypt_error",
+	70:  "protocol_version",
+	80:  "internal_error",
+	100: "no_renegotiation",
+	109: "missing_extension",
+	110: "unsupported_extension",
+	120: "no_application_protocol",
+}
+
+func alertName(desc byte) string {
+	if name, ok := alertNames[desc]; ok {
+		return name
+	}
+	return fmt.Sprintf("alert(%d)", desc)
+}
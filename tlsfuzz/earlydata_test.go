@@ -0,0 +1,142 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsfuzz
+
+import (
+	"crypto/tls"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+// echoServer is a TLS 1.3 server on loopback that echoes what it reads. It
+// keeps the state of each connection after its handshake.
+type echoServer struct {
+	net.Listener
+	mu     sync.Mutex
+	states []tls.ConnectionState
+}
+
+func newEchoServer(t *testing.T, cfg *tls.Config) *echoServer {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &echoServer{Listener: l}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(tls.Server(c, cfg))
+		}
+	}()
+	return s
+}
+
+func (s *echoServer) serve(tc *tls.Conn) {
+	defer tc.Close()
+	tc.SetDeadline(time.Now().Add(5 * time.Second))
+	if err := tc.Handshake(); err != nil {
+		return
+	}
+	s.mu.Lock()
+	s.states = append(s.states, tc.ConnectionState())
+	s.mu.Unlock()
+	buf := make([]byte, 4096)
+	for {
+		n, err := tc.Read(buf)
+		if err != nil {
+			return
+		}
+		tc.Write(buf[:n])
+	}
+}
+
+func (s *echoServer) state(i int) tls.ConnectionState {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if i >= len(s.states) {
+		return tls.ConnectionState{}
+	}
+	return s.states[i]
+}
+
+func (s *echoServer) dial() (net.Conn, error) {
+	return net.Dial("tcp", s.Addr().String())
+}
+
+// sessionTicket reads the PSK and cipher suite out of SessionState.Bytes, at
+// offsets that crypto/tls could move.
+func TestSessionTicket(t *testing.T) {
+	s := newEchoServer(t, serverConfig(t, config.CertValid))
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	before := time.Now().Truncate(time.Second)
+	ticket, psk, _, created, suite, err := sessionTicket(s.dial, clientConfig, []byte("hello"), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(ticket) == 0 {
+		t.Error("empty ticket")
+	}
+	if want := s.state(0).CipherSuite; suite != want {
+		t.Fatalf("got cipher suite %s, the server negotiated %s", tls.CipherSuiteName(suite), tls.CipherSuiteName(want))
+	}
+	if want := tls13Suites[suite].hash().Size(); len(psk) != want {
+		t.Errorf("got a %d byte PSK, want %d", len(psk), want)
+	}
+	if created.Before(before) || created.After(time.Now()) {
+		t.Errorf("ticket created at %v, test started at %v", created, before)
+	}
+}
+
+// Without early data, EarlyData's ClientHello has to resume the session,
+// which takes the right PSK and binder, and the server's EncryptedExtensions
+// has to decrypt, which takes the right handshake keys.
+func TestEarlyDataResumes(t *testing.T) {
+	s := newEchoServer(t, serverConfig(t, config.CertValid))
+	clientConfig := &tls.Config{InsecureSkipVerify: true, NextProtos: []string{"h2"}}
+
+	result, err := EarlyData(s.dial, clientConfig, []byte("first"), nil, 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !result.Resumed || result.Accepted || result.Alert != "" {
+		t.Errorf("got %+v, want a resumed session", result)
+	}
+}
+
+// crypto/tls servers refuse the early_data extension outright, RFC 8446
+// section 4.2.10 notwithstanding.
+func TestEarlyDataRefused(t *testing.T) {
+	s := newEchoServer(t, serverConfig(t, config.CertValid))
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	result, err := EarlyData(s.dial, clientConfig, []byte("first"), []byte("early data"), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if result.Alert != "unsupported_extension" {
+		t.Errorf("got %+v, want unsupported_extension", result)
+	}
+}
+
+func TestEarlyDataWithoutTickets(t *testing.T) {
+	serverConfig := serverConfig(t, config.CertValid)
+	serverConfig.SessionTicketsDisabled = true
+	s := newEchoServer(t, serverConfig)
+	clientConfig := &tls.Config{InsecureSkipVerify: true}
+
+	if _, err := EarlyData(s.dial, clientConfig, []byte("first"), []byte("early"), 500*time.Millisecond); err == nil {
+		t.Error("got a result without a session ticket")
+	}
+}
@@ -0,0 +1,273 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsfuzz
+
+import (
+	"crypto/tls"
+	"encoding/binary"
+	"errors"
+	"net"
+	"sync"
+
+	"github.com/c0nrad/http2fuzz/internal/tlsutil"
+)
+
+const (
+	recordChangeCipherSpec = 20
+	recordAlert            = 21
+	recordHandshake        = 22
+	recordApplicationData  = 23
+
+	handshakeHelloRequest       = 0
+	handshakeClientHello        = 1
+	handshakeServerHello        = 2
+	handshakeEncryptedExtension = 8
+	handshakeFinished           = 20
+
+	extensionServerName       = 0
+	extensionSupportedGroups  = 10
+	extensionSignatureAlgs    = 13
+	ExtensionALPN             = 16
+	extensionPreSharedKey     = 41
+	extensionEarlyData        = 42
+	extensionSupportedVersion = 43
+	extensionPSKModes         = 45
+	extensionKeyShare         = 51
+	extensionRenegotiation    = 0xff01
+
+	maxRecord = 16384
+	maxTap    = 1 << 20
+)
+
+// BlacklistedCipherSuites are the suites crypto/tls still speaks that RFC
+// 7540 Appendix A forbids for HTTP/2. A peer that negotiates one should end
+// the connection with INADEQUATE_SECURITY.
+var BlacklistedCipherSuites = []uint16{
+	tls.TLS_RSA_WITH_RC4_128_SHA,
+	tls.TLS_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_RSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_RSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_ECDSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_RC4_128_SHA,
+	tls.TLS_ECDHE_RSA_WITH_3DES_EDE_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_CBC_SHA,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_CBC_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_CBC_SHA256,
+}
+
+// GCMCipherSuites are the TLS 1.2 suites Renegotiate can encrypt with.
+var GCMCipherSuites = []uint16{
+	tls.TLS_ECDHE_ECDSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_RSA_WITH_AES_128_GCM_SHA256,
+	tls.TLS_ECDHE_ECDSA_WITH_AES_256_GCM_SHA384,
+	tls.TLS_ECDHE_RSA_WITH_AES_256_GCM_SHA384,
+}
+
+// appendRecords frames payload as records of typ, splitting it if it doesn't
+// fit in one.
+func appendRecords(out []byte, typ byte, payload []byte) []byte {
+	for first := true; first || len(payload) > 0; first = false {
+		n := len(payload)
+		if n > maxRecord {
+			n = maxRecord
+		}
+		out = append(out, typ, 3, 3, byte(n>>8), byte(n))
+		out = append(out, payload[:n]...)
+		payload = payload[n:]
+	}
+	return out
+}
+
+func appendHandshake(out []byte, msgType byte, body []byte) []byte {
+	n := len(body)
+	out = append(out, msgType, byte(n>>16), byte(n>>8), byte(n))
+	return append(out, body...)
+}
+
+// extensionsOffset returns where the extensions of a ClientHello or
+// ServerHello message start, at their two byte length.
+func extensionsOffset(msg []byte) (int, error) {
+	if len(msg) < 4+35 {
+		return 0, errors.New("short hello")
+	}
+	i := 4 + 34
+	i += 1 + int(msg[i]) // session id
+	if msg[0] == handshakeClientHello {
+		if len(msg) < i+2 {
+			return 0, errors.New("short ClientHello")
+		}
+		i += 2 + int(binary.BigEndian.Uint16(msg[i:])) // cipher suites
+		if len(msg) < i+1 {
+			return 0, errors.New("short ClientHello")
+		}
+		i += 1 + int(msg[i]) // compression methods
+	} else {
+		i += 3 // cipher suite and compression method
+	}
+	if len(msg) < i+2 {
+		return 0, errors.New("hello without extensions")
+	}
+	return i, nil
+}
+
+// Extension returns the body of extension ext in a ClientHello or
+// ServerHello message, and whether it's there.
+func Extension(msg []byte, ext uint16) ([]byte, bool) {
+	i, err := extensionsOffset(msg)
+	if err != nil {
+		return nil, false
+	}
+	exts := msg[i+2:]
+	for len(exts) >= 4 {
+		typ, n := binary.BigEndian.Uint16(exts), int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			break
+		}
+		if typ == ext {
+			return exts[4 : 4+n], true
+		}
+		exts = exts[4+n:]
+	}
+	return nil, false
+}
+
+// SetExtension returns a copy of the ClientHello or ServerHello message msg
+// with the body of extension ext replaced, or the extension added first if
+// it wasn't there. The lengths around it are fixed up, so the message still
+// parses; the peer's Finished check is what fails.
+func SetExtension(msg []byte, ext uint16, body []byte) ([]byte, error) {
+	i, err := extensionsOffset(msg)
+	if err != nil {
+		return nil, err
+	}
+	newExt := []byte{byte(ext >> 8), byte(ext), byte(len(body) >> 8), byte(len(body))}
+	newExt = append(newExt, body...)
+
+	exts := []byte{}
+	old := msg[i+2:]
+	found := false
+	for len(old) >= 4 {
+		typ, n := binary.BigEndian.Uint16(old), int(binary.BigEndian.Uint16(old[2:]))
+		if len(old) < 4+n {
+			return nil, errors.New("truncated extension")
+		}
+		if typ == ext {
+			exts = append(exts, newExt...)
+			found = true
+		} else {
+			exts = append(exts, old[:4+n]...)
+		}
+		old = old[4+n:]
+	}
+	if !found {
+		exts = append(newExt, exts...)
+	}
+	if len(exts) > 0xffff {
+		return nil, errors.New("extensions too long")
+	}
+
+	out := append([]byte{}, msg[4:i]...)
+	out = append(out, byte(len(exts)>>8), byte(len(exts)))
+	out = append(out, exts...)
+	return appendHandshake(nil, msg[0], out), nil
+}
+
+// ALPN encodes the body of an ALPN extension listing protos. Names longer
+// than 255 bytes have their length byte wrap, as a broken peer would send.
+func ALPN(protos ...string) []byte {
+	list := []byte{}
+	for _, p := range protos {
+		list = append(list, byte(len(p)))
+		list = append(list, p...)
+	}
+	return append([]byte{byte(len(list) >> 8), byte(len(list))}, list...)
+}
+
+// A Tap is a net.Conn that keeps a copy of the bytes going each way, so the
+// TLS records can be looked at after a handshake, and can rewrite the first
+// hello message written on it.
+type Tap struct {
+	net.Conn
+
+	// Rewrite, if set, is handed the first handshake message written, whole
+	// with its header, and returns the message to send instead.
+	Rewrite func(msg []byte) []byte
+
+	mu        sync.Mutex
+	rewritten bool
+	written   []byte
+	read      []byte
+}
+
+func NewTap(c net.Conn) *Tap {
+	return &Tap{Conn: c}
+}
+
+func (t *Tap) Read(b []byte) (int, error) {
+	n, err := t.Conn.Read(b)
+	t.mu.Lock()
+	if len(t.read) < maxTap {
+		t.read = append(t.read, b[:n]...)
+	}
+	t.mu.Unlock()
+	return n, err
+}
+
+// Write expects crypto/tls to write the first hello in one call, as it does.
+func (t *Tap) Write(b []byte) (int, error) {
+	out := b
+	t.mu.Lock()
+	if t.Rewrite != nil && !t.rewritten {
+		t.rewritten = true
+		out = t.rewrite(b)
+	}
+	if len(t.written) < maxTap {
+		t.written = append(t.written, out...)
+	}
+	t.mu.Unlock()
+
+	if _, err := t.Conn.Write(out); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (t *Tap) rewrite(b []byte) []byte {
+	rs := tlsutil.Records(b)
+	if len(rs) == 0 || rs[0].Type != recordHandshake {
+		return b
+	}
+	body := rs[0].Body
+	if len(body) < 4 {
+		return b
+	}
+	n := 4 + (int(body[1])<<16 | int(body[2])<<8 | int(body[3]))
+	if len(body) < n {
+		return b
+	}
+	payload := append(t.Rewrite(body[:n]), body[n:]...)
+	out := appendRecords(nil, recordHandshake, payload)
+	return append(out, b[5+len(body):]...)
+}
+
+// Written returns the records written so far.
+func (t *Tap) Written() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte{}, t.written...)
+}
+
+// ReadBytes returns the records read so far.
+func (t *Tap) ReadBytes() []byte {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	return append([]byte{}, t.read...)
+}
@@ -0,0 +1,188 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsfuzz
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/binary"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/c0nrad/http2fuzz/config"
+	"github.com/c0nrad/http2fuzz/internal/tlsutil"
+)
+
+// hellos captures the ClientHello and ServerHello of a TLS 1.2 handshake in
+// which the client offers protos.
+func hellos(t *testing.T, protos ...string) (clientHello, serverHello []byte) {
+	t.Helper()
+	clientConfig := &tls.Config{InsecureSkipVerify: true, MaxVersion: tls.VersionTLS12, NextProtos: protos}
+	_, _, clientTap, _ := tappedPair(t, clientConfig, serverConfig(t, config.CertValid))
+	clientHello, err := tlsutil.HandshakeMessage(tlsutil.Records(clientTap.Written()), handshakeClientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	serverHello, err = tlsutil.HandshakeMessage(tlsutil.Records(clientTap.ReadBytes()), handshakeServerHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return clientHello, serverHello
+}
+
+// extensionTypes lists the extensions of a hello message in order, and
+// fails unless the message's lengths add up.
+func extensionTypes(t *testing.T, msg []byte) []uint16 {
+	t.Helper()
+	if n := int(msg[1])<<16 | int(msg[2])<<8 | int(msg[3]); n != len(msg)-4 {
+		t.Fatalf("message length %d, body is %d bytes", n, len(msg)-4)
+	}
+	i, err := extensionsOffset(msg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	exts := msg[i+2:]
+	if n := int(binary.BigEndian.Uint16(msg[i:])); n != len(exts) {
+		t.Fatalf("extensions length %d, they are %d bytes", n, len(exts))
+	}
+	types := []uint16{}
+	for len(exts) > 0 {
+		if len(exts) < 4 {
+			t.Fatalf("%d bytes left over after the extensions", len(exts))
+		}
+		n := int(binary.BigEndian.Uint16(exts[2:]))
+		if len(exts) < 4+n {
+			t.Fatalf("extension %d is truncated", binary.BigEndian.Uint16(exts))
+		}
+		types = append(types, binary.BigEndian.Uint16(exts))
+		exts = exts[4+n:]
+	}
+	return types
+}
+
+func TestALPN(t *testing.T) {
+	tests := []struct {
+		protos []string
+		want   []byte
+	}{
+		{nil, []byte{0, 0}},
+		{[]string{"h2"}, []byte("\x00\x03\x02h2")},
+		{[]string{"h2", "http/1.1"}, []byte("\x00\x0c\x02h2\x08http/1.1")},
+		{[]string{"", "h2"}, []byte("\x00\x04\x00\x02h2")},
+		// The length byte of a 256 byte name wraps to 0.
+		{[]string{strings.Repeat("a", 256)}, append([]byte{1, 1, 0}, strings.Repeat("a", 256)...)},
+	}
+	for _, tt := range tests {
+		if got := ALPN(tt.protos...); !bytes.Equal(got, tt.want) {
+			t.Errorf("ALPN(%.20q) = %x, want %x", tt.protos, got, tt.want)
+		}
+	}
+}
+
+func TestSetExtension(t *testing.T) {
+	clientHello, serverHello := hellos(t, "h2", "http/1.1")
+	bareHello, _ := hellos(t)
+	if _, ok := Extension(bareHello, ExtensionALPN); ok {
+		t.Fatal("ClientHello without NextProtos has ALPN")
+	}
+	const unknown = 0x1234
+
+	tests := []struct {
+		name  string
+		msg   []byte
+		ext   uint16
+		body  []byte
+		first bool
+	}{
+		{"replace", clientHello, ExtensionALPN, ALPN("http/1.1"), false},
+		{"replace-empty", clientHello, ExtensionALPN, nil, false},
+		{"replace-longer", clientHello, ExtensionALPN, ALPN(strings.Repeat("h2", 150), "h2"), false},
+		{"add", bareHello, ExtensionALPN, ALPN("h2"), true},
+		{"add-unknown", clientHello, unknown, []byte("anything"), true},
+		{"server-hello", serverHello, ExtensionALPN, ALPN("spdy/3"), false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			before := extensionTypes(t, tt.msg)
+			out, err := SetExtension(tt.msg, tt.ext, tt.body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			after := extensionTypes(t, out)
+			want := before
+			if tt.first {
+				want = append([]uint16{tt.ext}, before...)
+			}
+			if !reflect.DeepEqual(after, want) {
+				t.Errorf("extensions %v, want %v", after, want)
+			}
+			if got, ok := Extension(out, tt.ext); !ok || !bytes.Equal(got, tt.body) {
+				t.Errorf("extension %d is %x, %v; want %x", tt.ext, got, ok, tt.body)
+			}
+			for _, ext := range before {
+				if ext == tt.ext {
+					continue
+				}
+				if was, _ := Extension(tt.msg, ext); !bytes.Equal(was, mustExtension(t, out, ext)) {
+					t.Errorf("extension %d changed", ext)
+				}
+			}
+			// Everything up to the extensions is as it was.
+			i, _ := extensionsOffset(tt.msg)
+			if out[0] != tt.msg[0] || !bytes.Equal(out[4:i], tt.msg[4:i]) {
+				t.Error("the hello before the extensions changed")
+			}
+		})
+	}
+}
+
+func mustExtension(t *testing.T, msg []byte, ext uint16) []byte {
+	t.Helper()
+	body, ok := Extension(msg, ext)
+	if !ok {
+		t.Fatalf("extension %d is gone", ext)
+	}
+	return body
+}
+
+func TestSetExtensionErrors(t *testing.T) {
+	clientHello, _ := hellos(t, "h2")
+	i, err := extensionsOffset(clientHello)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Where the cipher suites start: header, version, random, session id.
+	suites := 4 + 34 + 1 + int(clientHello[4+34])
+	// A cut inside the ALPN extension's body.
+	inALPN := bytes.Index(clientHello, ALPN("h2")) + 2
+
+	tests := []struct {
+		name string
+		msg  []byte
+		body []byte
+		want string
+	}{
+		{"short", clientHello[:30], ALPN("h2"), "short hello"},
+		{"in-cipher-suites", clientHello[:suites+4], ALPN("h2"), "short ClientHello"},
+		{"no-extensions", clientHello[:i], ALPN("h2"), "hello without extensions"},
+		{"truncated-extension", clientHello[:inALPN], ALPN("h2"), "truncated extension"},
+		{"too-long", clientHello, make([]byte, 0xffff), "extensions too long"},
+	}
+	for _, tt := range tests {
+		_, err := SetExtension(tt.msg, ExtensionALPN, tt.body)
+		if err == nil || !strings.Contains(err.Error(), tt.want) {
+			t.Errorf("%s: got %v, want %q", tt.name, err, tt.want)
+		}
+	}
+
+	// Extension stops at a truncated extension rather than reading past it.
+	if _, ok := Extension(clientHello[:inALPN], ExtensionALPN); ok {
+		t.Error("found the truncated ALPN extension")
+	}
+	if _, ok := Extension(clientHello[:30], ExtensionALPN); ok {
+		t.Error("found ALPN in a truncated hello")
+	}
+}
@@ -0,0 +1,151 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsfuzz
+
+import (
+	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"strings"
+	"sync"
+
+	"github.com/c0nrad/http2fuzz/internal/tlsutil"
+)
+
+// A KeyLog is a tls.Config.KeyLogWriter that keeps the TLS 1.2 master
+// secrets it's handed, by client random.
+type KeyLog struct {
+	mu      sync.Mutex
+	secrets map[string][]byte
+}
+
+func (k *KeyLog) Write(b []byte) (int, error) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	if k.secrets == nil {
+		k.secrets = map[string][]byte{}
+	}
+	for _, line := range strings.Split(string(b), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) != 3 || fields[0] != "CLIENT_RANDOM" {
+			continue
+		}
+		if secret, err := hex.DecodeString(fields[2]); err == nil {
+			k.secrets[strings.ToLower(fields[1])] = secret
+		}
+	}
+	return len(b), nil
+}
+
+func (k *KeyLog) master(clientRandom []byte) ([]byte, bool) {
+	k.mu.Lock()
+	defer k.mu.Unlock()
+	secret, ok := k.secrets[hex.EncodeToString(clientRandom)]
+	return secret, ok
+}
+
+// gcmSuites is what encrypting with a suite of GCMCipherSuites needs.
+var gcmSuites = map[uint16]struct {
+	hash   func() hash.Hash
+	keyLen int
+}{
+	0xc02b: {sha256.New, 16},
+	0xc02f: {sha256.New, 16},
+	0xc02c: {sha512.New384, 32},
+	0xc030: {sha512.New384, 32},
+}
+
+// Renegotiate starts a second handshake on a TLS 1.2 connection tapped by
+// t, which HTTP/2 forbids. A client sends a new ClientHello that carries the
+// renegotiation_info of the first handshake, a server a HelloRequest.
+//
+// The record is encrypted here and written straight to the socket, which
+// crypto/tls doesn't know about, so nothing more can be written through the
+// tls.Conn afterwards. Reading from it still works. The connection has to
+// use one of GCMCipherSuites and log its secrets to keys.
+func Renegotiate(t *Tap, keys *KeyLog, isClient bool) error {
+	written, read := tlsutil.Records(t.Written()), tlsutil.Records(t.ReadBytes())
+	clientRecords, serverRecords := written, read
+	if !isClient {
+		clientRecords, serverRecords = read, written
+	}
+
+	ch, err := tlsutil.HandshakeMessage(clientRecords, handshakeClientHello)
+	if err != nil || len(ch) < 4+34 {
+		return errors.New("no ClientHello")
+	}
+	sh, err := tlsutil.HandshakeMessage(serverRecords, handshakeServerHello)
+	if err != nil {
+		return errors.New("no ServerHello")
+	}
+	if v, ok := Extension(sh, extensionSupportedVersion); ok && bytes.Equal(v, []byte{3, 4}) {
+		return errors.New("TLS 1.3 has no renegotiation")
+	}
+	i, err := extensionsOffset(sh)
+	if err != nil {
+		return err
+	}
+	suiteID := binary.BigEndian.Uint16(sh[i-3:])
+	suite, ok := gcmSuites[suiteID]
+	if !ok {
+		return fmt.Errorf("can't encrypt with cipher suite 0x%04x", suiteID)
+	}
+	clientRandom, serverRandom := ch[6:38], sh[6:38]
+	master, ok := keys.master(clientRandom)
+	if !ok {
+		return errors.New("no master secret in key log")
+	}
+
+	seed := append(append([]byte{}, serverRandom...), clientRandom...)
+	kb := tlsutil.PRF12(suite.hash, master, "key expansion", seed, 2*suite.keyLen+8)
+	n := suite.keyLen
+	key, iv := kb[:n], kb[2*n:2*n+4]
+	if !isClient {
+		key, iv = kb[n:2*n], kb[2*n+4:2*n+8]
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return err
+	}
+	aead, err := cipher.NewGCM(block)
+	if err != nil {
+		return err
+	}
+
+	// Everything we wrote after our ChangeCipherSpec is encrypted, starting
+	// with Finished at sequence number 0.
+	var encrypted []tlsutil.Record
+	for j, r := range written {
+		if r.Type == recordChangeCipherSpec {
+			encrypted = written[j+1:]
+			break
+		}
+	}
+	if len(encrypted) == 0 {
+		return errors.New("handshake not finished")
+	}
+	seq := uint64(len(encrypted))
+
+	msg := appendHandshake(nil, handshakeHelloRequest, nil)
+	if isClient {
+		finished, err := tlsutil.Open12(aead, iv, 0, encrypted[0])
+		if err != nil || len(finished) != 16 || finished[0] != handshakeFinished {
+			return errors.New("can't read our Finished")
+		}
+		msg, err = SetExtension(ch, extensionRenegotiation, append([]byte{12}, finished[4:]...))
+		if err != nil {
+			return err
+		}
+	}
+	_, err = t.Conn.Write(appendRecords(nil, recordHandshake, tlsutil.Seal12(aead, iv, seq, recordHandshake, msg)))
+	return err
+}
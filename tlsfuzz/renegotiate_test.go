@@ -0,0 +1,120 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package tlsfuzz
+
+import (
+	"crypto/tls"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/c0nrad/http2fuzz/certs"
+	"github.com/c0nrad/http2fuzz/config"
+)
+
+func serverConfig(t *testing.T, certMode string) *tls.Config {
+	t.Helper()
+	cert, err := certs.Generate(certMode, []string{"127.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, NextProtos: []string{"h2"}}
+}
+
+// tappedPair makes a TLS connection over loopback with both ends tapped, and
+// finishes the handshake.
+func tappedPair(t *testing.T, clientConfig, serverConfig *tls.Config) (client, server *tls.Conn, clientTap, serverTap *Tap) {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	accepted := make(chan error, 1)
+	go func() {
+		c, err := l.Accept()
+		if err != nil {
+			accepted <- err
+			return
+		}
+		serverTap = NewTap(c)
+		server = tls.Server(serverTap, serverConfig)
+		accepted <- server.Handshake()
+	}()
+
+	c, err := net.Dial("tcp", l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	clientTap = NewTap(c)
+	client = tls.Client(clientTap, clientConfig)
+	if err := client.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-accepted; err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		client.Close()
+		server.Close()
+	})
+	client.SetDeadline(time.Now().Add(5 * time.Second))
+	server.SetDeadline(time.Now().Add(5 * time.Second))
+	return client, server, clientTap, serverTap
+}
+
+// Renegotiate has to encrypt its record so that crypto/tls decrypts it and
+// gets as far as the handshake message inside, which it then refuses.
+func TestRenegotiate(t *testing.T) {
+	for _, suite := range GCMCipherSuites {
+		name := tls.CipherSuiteName(suite)
+		certMode := config.CertValid
+		if strings.Contains(name, "_RSA_") {
+			certMode = config.CertRSA1024
+		}
+		for _, isClient := range []bool{true, false} {
+			keys := &KeyLog{}
+			clientConfig := &tls.Config{
+				InsecureSkipVerify: true,
+				MaxVersion:         tls.VersionTLS12,
+				CipherSuites:       []uint16{suite},
+				NextProtos:         []string{"h2"},
+			}
+			serverConfig := serverConfig(t, certMode)
+			if isClient {
+				clientConfig.KeyLogWriter = keys
+			} else {
+				serverConfig.KeyLogWriter = keys
+			}
+			client, server, clientTap, serverTap := tappedPair(t, clientConfig, serverConfig)
+			if got := client.ConnectionState().CipherSuite; got != suite {
+				t.Fatalf("%s: negotiated %s", name, tls.CipherSuiteName(got))
+			}
+
+			tap, peer, want := clientTap, server, "clientHelloMsg"
+			if !isClient {
+				tap, peer, want = serverTap, client, "no renegotiation"
+			}
+			if err := Renegotiate(tap, keys, isClient); err != nil {
+				t.Fatalf("%s, client %v: %v", name, isClient, err)
+			}
+			_, err := peer.Read(make([]byte, 1))
+			if err == nil || !strings.Contains(err.Error(), want) {
+				t.Errorf("%s, client %v: peer read %v, want an error about %q", name, isClient, err, want)
+			}
+		}
+	}
+}
+
+func TestRenegotiateTLS13(t *testing.T) {
+	keys := &KeyLog{}
+	clientConfig := &tls.Config{InsecureSkipVerify: true, KeyLogWriter: keys}
+	_, _, clientTap, _ := tappedPair(t, clientConfig, serverConfig(t, config.CertValid))
+	if err := Renegotiate(clientTap, keys, true); err == nil || !strings.Contains(err.Error(), "TLS 1.3") {
+		t.Errorf("got %v, want TLS 1.3 refused", err)
+	}
+}
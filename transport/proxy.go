@@ -0,0 +1,230 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package transport
+
+import (
+	"bufio"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ProxyTimeout is how long connecting to a proxy and setting up the tunnel
+// may take.
+const ProxyTimeout = 10 * time.Second
+
+var defaultProxyPorts = map[string]string{
+	"http":   "80",
+	"https":  "443",
+	"socks5": "1080",
+}
+
+// ParseProxies reads proxy URLs separated by commas: http://, https:// or
+// socks5://, with an optional user:password@. "direct" stands for no proxy
+// and is returned as nil.
+func ParseProxies(s string) ([]*url.URL, error) {
+	if s == "" {
+		return nil, nil
+	}
+	proxies := []*url.URL{}
+	for _, spec := range strings.Split(s, ",") {
+		spec = strings.TrimSpace(spec)
+		if spec == "direct" {
+			proxies = append(proxies, nil)
+			continue
+		}
+		u, err := url.Parse(spec)
+		if err != nil {
+			return nil, err
+		}
+		if _, ok := defaultProxyPorts[u.Scheme]; !ok || u.Host == "" {
+			return nil, fmt.Errorf("bad proxy %q, want http://, https:// or socks5:// and a host", spec)
+		}
+		proxies = append(proxies, u)
+	}
+	return proxies, nil
+}
+
+// DialProxy opens a tunnel to addr through proxy. What is written to the
+// connection it returns goes to addr.
+func DialProxy(proxy *url.URL, addr string) (net.Conn, error) {
+	proxyAddr := proxy.Host
+	if proxy.Port() == "" {
+		proxyAddr = net.JoinHostPort(proxy.Hostname(), defaultProxyPorts[proxy.Scheme])
+	}
+	c, err := net.DialTimeout("tcp", proxyAddr, ProxyTimeout)
+	if err != nil {
+		return nil, err
+	}
+	c.SetDeadline(time.Now().Add(ProxyTimeout))
+
+	tunnel := c
+	switch proxy.Scheme {
+	case "https":
+		tc := tls.Client(c, &tls.Config{ServerName: proxy.Hostname(), InsecureSkipVerify: true})
+		c = tc
+		if err = tc.Handshake(); err == nil {
+			tunnel, err = connectHTTP(tc, proxy, addr)
+		}
+	case "http":
+		tunnel, err = connectHTTP(c, proxy, addr)
+	default:
+		err = connectSOCKS5(c, proxy, addr)
+	}
+	if err != nil {
+		c.Close()
+		return nil, fmt.Errorf("proxy %s: %w", proxy.Redacted(), err)
+	}
+	tunnel.SetDeadline(time.Time{})
+	return tunnel, nil
+}
+
+// bufferedConn hands out what the reader already took off the socket before
+// reading from it again.
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c bufferedConn) Read(b []byte) (int, error) {
+	return c.r.Read(b)
+}
+
+// connectHTTP asks an HTTP proxy to CONNECT to addr.
+func connectHTTP(c net.Conn, proxy *url.URL, addr string) (net.Conn, error) {
+	req := "CONNECT " + addr + " HTTP/1.1\r\nHost: " + addr + "\r\n"
+	if proxy.User != nil {
+		password, _ := proxy.User.Password()
+		auth := base64.StdEncoding.EncodeToString([]byte(proxy.User.Username() + ":" + password))
+		req += "Proxy-Authorization: Basic " + auth + "\r\n"
+	}
+	if _, err := io.WriteString(c, req+"\r\n"); err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(c)
+	resp, err := http.ReadResponse(r, &http.Request{Method: http.MethodConnect})
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode != http.StatusOK {
+		resp.Body.Close()
+		return nil, fmt.Errorf("CONNECT %s: %s", addr, resp.Status)
+	}
+	if r.Buffered() > 0 {
+		return bufferedConn{Conn: c, r: r}, nil
+	}
+	return c, nil
+}
+
+var socks5Errors = map[byte]string{
+	1: "general failure",
+	2: "connection not allowed by ruleset",
+	3: "network unreachable",
+	4: "host unreachable",
+	5: "connection refused",
+	6: "TTL expired",
+	7: "command not supported",
+	8: "address type not supported",
+}
+
+// connectSOCKS5 asks a SOCKS5 proxy to connect to addr, logging in with the
+// user and password of proxy if it has them (RFC 1928, RFC 1929). Host
+// names are sent as they are, for the proxy to resolve.
+func connectSOCKS5(c net.Conn, proxy *url.URL, addr string) error {
+	host, portStr, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	port, err := strconv.ParseUint(portStr, 10, 16)
+	if err != nil {
+		return fmt.Errorf("bad port in %q", addr)
+	}
+
+	method := byte(0)
+	if proxy.User != nil {
+		method = 2
+	}
+	if _, err := c.Write([]byte{5, 1, method}); err != nil {
+		return err
+	}
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(c, reply); err != nil {
+		return err
+	}
+	if reply[0] != 5 || reply[1] != method {
+		return errors.New("SOCKS5 proxy refused our authentication method")
+	}
+	if method == 2 {
+		user := proxy.User.Username()
+		password, _ := proxy.User.Password()
+		if len(user) > 255 || len(password) > 255 {
+			return errors.New("SOCKS5 user or password too long")
+		}
+		auth := append([]byte{1, byte(len(user))}, user...)
+		auth = append(append(auth, byte(len(password))), password...)
+		if _, err := c.Write(auth); err != nil {
+			return err
+		}
+		if _, err := io.ReadFull(c, reply); err != nil {
+			return err
+		}
+		if reply[1] != 0 {
+			return errors.New("SOCKS5 login failed")
+		}
+	}
+
+	req := []byte{5, 1, 0}
+	if ip := net.ParseIP(host); ip == nil {
+		if len(host) > 255 {
+			return errors.New("host name too long for SOCKS5")
+		}
+		req = append(append(req, 3, byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		req = append(append(req, 1), ip4...)
+	} else {
+		req = append(append(req, 4), ip...)
+	}
+	req = append(req, byte(port>>8), byte(port))
+	if _, err := c.Write(req); err != nil {
+		return err
+	}
+
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(c, head); err != nil {
+		return err
+	}
+	if head[1] != 0 {
+		if msg, ok := socks5Errors[head[1]]; ok {
+			return errors.New("SOCKS5: " + msg)
+		}
+		return fmt.Errorf("SOCKS5: error %d", head[1])
+	}
+	// Skip the address the proxy bound.
+	var n int
+	switch head[3] {
+	case 1:
+		n = 4
+	case 4:
+		n = 16
+	case 3:
+		if _, err := io.ReadFull(c, head[:1]); err != nil {
+			return err
+		}
+		n = int(head[0])
+	default:
+		return fmt.Errorf("SOCKS5: bad address type %d", head[3])
+	}
+	_, err = io.ReadFull(c, make([]byte, n+2))
+	return err
+}
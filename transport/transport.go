@@ -0,0 +1,276 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package transport
+
+import (
+	"fmt"
+	"math/rand"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// CoalesceWait is how long a Conn holds writes back waiting for more to
+// coalesce them with.
+const CoalesceWait = time.Second
+
+// CloseWait bounds how long Close spends writing what is held back.
+const CloseWait = time.Second
+
+// Options say how a Conn cuts up what is written to it.
+type Options struct {
+	// Writes are split into segments of MinSegment to MaxSegment bytes. 0
+	// leaves them whole.
+	MinSegment, MaxSegment int
+	// Delay is the pause after each segment but the last.
+	Delay time.Duration
+	// Coalesce writes are gathered up and written at once.
+	Coalesce int
+}
+
+// IsZero says whether o leaves writes alone.
+func (o Options) IsZero() bool {
+	return o.MaxSegment == 0 && o.Delay == 0 && o.Coalesce < 2
+}
+
+// ParseSegment reads a segment size, "n", or a range to pick sizes from at
+// random, "min-max".
+func ParseSegment(s string) (min, max int, err error) {
+	if s == "" {
+		return 0, 0, nil
+	}
+	lo, hi, isRange := strings.Cut(s, "-")
+	if min, err = strconv.Atoi(lo); err != nil {
+		return 0, 0, fmt.Errorf("bad segment size %q", s)
+	}
+	max = min
+	if isRange {
+		if max, err = strconv.Atoi(hi); err != nil {
+			return 0, 0, fmt.Errorf("bad segment size %q", s)
+		}
+	}
+	if min < 1 || max < min {
+		return 0, 0, fmt.Errorf("bad segment size %q, want n or min-max with 1 <= min <= max", s)
+	}
+	return min, max, nil
+}
+
+// A Conn writes to the connection it wraps the way its Options say, so
+// frames reach the peer split across reads, slowly, or several to a read.
+// Reads go straight through.
+type Conn struct {
+	net.Conn
+	opts    Options
+	closing chan struct{} // closed by Close, to cut short a write under way
+
+	// mu guards the fields below it. It is never held while writing, so
+	// Close doesn't wait out segment delays or a blocked socket.
+	mu      sync.Mutex
+	pending []byte
+	writes  int
+	queue   [][]byte // writes ready to go out, in the order they were made
+	timer   *time.Timer
+	closed  bool
+	err     error // from a write made by the timer, or by another caller
+
+	// writeMu is held while the queue goes out, one write at a time.
+	writeMu sync.Mutex
+	rand    *rand.Rand
+}
+
+// New wraps c. With zero Options it returns c as it is.
+func New(c net.Conn, opts Options) net.Conn {
+	if opts.IsZero() {
+		return c
+	}
+	return &Conn{Conn: c, opts: opts, closing: make(chan struct{}), rand: rand.New(rand.NewSource(rand.Int63()))}
+}
+
+// Write gathers b with the writes before it, and writes them all once there
+// are Coalesce of them or CoalesceWait has passed.
+func (c *Conn) Write(b []byte) (int, error) {
+	c.mu.Lock()
+	if err := c.errLocked(); err != nil {
+		c.mu.Unlock()
+		return 0, err
+	}
+	if c.opts.Coalesce < 2 {
+		c.queue = append(c.queue, b)
+		c.mu.Unlock()
+		if err := c.send(); err != nil {
+			return 0, err
+		}
+		return len(b), nil
+	}
+
+	c.pending = append(c.pending, b...)
+	c.writes++
+	if c.writes < c.opts.Coalesce {
+		if c.timer == nil {
+			c.timer = time.AfterFunc(CoalesceWait, func() {
+				c.mu.Lock()
+				c.timer = nil
+				c.queuePending()
+				c.mu.Unlock()
+				c.send()
+			})
+		}
+		c.mu.Unlock()
+		return len(b), nil
+	}
+	c.queuePending()
+	c.mu.Unlock()
+	if err := c.send(); err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+// Flush writes what is held back.
+func (c *Conn) Flush() error {
+	c.mu.Lock()
+	if err := c.errLocked(); err != nil {
+		c.mu.Unlock()
+		return err
+	}
+	c.queuePending()
+	c.mu.Unlock()
+	return c.send()
+}
+
+// Close closes the connection. What is held back is written first, unless
+// a write is under way or it takes longer than CloseWait. A write under way
+// is cut off at its next segment.
+func (c *Conn) Close() error {
+	c.mu.Lock()
+	if c.closed {
+		c.mu.Unlock()
+		return c.Conn.Close()
+	}
+	c.closed = true
+	c.queuePending()
+	c.mu.Unlock()
+
+	if c.writeMu.TryLock() {
+		deadline := time.Now().Add(CloseWait)
+		c.Conn.SetWriteDeadline(deadline)
+		c.drain(deadline)
+		c.writeMu.Unlock()
+	}
+	close(c.closing)
+	return c.Conn.Close()
+}
+
+func (c *Conn) errLocked() error {
+	if c.err != nil {
+		return c.err
+	}
+	if c.closed {
+		return net.ErrClosed
+	}
+	return nil
+}
+
+// queuePending moves what is held back to the queue. c.mu must be held.
+func (c *Conn) queuePending() {
+	if c.timer != nil {
+		c.timer.Stop()
+		c.timer = nil
+	}
+	if len(c.pending) > 0 {
+		c.queue = append(c.queue, c.pending)
+	}
+	c.pending, c.writes = nil, 0
+}
+
+// send writes the queue out. Whoever gets writeMu first writes everything
+// queued by then, so writes leave in order even when the timer races a
+// Write.
+func (c *Conn) send() error {
+	c.writeMu.Lock()
+	defer c.writeMu.Unlock()
+	return c.drain(time.Time{})
+}
+
+// drain writes the queue out with writeMu held, giving up at deadline if it
+// isn't zero.
+func (c *Conn) drain(deadline time.Time) error {
+	for {
+		c.mu.Lock()
+		if c.err != nil || len(c.queue) == 0 {
+			err := c.err
+			c.mu.Unlock()
+			return err
+		}
+		b := c.queue[0]
+		c.queue = c.queue[1:]
+		c.mu.Unlock()
+
+		if err := c.write(b, deadline); err != nil {
+			c.mu.Lock()
+			if c.err == nil {
+				c.err = err
+			}
+			c.mu.Unlock()
+			return err
+		}
+	}
+}
+
+// write splits b into segments.
+func (c *Conn) write(b []byte, deadline time.Time) error {
+	for len(b) > 0 {
+		n := len(b)
+		if c.opts.MaxSegment > 0 {
+			n = c.opts.MinSegment + c.rand.Intn(c.opts.MaxSegment-c.opts.MinSegment+1)
+			if n > len(b) {
+				n = len(b)
+			}
+		}
+		if _, err := c.Conn.Write(b[:n]); err != nil {
+			return err
+		}
+		b = b[n:]
+		if len(b) == 0 || c.opts.Delay == 0 {
+			continue
+		}
+		if !deadline.IsZero() && time.Now().Add(c.opts.Delay).After(deadline) {
+			return os.ErrDeadlineExceeded
+		}
+		select {
+		case <-time.After(c.opts.Delay):
+		case <-c.closing:
+			return net.ErrClosed
+		}
+	}
+	return nil
+}
+
+// SetNoDelay turns TCP_NODELAY on or off if c is a TCP connection. With it
+// off the kernel may gather small segments into bigger ones.
+func SetNoDelay(c net.Conn, noDelay bool) error {
+	if tcp, ok := c.(*net.TCPConn); ok {
+		return tcp.SetNoDelay(noDelay)
+	}
+	return nil
+}
+
+// Listener sets TCP_NODELAY on the connections it accepts.
+type Listener struct {
+	net.Listener
+	NoDelay bool
+}
+
+func (l Listener) Accept() (net.Conn, error) {
+	c, err := l.Listener.Accept()
+	if err != nil {
+		return nil, err
+	}
+	SetNoDelay(c, l.NoDelay)
+	return c, nil
+}
@@ -0,0 +1,208 @@
+// Copyright 2015 Yahoo Inc.
+// Licensed under the BSD license, see LICENSE file for terms.
+// Written by Stuart Larsen
+// http2fuzz - HTTP/2 Fuzzer
+package transport
+
+import (
+	"bytes"
+	"io"
+	"net"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseSegment(t *testing.T) {
+	tests := []struct {
+		in       string
+		min, max int
+		wantErr  bool
+	}{
+		{in: ""},
+		{in: "1", min: 1, max: 1},
+		{in: "100", min: 100, max: 100},
+		{in: "3-7", min: 3, max: 7},
+		{in: "5-5", min: 5, max: 5},
+		{in: "0", wantErr: true},
+		{in: "-1", wantErr: true},
+		{in: "7-3", wantErr: true},
+		{in: "0-3", wantErr: true},
+		{in: "3-", wantErr: true},
+		{in: "x", wantErr: true},
+		{in: "1-2-3", wantErr: true},
+	}
+	for _, tt := range tests {
+		min, max, err := ParseSegment(tt.in)
+		if tt.wantErr {
+			if err == nil {
+				t.Errorf("ParseSegment(%q) = %d, %d; want an error", tt.in, min, max)
+			}
+			continue
+		}
+		if err != nil || min != tt.min || max != tt.max {
+			t.Errorf("ParseSegment(%q) = %d, %d, %v; want %d, %d", tt.in, min, max, err, tt.min, tt.max)
+		}
+	}
+}
+
+// reads collects what arrives on a net.Pipe one read at a time, which is
+// one Write of the other end at a time.
+func reads(c net.Conn) <-chan []string {
+	out := make(chan []string, 1)
+	go func() {
+		got := []string{}
+		buf := make([]byte, 1<<16)
+		for {
+			n, err := c.Read(buf)
+			if err != nil {
+				out <- got
+				return
+			}
+			got = append(got, string(buf[:n]))
+		}
+	}()
+	return out
+}
+
+func TestNewZeroOptions(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	if c := New(client, Options{}); c != client {
+		t.Errorf("got %T, want the connection unwrapped", c)
+	}
+}
+
+func TestSegments(t *testing.T) {
+	tests := []struct {
+		name     string
+		opts     Options
+		min, max int
+	}{
+		{"fixed", Options{MinSegment: 3, MaxSegment: 3}, 3, 3},
+		{"range", Options{MinSegment: 2, MaxSegment: 5}, 2, 5},
+		{"delayed", Options{MinSegment: 4, MaxSegment: 4, Delay: time.Millisecond}, 4, 4},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			client, server := net.Pipe()
+			got := reads(server)
+			c := New(client, tt.opts)
+			data := []byte("the quick brown fox jumps over the lazy dog")
+			if n, err := c.Write(data); n != len(data) || err != nil {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			if n, err := c.Write([]byte("!")); n != 1 || err != nil {
+				t.Fatalf("Write = %d, %v", n, err)
+			}
+			c.Close()
+
+			segments := <-got
+			if joined := strings.Join(segments, ""); joined != string(data)+"!" {
+				t.Fatalf("got %q", joined)
+			}
+			for i, s := range segments[:len(segments)-2] {
+				if len(s) < tt.min || len(s) > tt.max {
+					t.Errorf("segment %d is %d bytes, want %d-%d", i, len(s), tt.min, tt.max)
+				}
+			}
+			if last := segments[len(segments)-1]; last != "!" {
+				t.Errorf("a segment crosses writes: %q", segments)
+			}
+		})
+	}
+}
+
+func TestCoalesce(t *testing.T) {
+	client, server := net.Pipe()
+	got := reads(server)
+	c := New(client, Options{Coalesce: 3})
+	for _, s := range []string{"a", "b", "c", "d", "e"} {
+		if _, err := c.Write([]byte(s)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// The last two are held back until Close.
+	c.Close()
+	if segments := <-got; !reflect.DeepEqual(segments, []string{"abc", "de"}) {
+		t.Errorf("got %q", segments)
+	}
+}
+
+func TestCoalesceWait(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	c := New(client, Options{Coalesce: 10})
+	defer c.Close()
+	start := time.Now()
+	if _, err := c.Write([]byte("held")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 16)
+	server.SetReadDeadline(time.Now().Add(5 * CoalesceWait))
+	n, err := server.Read(buf)
+	if err != nil || string(buf[:n]) != "held" {
+		t.Fatalf("got %q, %v", buf[:n], err)
+	}
+	if waited := time.Since(start); waited < CoalesceWait {
+		t.Errorf("written after %v, want %v", waited, CoalesceWait)
+	}
+}
+
+// Close mustn't wait for a write that is sleeping between segments, or one
+// stuck on a peer that doesn't read, and the write has to give up.
+func TestCloseDuringWrite(t *testing.T) {
+	for _, delay := range []time.Duration{time.Hour, 0} {
+		client, server := net.Pipe()
+		c := New(client, Options{MinSegment: 1, MaxSegment: 1, Delay: delay})
+		written := make(chan error, 1)
+		go func() {
+			_, err := c.Write([]byte("abc"))
+			written <- err
+		}()
+		if _, err := io.ReadFull(server, make([]byte, 1)); err != nil {
+			t.Fatal(err)
+		}
+		// With no delay the write is now blocked on the second byte.
+
+		closed := make(chan error, 1)
+		go func() { closed <- c.Close() }()
+		select {
+		case <-closed:
+		case <-time.After(CloseWait / 2):
+			t.Fatalf("delay %v: Close waited for the write", delay)
+		}
+		select {
+		case err := <-written:
+			if err == nil {
+				t.Errorf("delay %v: write finished after Close", delay)
+			}
+		case <-time.After(time.Second):
+			t.Fatalf("delay %v: write still going after Close", delay)
+		}
+		if _, err := c.Write([]byte("x")); err == nil {
+			t.Errorf("delay %v: Write after Close worked", delay)
+		}
+		server.Close()
+	}
+}
+
+// Coalesced writes go out in order, however they are segmented.
+func TestCoalesceOrder(t *testing.T) {
+	client, server := net.Pipe()
+	got := reads(server)
+	c := New(client, Options{MinSegment: 1, MaxSegment: 2, Delay: time.Millisecond, Coalesce: 2})
+	var want bytes.Buffer
+	for i := 0; i < 200; i++ {
+		b := []byte{byte('a' + i%26)}
+		want.Write(b)
+		if _, err := c.Write(b); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.Close()
+	if joined := strings.Join(<-got, ""); joined != want.String() {
+		t.Errorf("got %q, want %q", joined, want.String())
+	}
+}